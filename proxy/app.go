@@ -1,74 +1,169 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	gorillaHandlers "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 
+	"github.com/flightctl/flightctl-ui/audit"
 	"github.com/flightctl/flightctl-ui/auth"
 	"github.com/flightctl/flightctl-ui/bridge"
 	"github.com/flightctl/flightctl-ui/config"
 	"github.com/flightctl/flightctl-ui/log"
+	"github.com/flightctl/flightctl-ui/metrics"
 	"github.com/flightctl/flightctl-ui/middleware"
+	"github.com/flightctl/flightctl-ui/recording"
 	"github.com/flightctl/flightctl-ui/server"
+	"github.com/flightctl/flightctl-ui/tracing"
 )
 
 func corsHandler(router *mux.Router) http.Handler {
 	return gorillaHandlers.CORS(
 		gorillaHandlers.AllowedOrigins([]string{"http://localhost:9000"}),
 		gorillaHandlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "PATCH"}),
-		gorillaHandlers.AllowedHeaders([]string{"Content-Type", "Authorization", "X-FlightCtl-Organization-ID", "Flightctl-API-Version"}),
+		gorillaHandlers.AllowedHeaders([]string{"Content-Type", "Authorization", "X-FlightCtl-Organization-ID", "X-FlightCtl-Instance", "Flightctl-API-Version", "X-Request-ID", "traceparent", "tracestate"}),
+		gorillaHandlers.ExposedHeaders([]string{"X-Request-ID"}),
 		gorillaHandlers.AllowCredentials(),
 	)(router)
 }
 
 func main() {
 	log := log.InitLogs()
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		log.WithError(err).Error("Failed to initialize tracing")
+		os.Exit(1)
+	}
+
 	router := mux.NewRouter()
+	router.Use(middleware.RequestIDMiddleware)
+	router.Use(middleware.TracingMiddleware)
+	router.Use(middleware.RoutePolicyMiddleware)
 	apiRouter := router.PathPrefix("/api").Subrouter()
 
-	apiRouter.Use(middleware.AuthMiddleware)
-	apiRouter.Use(middleware.OrganizationMiddleware)
-
 	tlsConfig, err := bridge.GetTlsConfig()
 	if err != nil {
 		log.WithError(err).Error("Failed to get TLS configuration")
 		os.Exit(1)
 	}
 
-	apiRouter.Handle("/imagebuilder/{forward:.*}", bridge.NewImageBuilderHandler(tlsConfig))
+	if err := audit.Init(); err != nil {
+		log.WithError(err).Error("Failed to initialize the audit log")
+		os.Exit(1)
+	}
 
-	apiRouter.Handle("/flightctl/{forward:.*}", bridge.NewFlightCtlHandler(tlsConfig))
+	if err := recording.Init(); err != nil {
+		log.WithError(err).Error("Failed to initialize terminal recording")
+		os.Exit(1)
+	}
 
-	alertManagerUrl, alertManagerEnabled := os.LookupEnv("FLIGHTCTL_ALERTMANAGER_PROXY")
-	if alertManagerEnabled && alertManagerUrl != "" {
-		apiRouter.Handle("/alerts/{forward:.*}", bridge.NewAlertManagerHandler(tlsConfig))
-	} else {
-		apiRouter.HandleFunc("/alerts/{forward:.*}", bridge.UnimplementedHandler)
+	authHandler, err := auth.NewInstanceAuthHandler()
+	if err != nil {
+		log.WithError(err).Error("Failed to initialize authentication")
+		os.Exit(1)
 	}
+	withUserIdentity := middleware.UserIdentityMiddleware(authHandler.ResolveUsername)
 
-	cliArtifactsUrl, cliArtifactsEnabled := os.LookupEnv("FLIGHTCTL_CLI_ARTIFACTS_SERVER")
-	if cliArtifactsEnabled && cliArtifactsUrl != "" {
-		apiRouter.Handle("/cli-artifacts", bridge.NewFlightCtlCliArtifactsHandler(tlsConfig))
-	} else {
-		apiRouter.HandleFunc("/cli-artifacts", bridge.UnimplementedHandler)
+	apiRouter.Use(middleware.AuthMiddleware)
+	// Auditing needs the organization header, which OrganizationMiddleware converts to a query parameter
+	apiRouter.Use(middleware.AuditMiddleware(authHandler.ResolveUsername))
+	apiRouter.Use(middleware.OrganizationMiddleware)
+
+	// Every Flight Control instance has its own upstream handlers
+	instanceHandler := func(newHandler func(instance config.Instance, tlsConfig *tls.Config) http.Handler) http.Handler {
+		handler, err := bridge.NewInstanceHandler(newHandler)
+		if err != nil {
+			log.WithError(err).Error("Failed to initialize the instance handlers")
+			os.Exit(1)
+		}
+		return handler
+	}
+
+	apiRouter.Handle("/imagebuilder/{forward:.*}", instanceHandler(func(instance config.Instance, tlsConfig *tls.Config) http.Handler {
+		return bridge.NewImageBuilderHandler(instance, tlsConfig)
+	}))
+
+	apiRouter.Handle("/flightctl/{forward:.*}", instanceHandler(func(instance config.Instance, tlsConfig *tls.Config) http.Handler {
+		return bridge.WithResponseCache(bridge.NewFlightCtlHandler(instance, tlsConfig))
+	}))
+
+	apiRouter.Handle("/alerts/{forward:.*}", instanceHandler(func(instance config.Instance, tlsConfig *tls.Config) http.Handler {
+		if instance.AlertManagerUrl == "" {
+			return http.HandlerFunc(bridge.UnimplementedHandler)
+		}
+		return bridge.NewAlertManagerHandler(instance, tlsConfig)
+	}))
+
+	apiRouter.Handle("/alerts-stream", instanceHandler(func(instance config.Instance, tlsConfig *tls.Config) http.Handler {
+		if instance.AlertManagerUrl == "" {
+			return http.HandlerFunc(bridge.UnimplementedHandler)
+		}
+		return bridge.NewAlertStreamHandler(instance, tlsConfig)
+	}))
+
+	apiRouter.Handle("/cli-artifacts", instanceHandler(func(instance config.Instance, tlsConfig *tls.Config) http.Handler {
+		if instance.CliArtifactsUrl == "" {
+			return http.HandlerFunc(bridge.UnimplementedHandler)
+		}
+		return bridge.NewFlightCtlCliArtifactsHandler(instance, tlsConfig)
+	}))
+
+	apiRouter.Handle("/terminal/{forward:.*}", withUserIdentity(instanceHandler(func(instance config.Instance, tlsConfig *tls.Config) http.Handler {
+		terminalBridge := bridge.TerminalBridge{TlsConfig: tlsConfig, ResumeGracePeriod: config.TerminalResumeGracePeriod}
+		return http.HandlerFunc(terminalBridge.HandleTerminal)
+	})))
+
+	apiRouter.Handle("/console/broadcast", withUserIdentity(instanceHandler(func(instance config.Instance, tlsConfig *tls.Config) http.Handler {
+		return bridge.NewTerminalBroadcastHandler(instance, tlsConfig)
+	}))).Methods(http.MethodPost)
+
+	// WebSocket connections to the upstream paths allowed by WEBSOCKET_ROUTES_FILE
+	apiRouter.Handle("/ws/flightctl/{forward:.*}", instanceHandler(func(instance config.Instance, tlsConfig *tls.Config) http.Handler {
+		return bridge.NewFlightCtlWebsocketProxy(instance, tlsConfig)
+	}))
+	apiRouter.Handle("/ws/imagebuilder/{forward:.*}", instanceHandler(func(instance config.Instance, tlsConfig *tls.Config) http.Handler {
+		return bridge.NewImageBuilderWebsocketProxy(instance, tlsConfig)
+	}))
+
+	// Terminal recordings and open sessions can only be accessed by administrators
+	apiRouter.Handle("/admin/terminal-recordings", withUserIdentity(middleware.RequireAdmin(http.HandlerFunc(recording.ListHandler)))).Methods(http.MethodGet)
+	apiRouter.Handle("/admin/terminal-recordings/{id}", withUserIdentity(middleware.RequireAdmin(http.HandlerFunc(recording.GetHandler)))).Methods(http.MethodGet, http.MethodHead)
+	apiRouter.Handle("/admin/terminal-sessions", withUserIdentity(middleware.RequireAdmin(http.HandlerFunc(bridge.ListTerminalSessions)))).Methods(http.MethodGet)
+	apiRouter.Handle("/admin/terminal-sessions/{id}", withUserIdentity(middleware.RequireAdmin(http.HandlerFunc(bridge.TerminateTerminalSession)))).Methods(http.MethodDelete)
+	// Sessions can also be observed by the users of TERMINAL_OBSERVER_USERS with access to the device
+	apiRouter.Handle("/admin/terminal-sessions/{id}/observe", withUserIdentity(instanceHandler(func(instance config.Instance, tlsConfig *tls.Config) http.Handler {
+		return bridge.NewTerminalObserveHandler(instance, tlsConfig)
+	}))).Methods(http.MethodGet)
+
+	instancesHandler, err := bridge.NewInstancesHandler(authHandler.AuthConfigStatus)
+	if err != nil {
+		log.WithError(err).Error("Failed to initialize the instances handler")
+		os.Exit(1)
 	}
+	apiRouter.Handle("/instances", instancesHandler).Methods(http.MethodGet)
 
-	terminalBridge := bridge.TerminalBridge{TlsConfig: tlsConfig}
-	apiRouter.HandleFunc("/terminal/{forward:.*}", terminalBridge.HandleTerminal)
+	// Sub-requests of a batch are routed like direct calls, through the same middlewares
+	apiRouter.Handle("/batch", bridge.NewBatchHandler(router))
 
 	testAuthHandler := bridge.NewTestAuthHandler(tlsConfig)
-	apiRouter.HandleFunc("/test-auth-provider-connection", testAuthHandler.TestConnection)
+	apiRouter.Handle("/test-auth-provider-connection", withUserIdentity(http.HandlerFunc(testAuthHandler.TestConnection)))
 
-	authHandler, err := auth.NewAuth(tlsConfig)
+	testLoginHandler, err := auth.NewTestLoginHandler()
 	if err != nil {
-		log.WithError(err).Error("Failed to initialize authentication")
+		log.WithError(err).Error("Failed to initialize the test login handler")
 		os.Exit(1)
 	}
+	apiRouter.Handle("/test-auth-provider-login", withUserIdentity(http.HandlerFunc(testLoginHandler.StartTestLogin)))
+	apiRouter.Handle("/test-auth-provider-login/complete", withUserIdentity(http.HandlerFunc(testLoginHandler.CompleteTestLogin)))
+	// The identity provider redirects the test login popup here rather than to the login callback of the UI
+	apiRouter.HandleFunc("/test-auth-provider-login/callback", testLoginHandler.TestLoginCallback).Methods(http.MethodGet)
 	// Viewing the login command is always available
 	apiRouter.HandleFunc("/login-command", authHandler.GetLoginCommand)
 
@@ -98,10 +193,45 @@ func main() {
 	}
 
 	srv := &http.Server{
-		Handler:      corsHandler(router),
-		Addr:         config.BridgePort,
-		WriteTimeout: 15 * time.Minute, // Long timeout for streaming responses (SSE, chunked encoding)
-		ReadTimeout:  15 * time.Second,
+		// The instance is selected before routing, since it can be part of the path
+		Handler: middleware.InstanceMiddleware(corsHandler(router)),
+		Addr:    config.BridgePort,
+		// Read and write deadlines are set for each request by the route policies
+		ReadHeaderTimeout: 15 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	// On shutdown, let in-flight requests complete and flush the pending spans
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.WithError(err).Warn("Failed to shut down the server gracefully")
+		}
+	}()
+
+	// Metrics are served on their own listener, which is not exposed with the UI
+	if config.MetricsAddress != "" {
+		metricsRouter := mux.NewRouter()
+		metricsRouter.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet)
+		metricsSrv := &http.Server{
+			Handler:           metricsRouter,
+			Addr:              config.MetricsAddress,
+			ReadHeaderTimeout: 15 * time.Second,
+		}
+		go func() {
+			<-ctx.Done()
+			_ = metricsSrv.Close()
+		}()
+		go func() {
+			log.Info("Metrics available at", config.MetricsAddress)
+			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.WithError(err).Error("Failed to serve the metrics")
+			}
+		}()
 	}
 
 	log.Info("Proxy running at", config.BridgePort)
@@ -109,9 +239,17 @@ func main() {
 	if serverTlsconfig != nil {
 		srv.TLSConfig = serverTlsconfig
 		log.Info("Running as HTTPS")
-		log.Fatal(srv.ListenAndServeTLS("", ""))
+		err = srv.ListenAndServeTLS("", "")
 	} else {
-		log.Fatal(srv.ListenAndServe())
+		err = srv.ListenAndServe()
 	}
 
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.WithError(err).Warn("Failed to flush the pending traces")
+	}
 }
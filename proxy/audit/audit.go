@@ -0,0 +1,195 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/log"
+)
+
+// Event types
+const (
+	EventAPICall           = "api-call"
+	EventTerminalOpen      = "terminal-open"
+	EventTerminalClose     = "terminal-close"
+	EventRecordingView     = "terminal-recording-view"
+	EventTerminalTerminate = "terminal-terminate"
+	EventTerminalObserve   = "terminal-observe"
+	EventTerminalResume    = "terminal-resume"
+	EventTerminalCommand   = "terminal-command-policy"
+	EventTerminalBroadcast = "terminal-broadcast"
+)
+
+// Entry is a single audit record, written as one JSON line
+type Entry struct {
+	Timestamp    time.Time       `json:"timestamp"`
+	Event        string          `json:"event"`
+	RequestID    string          `json:"requestId,omitempty"`
+	Username     string          `json:"username,omitempty"`
+	Provider     string          `json:"provider,omitempty"`
+	Instance     string          `json:"instance,omitempty"`
+	Organization string          `json:"organization,omitempty"`
+	ClientIP     string          `json:"clientIp,omitempty"`
+	Method       string          `json:"method,omitempty"`
+	Path         string          `json:"path,omitempty"`
+	Device       string          `json:"device,omitempty"`
+	Status       int             `json:"status,omitempty"`
+	DurationMs   int64           `json:"durationMs,omitempty"`
+	Body         json.RawMessage `json:"body,omitempty"`
+	Detail       string          `json:"detail,omitempty"`
+}
+
+type auditLogger struct {
+	mu      sync.Mutex
+	writers []io.Writer
+}
+
+var logger *auditLogger
+
+// Init sets up the audit sinks from the configuration. Auditing stays disabled when no sink is configured.
+func Init() error {
+	var writers []io.Writer
+
+	if config.AuditLogFile != "" {
+		file, err := newRotatingFile(config.AuditLogFile, int64(config.AuditLogMaxSizeMB)*1024*1024, config.AuditLogMaxBackups)
+		if err != nil {
+			return err
+		}
+		writers = append(writers, file)
+	}
+
+	if config.AuditLogSyslog == "true" {
+		network, address, err := parseSyslogAddress(config.AuditLogSyslogAddress)
+		if err != nil {
+			return err
+		}
+		syslogWriter, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_AUTH, "flightctl-ui-audit")
+		if err != nil {
+			return fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+		writers = append(writers, syslogWriter)
+	}
+
+	if len(writers) == 0 {
+		logger = nil
+		return nil
+	}
+	logger = &auditLogger{writers: writers}
+	return nil
+}
+
+// parseSyslogAddress accepts an empty address for the local syslog daemon, or <network>://<host>:<port>
+func parseSyslogAddress(address string) (string, string, error) {
+	if address == "" {
+		return "", "", nil
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return "", "", fmt.Errorf("invalid syslog address %q, expected <udp|tcp>://<host>:<port>", address)
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return "", "", fmt.Errorf("unsupported syslog network %q", u.Scheme)
+	}
+	return u.Scheme, u.Host, nil
+}
+
+// Enabled reports whether audit records are being written
+func Enabled() bool {
+	return logger != nil
+}
+
+// Record writes an audit entry to every configured sink
+func Record(entry Entry) {
+	if logger == nil {
+		return
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now().UTC()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.GetLogger().WithError(err).Error("Failed to marshal audit record")
+		return
+	}
+	line = append(line, '\n')
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	for _, w := range logger.writers {
+		if _, err := w.Write(line); err != nil {
+			log.GetLogger().WithError(err).Error("Failed to write audit record")
+		}
+	}
+}
+
+// redactedValue replaces the value of sensitive fields in recorded bodies
+const redactedValue = "[REDACTED]"
+
+// sensitiveKeyFragments identify JSON fields whose values must never reach the audit log
+var sensitiveKeyFragments = []string{
+	"password",
+	"secret",
+	"token",
+	"privatekey",
+	"credential",
+	"authorization",
+	"apikey",
+	"passphrase",
+	"sshkey",
+}
+
+func isSensitiveKey(key string) bool {
+	normalized := strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+	for _, fragment := range sensitiveKeyFragments {
+		if strings.Contains(normalized, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+func redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if isSensitiveKey(key) {
+				v[key] = redactedValue
+			} else {
+				v[key] = redact(child)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redact(child)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// RedactBody returns a JSON body with the values of sensitive fields replaced.
+// Bodies that are not JSON are not recorded, only their size.
+func RedactBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	var parsed interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		summary, _ := json.Marshal(fmt.Sprintf("[%d bytes of non-JSON content omitted]", len(body)))
+		return summary
+	}
+	redacted, err := json.Marshal(redact(parsed))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
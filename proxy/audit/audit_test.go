@@ -0,0 +1,74 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRedactBody(t *testing.T) {
+	t.Parallel()
+
+	body := []byte(`{"metadata":{"name":"repo"},"spec":{"url":"https://git.example.com","httpConfig":{"password":"hunter2","token":"abc"},"sshConfig":{"sshPrivateKey":"key"}},"items":[{"client_secret":"s"}]}`)
+
+	var redacted map[string]interface{}
+	if err := json.Unmarshal(RedactBody(body), &redacted); err != nil {
+		t.Fatalf("redacted body is not valid JSON: %v", err)
+	}
+
+	spec := redacted["spec"].(map[string]interface{})
+	if spec["url"] != "https://git.example.com" {
+		t.Errorf("expected non-sensitive fields to be kept, got %v", spec["url"])
+	}
+	httpConfig := spec["httpConfig"].(map[string]interface{})
+	if httpConfig["password"] != redactedValue || httpConfig["token"] != redactedValue {
+		t.Errorf("expected credentials to be redacted, got %v", httpConfig)
+	}
+	if spec["sshConfig"].(map[string]interface{})["sshPrivateKey"] != redactedValue {
+		t.Errorf("expected private key to be redacted")
+	}
+	item := redacted["items"].([]interface{})[0].(map[string]interface{})
+	if item["client_secret"] != redactedValue {
+		t.Errorf("expected secrets inside arrays to be redacted")
+	}
+
+	if string(RedactBody([]byte("not json"))) != `"[8 bytes of non-JSON content omitted]"` {
+		t.Errorf("expected non-JSON bodies to be omitted, got %s", RedactBody([]byte("not json")))
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f, err := newRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("failed to create audit file: %v", err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		if string(data) != content {
+			t.Errorf("expected %s to contain %q, got %q", name, content, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 backups to be kept")
+	}
+}
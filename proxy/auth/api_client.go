@@ -2,6 +2,7 @@ package auth
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -11,6 +12,8 @@ import (
 	"time"
 
 	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/tracing"
 	"github.com/flightctl/flightctl/api/v1beta1"
 )
 
@@ -18,7 +21,7 @@ import (
 const k8sServiceAccountPrefix = "system:serviceaccount:"
 
 // exchangeTokenWithApiServer allows us to perform the token exchange through the Flight Control API
-func exchangeTokenWithApiServer(apiTlsConfig *tls.Config, providerConfig *v1beta1.AuthProvider, tokenReq *v1beta1.TokenRequest) (*v1beta1.TokenResponse, error) {
+func exchangeTokenWithApiServer(ctx context.Context, instance config.Instance, apiTlsConfig *tls.Config, providerConfig *v1beta1.AuthProvider, tokenReq *v1beta1.TokenRequest) (*v1beta1.TokenResponse, error) {
 	if providerConfig == nil || providerConfig.Metadata.Name == nil {
 		return nil, fmt.Errorf("invalid provider configuration")
 	}
@@ -30,7 +33,7 @@ func exchangeTokenWithApiServer(apiTlsConfig *tls.Config, providerConfig *v1beta
 		Timeout: 30 * time.Second,
 	}
 
-	tokenURL, err := common.BuildFctlApiUrl("api/v1/auth", *providerConfig.Metadata.Name, "token")
+	tokenURL, err := common.BuildFctlApiUrl(instance, "api/v1/auth", *providerConfig.Metadata.Name, "token")
 	if err != nil {
 		return nil, fmt.Errorf("failed to construct token URL: %w", err)
 	}
@@ -41,7 +44,7 @@ func exchangeTokenWithApiServer(apiTlsConfig *tls.Config, providerConfig *v1beta
 		return nil, fmt.Errorf("failed to marshal token request: %w", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, tokenURL, bytes.NewReader(reqBody))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create token request: %w", err)
 	}
@@ -49,7 +52,7 @@ func exchangeTokenWithApiServer(apiTlsConfig *tls.Config, providerConfig *v1beta
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := client.Do(req)
+	resp, err := tracing.Do(client, req, "exchangeTokenWithApiServer")
 	if err != nil {
 		return nil, fmt.Errorf("failed to call API server token endpoint: %w", err)
 	}
@@ -97,7 +100,7 @@ func exchangeTokenWithApiServer(apiTlsConfig *tls.Config, providerConfig *v1beta
 }
 
 // getUserInfoFromApiServer allows us to get the user info from the Flight Control API
-func getUserInfoFromApiServer(apiTlsConfig *tls.Config, token string) (string, error) {
+func getUserInfoFromApiServer(ctx context.Context, instance config.Instance, apiTlsConfig *tls.Config, token string) (string, error) {
 	client := &http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: apiTlsConfig,
@@ -105,12 +108,12 @@ func getUserInfoFromApiServer(apiTlsConfig *tls.Config, token string) (string, e
 		Timeout: 30 * time.Second,
 	}
 
-	userInfoURL, err := common.BuildFctlApiUrl("api/v1/auth/userinfo")
+	userInfoURL, err := common.BuildFctlApiUrl(instance, "api/v1/auth/userinfo")
 	if err != nil {
 		return "", &UserInfoError{UserMessage: "Unable to reach userinfo service.", Err: err}
 	}
 
-	req, err := http.NewRequest(http.MethodGet, userInfoURL, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, userInfoURL, nil)
 	if err != nil {
 		return "", &UserInfoError{UserMessage: "Unable to reach userinfo service.", Err: err}
 	}
@@ -118,7 +121,7 @@ func getUserInfoFromApiServer(apiTlsConfig *tls.Config, token string) (string, e
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := client.Do(req)
+	resp, err := tracing.Do(client, req, "getUserInfoFromApiServer")
 	if err != nil {
 		return "", &UserInfoError{UserMessage: "Unable to reach userinfo service.", Err: err}
 	}
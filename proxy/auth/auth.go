@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -9,10 +10,13 @@ import (
 	"net/http"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/flightctl/flightctl-ui/common"
 	"github.com/flightctl/flightctl-ui/config"
 	"github.com/flightctl/flightctl-ui/log"
+	"github.com/flightctl/flightctl-ui/tracing"
 	"github.com/flightctl/flightctl/api/v1beta1"
 )
 
@@ -58,29 +62,71 @@ func (e *UserInfoError) Unwrap() error {
 	return e.Err
 }
 
+const (
+	// authConfigTimeout bounds a fetch of the auth config of an instance
+	authConfigTimeout = 10 * time.Second
+	// authConfigRetryInterval spaces the fetches of the auth config while the instance cannot be reached
+	authConfigRetryInterval = 10 * time.Second
+)
+
 type AuthHandler struct {
-	provider       AuthProvider
-	apiTlsConfig   *tls.Config
-	authConfigData *v1beta1.AuthConfig
+	instance     config.Instance
+	provider     AuthProvider
+	apiTlsConfig *tls.Config
+	authConfig   *authConfigState
+	usernames    *usernameCache
+	throttle     *loginThrottle
+}
+
+// authConfigState tracks whether the auth config of the instance could be fetched. Until it is, the
+// instance cannot be logged in to, without preventing the proxy from serving the other instances.
+type authConfigState struct {
+	mu        sync.Mutex
+	loaded    bool
+	err       error
+	checkedAt time.Time
 }
 
-func NewAuth(apiTlsConfig *tls.Config) (*AuthHandler, error) {
-	auth := AuthHandler{
+// NewAuth creates the authentication handler of a Flight Control instance. Its auth config is
+// fetched in the background, and again on demand while the instance cannot be reached. The login
+// throttle is shared by all the instances, so that the per-IP budget does not grow with them.
+func NewAuth(instance config.Instance, apiTlsConfig *tls.Config, throttle *loginThrottle) *AuthHandler {
+	auth := &AuthHandler{
+		instance:     instance,
 		apiTlsConfig: apiTlsConfig,
+		authConfig:   &authConfigState{},
+		usernames:    newUsernameCache(),
+		throttle:     throttle,
 	}
-	authConfig, err := getAuthInfo(apiTlsConfig)
-	if err != nil {
-		return nil, err
-	}
+	go func() {
+		if err := auth.authConfigStatus(context.Background()); err != nil {
+			log.GetLogger().WithError(err).Warnf("Failed to get the auth config of instance %s, it is unavailable until it can be reached", instance.Name)
+		}
+	}()
+	return auth
+}
 
-	if authConfig == nil {
-		return nil, fmt.Errorf("Auth config is missing")
+// authConfigStatus returns nil once the auth config of the instance has been fetched, and otherwise
+// the error of the last attempt. Attempts are spaced by authConfigRetryInterval.
+func (a *AuthHandler) authConfigStatus(ctx context.Context) error {
+	s := a.authConfig
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loaded || (s.err != nil && time.Since(s.checkedAt) < authConfigRetryInterval) {
+		return s.err
 	}
 
-	// Store the full auth config for later use
-	auth.authConfigData = authConfig
-
-	return &auth, nil
+	ctx, cancel := context.WithTimeout(ctx, authConfigTimeout)
+	defer cancel()
+	authConfig, err := getAuthInfo(ctx, a.instance, a.apiTlsConfig)
+	if err == nil && authConfig == nil {
+		err = fmt.Errorf("Auth config is missing")
+	}
+	if err == nil && s.err != nil {
+		log.GetLogger().Infof("Got the auth config of instance %s", a.instance.Name)
+	}
+	s.loaded, s.err, s.checkedAt = err == nil, err, time.Now()
+	return err
 }
 
 // findProviderConfig finds a provider config by name from the auth config
@@ -100,8 +146,8 @@ func findProviderConfig(authConfig *v1beta1.AuthConfig, providerName string) (*v
 
 // getProviderInstance creates a provider instance by fetching the latest auth config
 // Returns both the provider instance and the provider config to avoid duplicate API calls
-func (a *AuthHandler) getProviderInstance(providerName string) (AuthProvider, *v1beta1.AuthProvider, error) {
-	authConfig, err := getAuthInfo(a.apiTlsConfig)
+func (a *AuthHandler) getProviderInstance(ctx context.Context, providerName string) (AuthProvider, *v1beta1.AuthProvider, error) {
+	authConfig, err := getAuthInfo(ctx, a.instance, a.apiTlsConfig)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to get auth config: %w", err)
 	}
@@ -137,7 +183,7 @@ func (a *AuthHandler) getProviderInstance(providerName string) (AuthProvider, *v
 			return nil, nil, fmt.Errorf("failed to parse K8s provider spec for %s: %w", providerName, err)
 		}
 		// This is regular k8s token auth
-		provider, err = getK8sAuthHandler(providerConfig, &k8sSpec)
+		provider, err = getK8sAuthHandler(a.instance, a.apiTlsConfig, providerConfig, &k8sSpec)
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to create K8s provider %s: %w", providerName, err)
 		}
@@ -146,7 +192,7 @@ func (a *AuthHandler) getProviderInstance(providerName string) (AuthProvider, *v
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to parse OIDC provider spec for %s: %w", providerName, err)
 		}
-		oidcHandler, err := getOIDCAuthHandler(providerConfig, &oidcSpec)
+		oidcHandler, err := getOIDCAuthHandler(ctx, providerConfig, &oidcSpec)
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to create OIDC provider %s: %w", providerName, err)
 		}
@@ -263,7 +309,47 @@ func handleTokenProviderLogin(w http.ResponseWriter, r *http.Request, tokenProvi
 	return true
 }
 
+// loginProviderName returns the provider targeted by a login request, for throttling purposes only
+func loginProviderName(r *http.Request) string {
+	providerName := r.URL.Query().Get("provider")
+	if providerName == "" && r.Method == http.MethodPost {
+		providerName, _ = getStateCookie(r, r.URL.Query().Get("state"))
+	}
+	if !common.IsSafeResourceName(providerName) {
+		return ""
+	}
+	return providerName
+}
+
 func (a AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	clientIP := clientIPKey(r)
+	providerName := loginProviderName(r)
+	// Providers are only unique within their instance
+	throttleProvider := providerName
+	if providerName != "" {
+		throttleProvider = a.instance.Name + "/" + providerName
+	}
+	if throttleErr := a.throttle.allow(clientIP, throttleProvider); throttleErr != nil {
+		log.GetLogger().Warnf("Throttled login request for provider %q from %s: %s", providerName, clientIP, throttleErr.reason)
+		respondThrottled(w, throttleErr)
+		return
+	}
+
+	recorder := common.NewStatusRecorder(w)
+	a.login(recorder, r, clientIP)
+
+	// Only completing a login can fail because of wrong credentials
+	if r.Method == http.MethodPost {
+		switch recorder.Status() {
+		case http.StatusOK:
+			a.throttle.recordSuccess(clientIP, throttleProvider)
+		case http.StatusBadRequest, http.StatusUnauthorized:
+			a.throttle.recordFailure(clientIP, throttleProvider)
+		}
+	}
+}
+
+func (a AuthHandler) login(w http.ResponseWriter, r *http.Request, clientIP string) {
 	// For GET requests, extract provider from query parameter
 	var provider AuthProvider
 	var err error
@@ -274,7 +360,7 @@ func (a AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		provider, _, err = a.getProviderInstance(providerName)
+		provider, _, err = a.getProviderInstance(r.Context(), providerName)
 		if err != nil {
 			log.GetLogger().WithError(err).Warn("Failed to set up authentication provider")
 			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid authentication provider: %s", providerName))
@@ -319,6 +405,12 @@ func (a AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if throttleErr := a.throttle.beginTransaction(clientIP, state); throttleErr != nil {
+			log.GetLogger().Warnf("Throttled login request for provider %q from %s: %s", providerName, clientIP, throttleErr.reason)
+			respondThrottled(w, throttleErr)
+			return
+		}
+
 		// Store code verifier in cookie for later use during token exchange
 		setPKCEVerifierCookie(w, r, providerName, codeVerifier)
 
@@ -356,7 +448,7 @@ func (a AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		// Token providers pass provider in query param, not state
 		providerNameFromQuery := r.URL.Query().Get("provider")
 		if providerNameFromQuery != "" && common.IsSafeResourceName(providerNameFromQuery) {
-			provider, _, err := a.getProviderInstance(providerNameFromQuery)
+			provider, _, err := a.getProviderInstance(r.Context(), providerNameFromQuery)
 			if err == nil && isProviderWithCustomerToken(provider) {
 				// Handle token provider login immediately and return
 				tokenProvider := provider.(*TokenAuthProvider)
@@ -379,9 +471,10 @@ func (a AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
+		a.throttle.endTransaction(clientIP, state)
 
 		var providerConfig *v1beta1.AuthProvider
-		provider, providerConfig, err = a.getProviderInstance(providerName)
+		provider, providerConfig, err = a.getProviderInstance(r.Context(), providerName)
 		if err != nil {
 			log.GetLogger().WithError(err).Warnf("Failed to set up authentication provider %s", providerName)
 			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid authentication provider: %s", providerName))
@@ -457,7 +550,7 @@ func (a AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 			RedirectUri:  &redirectURI,
 		}
 
-		tokenResp, err := exchangeTokenWithApiServer(a.apiTlsConfig, providerConfig, tokenReq)
+		tokenResp, err := exchangeTokenWithApiServer(r.Context(), a.instance, a.apiTlsConfig, providerConfig, tokenReq)
 		if err != nil {
 			log.GetLogger().WithError(err).Warn("Failed to exchange token with API server")
 			handleOAuthErrorResponse(w, tokenResp, "Failed to obtain login authorization code")
@@ -487,7 +580,7 @@ func (a AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
 
 	// Get provider to determine routing
 	var providerConfig *v1beta1.AuthProvider
-	provider, providerConfig, err := a.getProviderInstance(tokenData.Provider)
+	provider, providerConfig, err := a.getProviderInstance(r.Context(), tokenData.Provider)
 	if err != nil {
 		log.GetLogger().WithError(err).Warnf("Failed to set up authentication for provider %s", tokenData.Provider)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -517,7 +610,7 @@ func (a AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
 		RefreshToken: &tokenData.RefreshToken,
 	}
 
-	tokenResp, err := exchangeTokenWithApiServer(a.apiTlsConfig, providerConfig, tokenReq)
+	tokenResp, err := exchangeTokenWithApiServer(r.Context(), a.instance, a.apiTlsConfig, providerConfig, tokenReq)
 	if err != nil {
 		log.GetLogger().WithError(err).Warn("Failed to exchange token with API server")
 		handleOAuthErrorResponse(w, tokenResp, "Failed to obtain new access token")
@@ -548,6 +641,7 @@ func respondWithToken(w http.ResponseWriter, r *http.Request, tokenData TokenDat
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	sessionProviders.set(common.InstanceFromContext(r.Context()).Name, tokenData.Token, tokenData.Provider, expires)
 	exp, err := json.Marshal(ExpiresInResp{ExpiresIn: expires})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -579,7 +673,7 @@ func (a AuthHandler) GetUserInfo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Route ALL providers to API server userinfo endpoint
-	username, err := getUserInfoFromApiServer(a.apiTlsConfig, token)
+	username, err := getUserInfoFromApiServer(r.Context(), a.instance, a.apiTlsConfig, token)
 	if err != nil {
 		log.GetLogger().WithError(err).Warn("Failed to get user info from API server")
 
@@ -600,6 +694,20 @@ func (a AuthHandler) GetUserInfo(w http.ResponseWriter, r *http.Request) {
 	a.respondWithUserInfo(w, username)
 }
 
+// ResolveUsername returns the username that owns the given session token.
+// Results are cached briefly so it can be used for logging on every request.
+func (a AuthHandler) ResolveUsername(ctx context.Context, token string) (string, error) {
+	if username, ok := a.usernames.get(token); ok {
+		return username, nil
+	}
+	username, err := getUserInfoFromApiServer(ctx, a.instance, a.apiTlsConfig, token)
+	if err != nil {
+		return "", err
+	}
+	a.usernames.set(token, username)
+	return username, nil
+}
+
 // respondWithUserInfo is a helper to send the UserInfoResponse
 func (a AuthHandler) respondWithUserInfo(w http.ResponseWriter, username string) {
 	userInfo := UserInfoResponse{Username: username}
@@ -641,7 +749,7 @@ func (a AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		provider, _, err := a.getProviderInstance(tokenData.Provider)
+		provider, _, err := a.getProviderInstance(r.Context(), tokenData.Provider)
 		if err == nil {
 			redirectUrl, err = provider.Logout(authToken, postLogoutBase)
 			if err != nil {
@@ -651,6 +759,7 @@ func (a AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// In any case, we proceed to clear the cookies
+	sessionProviders.delete(common.InstanceFromContext(r.Context()).Name, tokenData.Token)
 	clearSessionCookie(w, r)
 	redirectResp := RedirectResponse{}
 	if redirectUrl != "" {
@@ -664,21 +773,21 @@ func (a AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 	w.Write(response)
 }
 
-func getAuthInfo(apiTlsConfig *tls.Config) (*v1beta1.AuthConfig, error) {
+func getAuthInfo(ctx context.Context, instance config.Instance, apiTlsConfig *tls.Config) (*v1beta1.AuthConfig, error) {
 	client := &http.Client{Transport: &http.Transport{
 		TLSClientConfig: apiTlsConfig,
 	}}
-	authConfigUrl, err := common.BuildFctlApiUrl("api/v1/auth/config")
+	authConfigUrl, err := common.BuildFctlApiUrl(instance, "api/v1/auth/config")
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodGet, authConfigUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, authConfigUrl, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := tracing.Do(client, req, "getAuthInfo")
 	if err != nil {
 		return nil, err
 	}
@@ -771,7 +880,7 @@ func getDisplayNameFromProviderSpec(providerSpec *v1beta1.AuthProviderSpec) (boo
 
 // GetLoginCommand generates CLI login commands based on enabled auth providers
 func (a AuthHandler) GetLoginCommand(w http.ResponseWriter, r *http.Request) {
-	authConfig, err := getAuthInfo(a.apiTlsConfig)
+	authConfig, err := getAuthInfo(r.Context(), a.instance, a.apiTlsConfig)
 	if err != nil {
 		log.GetLogger().WithError(err).Error("Failed to get auth config for login command")
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve authentication configuration")
@@ -812,9 +921,9 @@ func (a AuthHandler) GetLoginCommand(w http.ResponseWriter, r *http.Request) {
 
 		if providersCount == 1 || providerTypeStr == ProviderTypeK8s {
 			// --token cannot be used with --provider
-			command = fmt.Sprintf("flightctl login %s --%s", config.FctlApiExternalUrl, providerFlag)
+			command = fmt.Sprintf("flightctl login %s --%s", a.instance.ExternalApiUrl, providerFlag)
 		} else {
-			command = fmt.Sprintf("flightctl login %s --provider=%s --%s", config.FctlApiExternalUrl, providerName, providerFlag)
+			command = fmt.Sprintf("flightctl login %s --provider=%s --%s", a.instance.ExternalApiUrl, providerName, providerFlag)
 		}
 		commands = append(commands, LoginCommand{ProviderName: providerName, DisplayName: displayName, Command: command})
 	}
@@ -60,7 +60,7 @@ func setCookie(w http.ResponseWriter, r *http.Request, value TokenData) error {
 	}
 
 	cookie := http.Cookie{
-		Name:     common.CookieSessionName,
+		Name:     common.SessionCookieName(common.InstanceFromContext(r.Context())),
 		Secure:   secure,
 		Value:    encodedValue,
 		HttpOnly: true,
@@ -73,7 +73,7 @@ func setCookie(w http.ResponseWriter, r *http.Request, value TokenData) error {
 
 func ParseSessionCookie(r *http.Request) (TokenData, error) {
 	tokenData := TokenData{}
-	cookie, err := r.Cookie(common.CookieSessionName)
+	cookie, err := r.Cookie(common.SessionCookieName(common.InstanceFromContext(r.Context())))
 	if err != nil && !errors.Is(err, http.ErrNoCookie) {
 		return tokenData, err
 	}
@@ -310,7 +310,7 @@ func clearStateCookie(w http.ResponseWriter, r *http.Request, state string) {
 // clearSessionCookie removes the session cookie
 func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
 	cookie := http.Cookie{
-		Name:     common.CookieSessionName,
+		Name:     common.SessionCookieName(common.InstanceFromContext(r.Context())),
 		Value:    "",
 		MaxAge:   -1,
 		Path:     "/",
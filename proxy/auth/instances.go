@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/flightctl/flightctl-ui/bridge"
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/log"
+)
+
+// InstanceAuthHandler dispatches the authentication endpoints to the handler of the Flight Control
+// instance selected for the request
+type InstanceAuthHandler map[string]*AuthHandler
+
+// NewInstanceAuthHandler creates the authentication handler of every configured instance
+func NewInstanceAuthHandler() (InstanceAuthHandler, error) {
+	handlers := InstanceAuthHandler{}
+	throttle := newLoginThrottleFromConfig()
+	for _, instance := range config.Instances() {
+		tlsConfig, err := bridge.GetInstanceTlsConfig(instance)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the TLS configuration of instance %s: %w", instance.Name, err)
+		}
+		handlers[instance.Name] = NewAuth(instance, tlsConfig, throttle)
+	}
+	return handlers, nil
+}
+
+func (h InstanceAuthHandler) forContext(ctx context.Context) (*AuthHandler, error) {
+	instance := common.InstanceFromContext(ctx)
+	handler, ok := h[instance.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown Flight Control instance %q", instance.Name)
+	}
+	return handler, nil
+}
+
+// dispatch calls the handler of the instance once its auth config could be fetched
+func (h InstanceAuthHandler) dispatch(handle func(a *AuthHandler, w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler, err := h.forContext(r.Context())
+		if err != nil {
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err := handler.authConfigStatus(r.Context()); err != nil {
+			log.GetLogger().WithError(err).Debugf("Authentication of instance %s is unavailable", handler.instance.Name)
+			respondWithError(w, http.StatusServiceUnavailable, fmt.Sprintf("The authentication of Flight Control instance %q is unavailable", handler.instance.Name))
+			return
+		}
+		handle(handler, w, r)
+	}
+}
+
+func (h InstanceAuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	h.dispatch((*AuthHandler).Login)(w, r)
+}
+
+func (h InstanceAuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	h.dispatch((*AuthHandler).Refresh)(w, r)
+}
+
+// Logout always clears the session, even when the auth config of the instance cannot be fetched
+func (h InstanceAuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	handler, err := h.forContext(r.Context())
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	handler.Logout(w, r)
+}
+
+func (h InstanceAuthHandler) GetUserInfo(w http.ResponseWriter, r *http.Request) {
+	h.dispatch((*AuthHandler).GetUserInfo)(w, r)
+}
+
+func (h InstanceAuthHandler) GetLoginCommand(w http.ResponseWriter, r *http.Request) {
+	h.dispatch((*AuthHandler).GetLoginCommand)(w, r)
+}
+
+// ResolveUsername resolves the session token against the instance selected for the request
+func (h InstanceAuthHandler) ResolveUsername(ctx context.Context, token string) (string, error) {
+	handler, err := h.forContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return handler.ResolveUsername(ctx, token)
+}
+
+// AuthConfigStatus returns the error preventing the auth config of the instance from being fetched, if any
+func (h InstanceAuthHandler) AuthConfigStatus(ctx context.Context, instance string) error {
+	handler, ok := h[instance]
+	if !ok {
+		return fmt.Errorf("unknown Flight Control instance %q", instance)
+	}
+	return handler.authConfigStatus(ctx)
+}
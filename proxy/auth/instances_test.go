@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+)
+
+func TestInstanceAuthHandlerUnavailableInstance(t *testing.T) {
+	t.Parallel()
+	var reachable atomic.Bool
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !reachable.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`{"providers":[]}`))
+	}))
+	defer api.Close()
+
+	instance := config.Instance{Name: "eu", ApiUrl: api.URL}
+	handlers := InstanceAuthHandler{instance.Name: NewAuth(instance, nil, newLoginThrottle(0, 0, 0))}
+	login := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/api/login", nil)
+		req = req.WithContext(common.WithInstance(req.Context(), instance))
+		rec := httptest.NewRecorder()
+		handlers.Login(rec, req)
+		return rec.Code
+	}
+
+	if status := login(); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while the auth config cannot be fetched, got %d", status)
+	}
+	if err := handlers.AuthConfigStatus(t.Context(), instance.Name); err == nil {
+		t.Error("expected the instance to report its auth config as unavailable")
+	}
+
+	// The auth config is fetched again once the retry interval has passed
+	reachable.Store(true)
+	handler := handlers[instance.Name]
+	handler.authConfig.mu.Lock()
+	handler.authConfig.checkedAt = time.Now().Add(-authConfigRetryInterval)
+	handler.authConfig.mu.Unlock()
+	if status := login(); status == http.StatusServiceUnavailable {
+		t.Error("expected the instance to be available once its auth config is fetched")
+	}
+	if err := handlers.AuthConfigStatus(t.Context(), instance.Name); err != nil {
+		t.Errorf("expected the auth config to be available, got %v", err)
+	}
+}
+
+func TestInstanceAuthHandlersShareLoginThrottle(t *testing.T) {
+	t.Parallel()
+	throttle := newLoginThrottle(1, 0, 0)
+	eu := NewAuth(config.Instance{Name: "eu"}, nil, throttle)
+	us := NewAuth(config.Instance{Name: "us"}, nil, throttle)
+
+	eu.Login(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/login", nil))
+	rec := httptest.NewRecorder()
+	us.Login(rec, httptest.NewRequest(http.MethodGet, "/api/login", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the per-IP budget to be shared by the instances, got %d", rec.Code)
+	}
+}
@@ -6,13 +6,14 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/flightctl/flightctl-ui/bridge"
 	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
 	"github.com/flightctl/flightctl/api/v1beta1"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 )
 
 type TokenAuthProvider struct {
+	instance     config.Instance
 	apiTlsConfig *tls.Config
 	authURL      string
 	providerName string
@@ -22,8 +23,9 @@ type TokenLoginParameters struct {
 	Token string `json:"token"`
 }
 
-func NewTokenAuthProvider(apiTlsConfig *tls.Config, authURL string, providerName string) *TokenAuthProvider {
+func NewTokenAuthProvider(instance config.Instance, apiTlsConfig *tls.Config, authURL string, providerName string) *TokenAuthProvider {
 	return &TokenAuthProvider{
+		instance:     instance,
 		apiTlsConfig: apiTlsConfig,
 		authURL:      authURL,
 		providerName: providerName,
@@ -37,7 +39,7 @@ func (t *TokenAuthProvider) ValidateToken(token string) (TokenData, *int64, erro
 	}}
 
 	// Endpoint to validate that a given token is authorized to access the Flight Control API
-	validateUrl, err := common.BuildFctlApiUrl("api/v1/auth/validate")
+	validateUrl, err := common.BuildFctlApiUrl(t.instance, "api/v1/auth/validate")
 	if err != nil {
 		return TokenData{}, nil, err
 	}
@@ -126,19 +128,14 @@ func (t *TokenAuthProvider) GetLoginRedirectURL(state string, codeChallenge stri
 	return "", nil
 }
 
-// getK8sAuthHandler creates a new K8s token authentication handler
-func getK8sAuthHandler(provider *v1beta1.AuthProvider, k8sSpec *v1beta1.K8sProviderSpec) (*TokenAuthProvider, error) {
+// getK8sAuthHandler creates a new K8s token authentication handler.
+// It uses the API TLS config of the instance since we're calling the FlightCtl API to validate tokens.
+func getK8sAuthHandler(instance config.Instance, apiTlsConfig *tls.Config, provider *v1beta1.AuthProvider, k8sSpec *v1beta1.K8sProviderSpec) (*TokenAuthProvider, error) {
 	providerName := extractProviderName(provider)
 
-	// Use API TLS config since we're calling the FlightCtl API to validate tokens
-	tlsConfig, err := bridge.GetTlsConfig()
-	if err != nil {
-		return nil, err
-	}
-
 	// For K8s token auth, we don't need authURL for the provider itself
 	// The token validation happens against the FlightCtl API
 	authURL := ""
 
-	return NewTokenAuthProvider(tlsConfig, authURL, providerName), nil
+	return NewTokenAuthProvider(instance, apiTlsConfig, authURL, providerName), nil
 }
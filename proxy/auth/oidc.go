@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"net/url"
 
 	"github.com/flightctl/flightctl-ui/bridge"
+	"github.com/flightctl/flightctl-ui/tracing"
 	"github.com/flightctl/flightctl/api/v1beta1"
 	"github.com/openshift/osincli"
 )
@@ -32,7 +34,7 @@ type oidcServerResponse struct {
 	EndSessionEndpoint string `json:"end_session_endpoint"`
 }
 
-func getOIDCAuthHandler(provider *v1beta1.AuthProvider, oidcSpec *v1beta1.OIDCProviderSpec) (*OIDCAuthHandler, error) {
+func getOIDCAuthHandler(ctx context.Context, provider *v1beta1.AuthProvider, oidcSpec *v1beta1.OIDCProviderSpec) (*OIDCAuthHandler, error) {
 	providerName := extractProviderName(provider)
 
 	if oidcSpec.Issuer == "" {
@@ -58,7 +60,7 @@ func getOIDCAuthHandler(provider *v1beta1.AuthProvider, oidcSpec *v1beta1.OIDCPr
 	}
 
 	oauthConfigUrl := fmt.Sprintf("%s/.well-known/openid-configuration", url)
-	req, err := http.NewRequest(http.MethodGet, oauthConfigUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, oauthConfigUrl, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create http request: %w", err)
 	}
@@ -69,7 +71,7 @@ func getOIDCAuthHandler(provider *v1beta1.AuthProvider, oidcSpec *v1beta1.OIDCPr
 		},
 	}
 
-	res, err := httpClient.Do(req)
+	res, err := tracing.Do(&httpClient, req, "oidcDiscovery")
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch oidc config: %w", err)
 	}
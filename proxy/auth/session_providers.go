@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// sessionProviderTTL bounds how long the provider of a session is kept when its token does not
+// say when it expires
+const sessionProviderTTL = 24 * time.Hour
+
+type sessionProviderEntry struct {
+	provider string
+	expires  time.Time
+}
+
+// sessionProviderStore records the authentication provider of the sessions issued by the proxy. The
+// provider of the session cookie is chosen by the client, so it must not be trusted to match users
+// against ADMIN_USERS and TERMINAL_OBSERVER_USERS. Tokens are only kept as SHA-256 digests.
+type sessionProviderStore struct {
+	mu      sync.Mutex
+	entries map[string]sessionProviderEntry
+}
+
+var sessionProviders = &sessionProviderStore{entries: map[string]sessionProviderEntry{}}
+
+func sessionProviderKey(instance, token string) string {
+	return instance + "/" + tokenDigest(token)
+}
+
+func (s *sessionProviderStore) set(instance, token, provider string, expiresIn *int64) {
+	if token == "" || provider == "" {
+		return
+	}
+	now := time.Now()
+	expires := now.Add(sessionProviderTTL)
+	if expiresIn != nil && *expiresIn > 0 {
+		expires = now.Add(time.Duration(*expiresIn) * time.Second)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.entries {
+		if now.After(entry.expires) {
+			delete(s.entries, key)
+		}
+	}
+	s.entries[sessionProviderKey(instance, token)] = sessionProviderEntry{provider: provider, expires: expires}
+}
+
+func (s *sessionProviderStore) get(instance, token string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[sessionProviderKey(instance, token)]
+	if !ok || time.Now().After(entry.expires) {
+		return ""
+	}
+	return entry.provider
+}
+
+func (s *sessionProviderStore) delete(instance, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, sessionProviderKey(instance, token))
+}
+
+// SessionProvider returns the authentication provider the session token of the Flight Control instance
+// was issued for by the proxy, or an empty string when the proxy did not issue it, for example after a
+// restart
+func SessionProvider(instance, token string) string {
+	return sessionProviders.get(instance, token)
+}
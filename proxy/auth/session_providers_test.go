@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+)
+
+func TestSessionProviders(t *testing.T) {
+	t.Parallel()
+	expiresIn := int64(60)
+	req := httptest.NewRequest(http.MethodPost, "/api/login", nil)
+	req = req.WithContext(common.WithInstance(req.Context(), config.Instance{Name: "eu"}))
+	respondWithToken(httptest.NewRecorder(), req, TokenData{Token: "session-providers-token", Provider: "corp-oidc"}, &expiresIn)
+
+	if got := SessionProvider("eu", "session-providers-token"); got != "corp-oidc" {
+		t.Errorf("expected the provider recorded at login, got %q", got)
+	}
+	if got := SessionProvider("us", "session-providers-token"); got != "" {
+		t.Errorf("expected no provider for another instance, got %q", got)
+	}
+	if got := SessionProvider("eu", "forged-token"); got != "" {
+		t.Errorf("expected no provider for a session the proxy did not issue, got %q", got)
+	}
+
+	sessionProviders.delete("eu", "session-providers-token")
+	if got := SessionProvider("eu", "session-providers-token"); got != "" {
+		t.Errorf("expected the provider to be forgotten at logout, got %q", got)
+	}
+}
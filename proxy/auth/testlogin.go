@@ -0,0 +1,765 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/bridge"
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/log"
+	"github.com/flightctl/flightctl-ui/tracing"
+	"github.com/flightctl/flightctl/api/v1beta1"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// Test login cookie name prefix
+const testLoginCookiePrefix = "test_login_"
+
+// testLoginCallbackPath receives the redirect of the identity provider at the end of a test login.
+// It is distinct from the login callback of the UI, which would log the user in with the draft provider.
+const testLoginCallbackPath = "/api/test-auth-provider-login/callback"
+
+// testLoginMessageType identifies the message that the test login callback posts to the page that opened it
+const testLoginMessageType = "flightctl-test-login"
+
+// defaultUsernameClaim is used to report the username when the provider does not configure a usernameClaim
+var defaultUsernameClaim = []string{"preferred_username"}
+
+// TestLoginRequest carries an auth provider definition that has not been saved yet.
+// Code is only set when completing the flow, with the authorization code received on the callback.
+type TestLoginRequest struct {
+	Provider v1beta1.AuthProvider `json:"provider"`
+	Code     string               `json:"code,omitempty"`
+}
+
+// TestLoginStartResponse returns the URL to open in a popup, and the redirect URI that the identity
+// provider must allow for the test login to complete
+type TestLoginStartResponse struct {
+	Url         string `json:"url"`
+	RedirectUri string `json:"redirectUri"`
+}
+
+type TestLoginResponse struct {
+	Success        bool                   `json:"success"`
+	Username       string                 `json:"username,omitempty"`
+	GrantedScopes  []string               `json:"grantedScopes,omitempty"`
+	IdTokenClaims  map[string]interface{} `json:"idTokenClaims,omitempty"`
+	UserinfoClaims map[string]interface{} `json:"userinfoClaims,omitempty"`
+	Notes          []string               `json:"notes"`
+}
+
+// testLoginTransaction is stored in a cookie between starting and completing a test login.
+// It never holds the provider definition itself, only a digest of it, so client secrets stay out of cookies.
+type testLoginTransaction struct {
+	CodeVerifier     string `json:"codeVerifier"`
+	RedirectURI      string `json:"redirectUri"`
+	DefinitionDigest string `json:"definitionDigest"`
+}
+
+type testLoginDiscovery struct {
+	oidcServerResponse
+	Issuer  string `json:"issuer"`
+	JwksURI string `json:"jwks_uri"`
+}
+
+// testLoginProvider is the subset of a draft provider definition that is needed to run a test login
+type testLoginProvider struct {
+	providerType   string
+	issuer         string
+	clientId       string
+	clientSecret   string
+	scope          string
+	usernameClaim  []string
+	orgAssignment  v1beta1.AuthOrganizationAssignment
+	roleAssignment v1beta1.AuthRoleAssignment
+	endpoints      testLoginDiscovery
+	loginProvider  AuthProvider
+}
+
+type testLoginTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IdToken          string `json:"id_token"`
+	TokenType        string `json:"token_type"`
+	Scope            string `json:"scope"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// TestLoginHandler runs a complete authorization-code login against a draft auth provider definition.
+// The proxy talks to the identity provider directly: no session is created and the Flight Control API is not involved.
+type TestLoginHandler struct {
+	tlsConfig  *tls.Config
+	httpClient *http.Client
+}
+
+func NewTestLoginHandler() (*TestLoginHandler, error) {
+	tlsConfig, err := bridge.GetAuthTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &TestLoginHandler{
+		tlsConfig:  tlsConfig,
+		httpClient: bridge.NewOutboundClient(tlsConfig),
+	}, nil
+}
+
+// StartTestLogin returns the authorization URL that the UI opens in a popup to test the draft provider
+func (h *TestLoginHandler) StartTestLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req TestLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	ctx := testLoginContext(r)
+	provider, err := h.resolveTestLoginProvider(ctx, &req.Provider)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	codeVerifier, err := generateCodeVerifier()
+	if err != nil {
+		log.GetLogger().WithError(err).Warn("Failed to generate code verifier")
+		respondWithError(w, http.StatusInternalServerError, "Failed to initialize the test login")
+		return
+	}
+	state, err := generateState()
+	if err != nil {
+		log.GetLogger().WithError(err).Warn("Failed to generate state")
+		respondWithError(w, http.StatusInternalServerError, "Failed to initialize the test login")
+		return
+	}
+
+	redirectURI, err := resolveTestLoginRedirectURI(r, r.URL.Query().Get("redirect_base"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	digest, err := providerDefinitionDigest(&req.Provider)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	transaction := testLoginTransaction{
+		CodeVerifier:     codeVerifier,
+		RedirectURI:      redirectURI,
+		DefinitionDigest: digest,
+	}
+	if err := setTestLoginCookie(w, r, state, transaction); err != nil {
+		log.GetLogger().WithError(err).Warn("Failed to store the test login transaction")
+		respondWithError(w, http.StatusInternalServerError, "Failed to initialize the test login")
+		return
+	}
+
+	loginUrl, err := provider.loginProvider.GetLoginRedirectURL(state, generateCodeChallenge(codeVerifier), redirectURI)
+	if err != nil || loginUrl == "" {
+		log.GetLogger().WithError(err).Warn("Failed to build the test login URL")
+		respondWithError(w, http.StatusInternalServerError, "Failed to build login URL")
+		return
+	}
+
+	response, err := json.Marshal(TestLoginStartResponse{Url: loginUrl, RedirectUri: redirectURI})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// CompleteTestLogin exchanges the authorization code with the identity provider and reports the resulting claims
+func (h *TestLoginHandler) CompleteTestLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing state parameter")
+		return
+	}
+	transaction, err := getTestLoginCookie(r, state)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "The test login could not complete within 10 minutes. Please restart the test.")
+		return
+	}
+	clearTestLoginCookie(w, r, state)
+
+	var req TestLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if req.Code == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing authorization code")
+		return
+	}
+
+	digest, err := providerDefinitionDigest(&req.Provider)
+	if err != nil || digest != transaction.DefinitionDigest {
+		respondWithError(w, http.StatusBadRequest, "The provider definition changed during the test login. Please restart the test.")
+		return
+	}
+
+	ctx := testLoginContext(r)
+	provider, err := h.resolveTestLoginProvider(ctx, &req.Provider)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result := h.runTestLogin(ctx, provider, req.Code, transaction)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// resolveTestLoginRedirectURI returns the test login callback on the origin and base path of the login callback
+func resolveTestLoginRedirectURI(r *http.Request, redirectBase string) (string, error) {
+	loginCallback, err := ResolveOAuthRedirectURI(r, redirectBase)
+	if err != nil {
+		return "", err
+	}
+	redirectURI, err := url.Parse(loginCallback)
+	if err != nil {
+		return "", err
+	}
+	redirectURI.Path = strings.TrimSuffix(redirectURI.Path, "/callback") + testLoginCallbackPath
+	return redirectURI.String(), nil
+}
+
+// testLoginCallbackPage posts the result of the authorization to the page that opened the popup,
+// on the same origin only, and closes the popup
+var testLoginCallbackPage = template.Must(template.New("callback").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Test login</title></head>
+<body>
+<p id="message">{{.Message}}</p>
+{{if .Valid}}<script nonce="{{.Nonce}}">
+  if (window.opener) {
+    window.opener.postMessage({{.Result}}, window.location.origin);
+    window.close();
+  }
+</script>{{end}}
+</body>
+</html>
+`))
+
+// testLoginCallbackResult is posted to the page that started the test login
+type testLoginCallbackResult struct {
+	Type             string `json:"type"`
+	State            string `json:"state"`
+	Code             string `json:"code,omitempty"`
+	Error            string `json:"error,omitempty"`
+	ErrorDescription string `json:"errorDescription,omitempty"`
+}
+
+// TestLoginCallback receives the redirect of the identity provider at the end of a test login, and hands
+// the authorization code to the page that started it, which completes the test with CompleteTestLogin
+func (h *TestLoginHandler) TestLoginCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	result := testLoginCallbackResult{
+		Type:             testLoginMessageType,
+		State:            query.Get("state"),
+		Code:             query.Get("code"),
+		Error:            query.Get("error"),
+		ErrorDescription: query.Get("error_description"),
+	}
+	message := "The test login is complete, you can close this window."
+	valid := result.State != ""
+	if valid {
+		// Only codes of a test login started from this browser are handed over
+		_, err := getTestLoginCookie(r, result.State)
+		valid = err == nil
+	}
+	if !valid {
+		message = "The test login could not complete within 10 minutes. Please restart the test."
+	}
+
+	nonce, err := generateState()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'nonce-"+nonce+"'")
+	w.Header().Set("Cache-Control", "no-store")
+	// The URL carries the authorization code
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if !valid {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	err = testLoginCallbackPage.Execute(w, map[string]interface{}{
+		"Message": message,
+		"Nonce":   nonce,
+		"Valid":   valid,
+		"Result":  result,
+	})
+	if err != nil {
+		log.GetLogger().WithError(err).Warn("Failed to write the test login callback page")
+	}
+}
+
+func testLoginContext(r *http.Request) context.Context {
+	identity, _ := common.UserIdentityFromContext(r.Context())
+	return bridge.WithOutboundSession(r.Context(), identity.Username)
+}
+
+func (h *TestLoginHandler) runTestLogin(ctx context.Context, provider *testLoginProvider, code string, transaction *testLoginTransaction) TestLoginResponse {
+	result := TestLoginResponse{Notes: []string{}}
+
+	tokenResp, err := h.exchangeTestLoginCode(ctx, provider, code, transaction)
+	if err != nil {
+		result.Notes = append(result.Notes, fmt.Sprintf("Token exchange failed: %v", err))
+		return result
+	}
+	result.Notes = append(result.Notes, "Authorization code was exchanged for tokens")
+
+	requestedScopes := strings.Fields(provider.scope)
+	if tokenResp.Scope == "" {
+		result.GrantedScopes = requestedScopes
+	} else {
+		result.GrantedScopes = strings.Fields(tokenResp.Scope)
+		for _, scope := range requestedScopes {
+			if !containsString(result.GrantedScopes, scope) {
+				result.Notes = append(result.Notes, fmt.Sprintf("Requested scope %q was not granted", scope))
+			}
+		}
+	}
+
+	valid := true
+	if provider.providerType == ProviderTypeOIDC {
+		if tokenResp.IdToken == "" {
+			result.Notes = append(result.Notes, "Token response is missing the ID token. Make sure the \"openid\" scope is requested")
+			valid = false
+		} else {
+			claims, notes, verified := h.decodeIdToken(ctx, provider, tokenResp.IdToken)
+			result.IdTokenClaims = claims
+			result.Notes = append(result.Notes, notes...)
+			valid = valid && verified
+		}
+	}
+
+	if provider.endpoints.UserInfoEndpoint != "" && tokenResp.AccessToken != "" {
+		claims, err := h.fetchTestLoginUserinfo(ctx, provider.endpoints.UserInfoEndpoint, tokenResp.AccessToken)
+		if err != nil {
+			result.Notes = append(result.Notes, fmt.Sprintf("Failed to fetch userinfo claims: %v", err))
+			valid = valid && provider.providerType == ProviderTypeOIDC
+		} else {
+			result.UserinfoClaims = claims
+		}
+	}
+
+	// OIDC providers map claims from the ID token, OAuth2 providers from the userinfo response
+	claims, claimsSource := result.IdTokenClaims, "ID token"
+	if provider.providerType == ProviderTypeOAuth2 {
+		claims, claimsSource = result.UserinfoClaims, "userinfo response"
+	}
+
+	usernameClaim := provider.usernameClaim
+	if len(usernameClaim) == 0 {
+		usernameClaim = defaultUsernameClaim
+	}
+	if username, ok := lookupClaim(claims, usernameClaim); ok {
+		result.Username = fmt.Sprint(username)
+		result.Notes = append(result.Notes, fmt.Sprintf("Username %q was read from claim %q of the %s", result.Username, strings.Join(usernameClaim, "."), claimsSource))
+	} else {
+		result.Notes = append(result.Notes, fmt.Sprintf("Username claim %q is missing from the %s", strings.Join(usernameClaim, "."), claimsSource))
+		valid = false
+	}
+
+	if orgAssignment, err := provider.orgAssignment.AsAuthDynamicOrganizationAssignment(); err == nil && orgAssignment.Type == v1beta1.AuthDynamicOrganizationAssignmentTypeDynamic {
+		if value, ok := lookupClaim(claims, orgAssignment.ClaimPath); ok {
+			result.Notes = append(result.Notes, fmt.Sprintf("Organization claim %q resolved to %v", strings.Join(orgAssignment.ClaimPath, "."), value))
+		} else {
+			result.Notes = append(result.Notes, fmt.Sprintf("Organization claim %q is missing from the %s", strings.Join(orgAssignment.ClaimPath, "."), claimsSource))
+			valid = false
+		}
+	}
+
+	if roleAssignment, err := provider.roleAssignment.AsAuthDynamicRoleAssignment(); err == nil && roleAssignment.Type == v1beta1.AuthDynamicRoleAssignmentTypeDynamic {
+		if value, ok := lookupClaim(claims, roleAssignment.ClaimPath); ok {
+			result.Notes = append(result.Notes, fmt.Sprintf("Role claim %q resolved to %v", strings.Join(roleAssignment.ClaimPath, "."), value))
+		} else {
+			result.Notes = append(result.Notes, fmt.Sprintf("Role claim %q is missing from the %s", strings.Join(roleAssignment.ClaimPath, "."), claimsSource))
+			valid = false
+		}
+	}
+
+	result.Success = valid
+	return result
+}
+
+// resolveTestLoginProvider validates the draft definition and discovers its endpoints
+func (h *TestLoginHandler) resolveTestLoginProvider(ctx context.Context, definition *v1beta1.AuthProvider) (*testLoginProvider, error) {
+	providerType, err := definition.Spec.Discriminator()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine the provider type: %w", err)
+	}
+
+	switch providerType {
+	case ProviderTypeOIDC:
+		oidcSpec, err := definition.Spec.AsOIDCProviderSpec()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse OIDC provider spec: %w", err)
+		}
+		if oidcSpec.Issuer == "" || oidcSpec.ClientId == "" {
+			return nil, fmt.Errorf("OIDC provider is missing the issuer or the client ID")
+		}
+		discovery, err := h.fetchTestLoginDiscovery(ctx, oidcSpec.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		provider := &testLoginProvider{
+			providerType:   providerType,
+			issuer:         oidcSpec.Issuer,
+			clientId:       oidcSpec.ClientId,
+			scope:          buildScopeParam(oidcSpec.Scopes, "openid profile email organization:*"),
+			orgAssignment:  oidcSpec.OrganizationAssignment,
+			roleAssignment: oidcSpec.RoleAssignment,
+			endpoints:      *discovery,
+			loginProvider: &OIDCAuthHandler{
+				tlsConfig:              h.tlsConfig,
+				oidcDiscoveryForClient: discovery.oidcServerResponse,
+				scopes:                 oidcSpec.Scopes,
+				clientId:               oidcSpec.ClientId,
+			},
+		}
+		if oidcSpec.ClientSecret != nil {
+			provider.clientSecret = *oidcSpec.ClientSecret
+		}
+		if oidcSpec.UsernameClaim != nil {
+			provider.usernameClaim = *oidcSpec.UsernameClaim
+		}
+		return provider, nil
+	case ProviderTypeOAuth2:
+		oauth2Spec, err := definition.Spec.AsOAuth2ProviderSpec()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse OAuth2 provider spec: %w", err)
+		}
+		oauth2Handler, err := getOAuth2AuthHandler(definition, &oauth2Spec)
+		if err != nil {
+			return nil, err
+		}
+		provider := &testLoginProvider{
+			providerType:   providerType,
+			clientId:       oauth2Spec.ClientId,
+			scope:          oauth2Handler.scope,
+			orgAssignment:  oauth2Spec.OrganizationAssignment,
+			roleAssignment: oauth2Spec.RoleAssignment,
+			endpoints: testLoginDiscovery{
+				oidcServerResponse: oidcServerResponse{
+					AuthEndpoint:     oauth2Spec.AuthorizationUrl,
+					TokenEndpoint:    oauth2Spec.TokenUrl,
+					UserInfoEndpoint: oauth2Spec.UserinfoUrl,
+				},
+			},
+			loginProvider: oauth2Handler,
+		}
+		if oauth2Spec.Issuer != nil {
+			provider.issuer = *oauth2Spec.Issuer
+		}
+		if oauth2Spec.ClientSecret != nil {
+			provider.clientSecret = *oauth2Spec.ClientSecret
+		}
+		if oauth2Spec.UsernameClaim != nil {
+			provider.usernameClaim = *oauth2Spec.UsernameClaim
+		}
+		return provider, nil
+	default:
+		return nil, fmt.Errorf("test login is not supported for %s providers", providerType)
+	}
+}
+
+func (h *TestLoginHandler) fetchTestLoginDiscovery(ctx context.Context, issuer string) (*testLoginDiscovery, error) {
+	issuerURL, err := url.Parse(issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid issuer URL: %w", err)
+	}
+	discoveryURL := issuerURL.JoinPath(".well-known", "openid-configuration").String()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create discovery request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := tracing.Do(h.httpClient, req, "oidcDiscovery")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery endpoint returned status %d", resp.StatusCode)
+	}
+
+	discovery := &testLoginDiscovery{}
+	if err := json.NewDecoder(resp.Body).Decode(discovery); err != nil {
+		return nil, fmt.Errorf("failed to parse OIDC discovery document: %w", err)
+	}
+	if discovery.AuthEndpoint == "" || discovery.TokenEndpoint == "" {
+		return nil, fmt.Errorf("OIDC discovery document is missing the authorization or token endpoint")
+	}
+	return discovery, nil
+}
+
+func (h *TestLoginHandler) exchangeTestLoginCode(ctx context.Context, provider *testLoginProvider, code string, transaction *testLoginTransaction) (*testLoginTokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", transaction.RedirectURI)
+	form.Set("code_verifier", transaction.CodeVerifier)
+	if provider.clientSecret == "" {
+		form.Set("client_id", provider.clientId)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.endpoints.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token request: %w", err)
+	}
+	if provider.clientSecret != "" {
+		// RFC 6749 section 2.3.1: client credentials are form-encoded before being used for basic auth
+		req.SetBasicAuth(url.QueryEscape(provider.clientId), url.QueryEscape(provider.clientSecret))
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := tracing.Do(h.httpClient, req, "testLoginToken")
+	if err != nil {
+		return nil, fmt.Errorf("failed to call the token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the token response: %w", err)
+	}
+
+	tokenResp := &testLoginTokenResponse{}
+	if err := json.Unmarshal(body, tokenResp); err != nil {
+		// Some OAuth2 providers reply with a form-encoded body
+		values, parseErr := url.ParseQuery(string(body))
+		if parseErr != nil || (values.Get("access_token") == "" && values.Get("error") == "") {
+			return nil, fmt.Errorf("token endpoint returned status %d with an unexpected response", resp.StatusCode)
+		}
+		tokenResp = &testLoginTokenResponse{
+			AccessToken:      values.Get("access_token"),
+			IdToken:          values.Get("id_token"),
+			TokenType:        values.Get("token_type"),
+			Scope:            values.Get("scope"),
+			Error:            values.Get("error"),
+			ErrorDescription: values.Get("error_description"),
+		}
+	}
+	if tokenResp.Error != "" {
+		return nil, fmt.Errorf("%s - %s", tokenResp.Error, tokenResp.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+	if tokenResp.AccessToken == "" && tokenResp.IdToken == "" {
+		return nil, fmt.Errorf("token response does not contain any token")
+	}
+	return tokenResp, nil
+}
+
+// decodeIdToken returns the ID token claims. The signature, issuer and audience are verified when
+// the provider publishes its keys; otherwise the claims are only decoded.
+func (h *TestLoginHandler) decodeIdToken(ctx context.Context, provider *testLoginProvider, idToken string) (map[string]interface{}, []string, bool) {
+	notes := []string{}
+	verified := false
+
+	var token jwt.Token
+	if provider.endpoints.JwksURI == "" {
+		notes = append(notes, "ID token signature was not verified: the discovery document does not include jwks_uri")
+	} else if keySet, err := jwk.Fetch(ctx, provider.endpoints.JwksURI, jwk.WithHTTPClient(h.httpClient)); err != nil {
+		notes = append(notes, fmt.Sprintf("ID token signature was not verified: failed to fetch signing keys: %v", err))
+	} else if token, err = jwt.Parse([]byte(idToken),
+		jwt.WithKeySet(keySet, jws.WithInferAlgorithmFromKey(true)),
+		jwt.WithValidate(true),
+		jwt.WithIssuer(provider.issuer),
+		jwt.WithAudience(provider.clientId),
+		jwt.WithAcceptableSkew(time.Minute),
+	); err != nil {
+		notes = append(notes, fmt.Sprintf("ID token failed verification: %v", err))
+	} else {
+		verified = true
+		notes = append(notes, "ID token signature, issuer and audience were verified")
+	}
+
+	if token == nil {
+		insecureToken, err := jwt.ParseInsecure([]byte(idToken))
+		if err != nil {
+			notes = append(notes, fmt.Sprintf("ID token could not be decoded: %v", err))
+			return nil, notes, false
+		}
+		token = insecureToken
+	}
+
+	claims, err := token.AsMap(ctx)
+	if err != nil {
+		notes = append(notes, fmt.Sprintf("ID token claims could not be decoded: %v", err))
+		return nil, notes, false
+	}
+	return claims, notes, verified
+}
+
+func (h *TestLoginHandler) fetchTestLoginUserinfo(ctx context.Context, userinfoURL string, accessToken string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, userinfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := tracing.Do(h.httpClient, req, "testLoginUserinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo endpoint returned status %d", resp.StatusCode)
+	}
+
+	claims := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse userinfo response: %w", err)
+	}
+	return claims, nil
+}
+
+// lookupClaim follows a claim path such as ["realm_access", "roles"] or ["groups", "0"] through the claims
+func lookupClaim(claims map[string]interface{}, path []string) (interface{}, bool) {
+	if len(path) == 0 {
+		return nil, false
+	}
+	var current interface{} = claims
+	for _, segment := range path {
+		switch value := current.(type) {
+		case map[string]interface{}:
+			next, ok := value[segment]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(value) {
+				return nil, false
+			}
+			current = value[index]
+		case []string:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(value) {
+				return nil, false
+			}
+			current = value[index]
+		default:
+			return nil, false
+		}
+	}
+	if current == nil {
+		return nil, false
+	}
+	return current, true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// providerDefinitionDigest identifies a draft provider definition without having to store it
+func providerDefinitionDigest(definition *v1beta1.AuthProvider) (string, error) {
+	spec, err := json.Marshal(definition.Spec)
+	if err != nil {
+		return "", fmt.Errorf("invalid provider definition: %w", err)
+	}
+	sum := sha256.Sum256(spec)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func setTestLoginCookie(w http.ResponseWriter, r *http.Request, state string, transaction testLoginTransaction) error {
+	value, err := json.Marshal(transaction)
+	if err != nil {
+		return err
+	}
+	encodedValue := b64.URLEncoding.EncodeToString(value)
+	if len(encodedValue) > maxCookieValueSize {
+		return fmt.Errorf("cookie value size (%d bytes) exceeds maximum allowed size (%d bytes)", len(encodedValue), maxCookieValueSize)
+	}
+	cookie := http.Cookie{
+		Name:     testLoginCookiePrefix + state,
+		Value:    encodedValue,
+		Secure:   cookieSecureForRequest(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+		MaxAge:   600, // 10 minutes (same as authorization code expiration)
+	}
+	http.SetCookie(w, &cookie)
+	return nil
+}
+
+func getTestLoginCookie(r *http.Request, state string) (*testLoginTransaction, error) {
+	cookie, err := r.Cookie(testLoginCookiePrefix + state)
+	if err != nil {
+		return nil, err
+	}
+	value, err := b64.URLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	transaction := &testLoginTransaction{}
+	if err := json.Unmarshal(value, transaction); err != nil {
+		return nil, err
+	}
+	if transaction.CodeVerifier == "" || transaction.RedirectURI == "" {
+		return nil, errors.New("incomplete test login transaction")
+	}
+	return transaction, nil
+}
+
+func clearTestLoginCookie(w http.ResponseWriter, r *http.Request, state string) {
+	cookie := http.Cookie{
+		Name:     testLoginCookiePrefix + state,
+		Value:    "",
+		MaxAge:   -1,
+		Path:     "/",
+		Secure:   cookieSecureForRequest(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+}
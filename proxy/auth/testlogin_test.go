@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+func TestLookupClaim(t *testing.T) {
+	t.Parallel()
+
+	claims := map[string]interface{}{}
+	err := json.Unmarshal([]byte(`{
+		"preferred_username": "jdoe",
+		"groups": ["admins", "operators"],
+		"realm_access": {"roles": ["org-a:viewer"]}
+	}`), &claims)
+	if err != nil {
+		t.Fatalf("failed to parse claims: %v", err)
+	}
+
+	if value, ok := lookupClaim(claims, []string{"preferred_username"}); !ok || value != "jdoe" {
+		t.Fatalf("expected preferred_username to resolve to jdoe, got %v", value)
+	}
+	if value, ok := lookupClaim(claims, []string{"groups", "1"}); !ok || value != "operators" {
+		t.Fatalf("expected groups.1 to resolve to operators, got %v", value)
+	}
+	if _, ok := lookupClaim(claims, []string{"realm_access", "roles"}); !ok {
+		t.Fatal("expected realm_access.roles to resolve")
+	}
+	for _, path := range [][]string{{"email"}, {"groups", "5"}, {"groups", "x"}, {"preferred_username", "0"}, {}} {
+		if value, ok := lookupClaim(claims, path); ok {
+			t.Errorf("expected path %v not to resolve, got %v", path, value)
+		}
+	}
+}
+
+// newTestIdentityProvider serves the discovery document, signing keys, token and userinfo endpoints of
+// an OIDC provider that accepts the authorization code "valid-code" sent with redirectURI
+func newTestIdentityProvider(t *testing.T, redirectURI string) *httptest.Server {
+	t.Helper()
+	rawKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.FromRaw(rawKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = key.Set(jwk.KeyIDKey, "test")
+	_ = key.Set(jwk.AlgorithmKey, jwa.RS256)
+	publicKey, err := key.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keySet := jwk.NewSet()
+	_ = keySet.AddKey(publicKey)
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 server.URL,
+				"authorization_endpoint": server.URL + "/authorize",
+				"token_endpoint":         server.URL + "/token",
+				"userinfo_endpoint":      server.URL + "/userinfo",
+				"jwks_uri":               server.URL + "/keys",
+			})
+		case "/keys":
+			_ = json.NewEncoder(w).Encode(keySet)
+		case "/token":
+			_ = r.ParseForm()
+			if r.PostForm.Get("code") != "valid-code" || r.PostForm.Get("redirect_uri") != redirectURI || r.PostForm.Get("code_verifier") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error": "invalid_grant", "error_description": "unexpected code or redirect URI"}`))
+				return
+			}
+			token, _ := jwt.NewBuilder().
+				Issuer(server.URL).
+				Audience([]string{"flightctl-ui"}).
+				Subject("1234").
+				IssuedAt(time.Now()).
+				Expiration(time.Now().Add(time.Minute)).
+				Claim("preferred_username", "jdoe").
+				Build()
+			signed, err := jwt.Sign(token, jwt.WithKey(jwa.RS256, key))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "id_token": string(signed), "token_type": "Bearer"})
+		case "/userinfo":
+			_, _ = w.Write([]byte(`{"sub": "1234", "preferred_username": "jdoe"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testLoginDefinition(issuer, clientID string) string {
+	return fmt.Sprintf(`{"apiVersion": "v1beta1", "kind": "AuthProvider", "metadata": {"name": "draft"}, "spec": {
+		"providerType": "oidc", "issuer": %q, "clientId": %q,
+		"organizationAssignment": {"type": "static", "organizationName": "default"},
+		"roleAssignment": {"type": "static", "roles": ["flightctl-admin"]}
+	}}`, issuer, clientID)
+}
+
+func TestTestLoginFlow(t *testing.T) {
+	t.Parallel()
+	redirectURI := "http://localhost:9000" + testLoginCallbackPath
+	idp := newTestIdentityProvider(t, redirectURI)
+	h := &TestLoginHandler{httpClient: idp.Client(), tlsConfig: idp.Client().Transport.(*http.Transport).TLSClientConfig}
+	definition := testLoginDefinition(idp.URL, "flightctl-ui")
+
+	// Starting the test returns the authorization URL, redirecting to the test login callback
+	rec := httptest.NewRecorder()
+	h.StartTestLogin(rec, httptest.NewRequest(http.MethodPost, "/api/test-auth-provider-login", strings.NewReader(`{"provider": `+definition+`}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the test login to start, got %d %s", rec.Code, rec.Body.String())
+	}
+	var started TestLoginStartResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &started); err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := url.Parse(started.Url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := authURL.Query().Get("state")
+	if started.RedirectUri != redirectURI || authURL.Query().Get("redirect_uri") != redirectURI || state == "" {
+		t.Fatalf("expected the test login callback as the redirect URI, got %+v", started)
+	}
+	cookies := rec.Result().Cookies()
+
+	withCookies := func(r *http.Request) *http.Request {
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		return r
+	}
+	complete := func(state, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.CompleteTestLogin(rec, withCookies(httptest.NewRequest(http.MethodPost, "/api/test-auth-provider-login/complete?state="+state, strings.NewReader(body))))
+		return rec
+	}
+
+	// The callback hands the code to the opener only for a test login started from this browser
+	rec = httptest.NewRecorder()
+	h.TestLoginCallback(rec, withCookies(httptest.NewRequest(http.MethodGet, testLoginCallbackPath+"?code=valid-code&state="+state, nil)))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "valid-code") || !strings.Contains(rec.Header().Get("Content-Security-Policy"), "script-src 'nonce-") {
+		t.Errorf("expected the callback to post the code to the opener, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	h.TestLoginCallback(rec, httptest.NewRequest(http.MethodGet, testLoginCallbackPath+"?code=valid-code&state="+state, nil))
+	if rec.Code != http.StatusBadRequest || strings.Contains(rec.Body.String(), "valid-code") {
+		t.Errorf("expected the callback without the test login cookie to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// The state must match the test login cookie
+	if rec := complete("other-state", `{"provider": `+definition+`, "code": "valid-code"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown state to be rejected, got %d", rec.Code)
+	}
+	// The provider definition must be the one the test login started with
+	if rec := complete(state, `{"provider": `+testLoginDefinition(idp.URL, "other-client")+`, "code": "valid-code"}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "definition changed") {
+		t.Errorf("expected a changed definition to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = complete(state, `{"provider": `+definition+`, "code": "valid-code"}`)
+	var result TestLoginResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+	if !result.Success || result.Username != "jdoe" || result.UserinfoClaims["sub"] != "1234" {
+		t.Errorf("expected the test login to succeed, got %+v", result)
+	}
+}
@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/log"
+)
+
+const (
+	// Consecutive failed logins allowed for a client and provider before backoff kicks in
+	loginFailureThreshold = 3
+	loginBackoffBase      = time.Second
+	loginBackoffMax       = 5 * time.Minute
+	// Pending login transactions expire together with the state and PKCE cookies
+	loginTransactionTTL     = 10 * time.Minute
+	loginThrottleCleanupAge = time.Minute
+)
+
+// tokenBucket allows bursts of up to capacity requests, refilled at capacity per minute
+type tokenBucket struct {
+	tokens   float64
+	updated  time.Time
+	capacity float64
+}
+
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	refillPerSecond := b.capacity / 60
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.updated).Seconds()*refillPerSecond)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / refillPerSecond * float64(time.Second))
+	return false, wait
+}
+
+func (b *tokenBucket) isFull(now time.Time) bool {
+	return b.tokens+now.Sub(b.updated).Seconds()*b.capacity/60 >= b.capacity
+}
+
+type loginFailures struct {
+	count        int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// loginThrottle protects the login endpoints against brute force and abuse. It limits the
+// attempts of every client IP and every provider, backs off exponentially after repeated failed
+// logins, and caps the number of login flows a client IP may have in progress.
+type loginThrottle struct {
+	mu              sync.Mutex
+	perIP           int
+	perProvider     int
+	maxPending      int
+	ipBuckets       map[string]*tokenBucket
+	providerBuckets map[string]*tokenBucket
+	failures        map[string]*loginFailures
+	pending         map[string]map[string]time.Time
+	lastCleanup     time.Time
+	now             func() time.Time
+}
+
+func newLoginThrottle(perIP, perProvider, maxPending int) *loginThrottle {
+	return &loginThrottle{
+		perIP:           perIP,
+		perProvider:     perProvider,
+		maxPending:      maxPending,
+		ipBuckets:       map[string]*tokenBucket{},
+		providerBuckets: map[string]*tokenBucket{},
+		failures:        map[string]*loginFailures{},
+		pending:         map[string]map[string]time.Time{},
+		now:             time.Now,
+	}
+}
+
+func newLoginThrottleFromConfig() *loginThrottle {
+	return newLoginThrottle(config.LoginRateLimitPerIP, config.LoginRateLimitPerProvider, config.LoginMaxPendingTransactions)
+}
+
+// loginThrottleError describes why a login attempt was throttled and when it may be retried
+type loginThrottleError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *loginThrottleError) Error() string {
+	return e.reason
+}
+
+func failureKey(clientIP, providerName string) string {
+	return clientIP + "|" + providerName
+}
+
+func takeFromBucket(buckets map[string]*tokenBucket, key string, capacity int, now time.Time) (bool, time.Duration) {
+	bucket, ok := buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(capacity), updated: now, capacity: float64(capacity)}
+		buckets[key] = bucket
+	}
+	return bucket.take(now)
+}
+
+// allow records a login attempt and returns an error when it must be rejected
+func (t *loginThrottle) allow(clientIP, providerName string) *loginThrottleError {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.cleanup(now)
+
+	if failures, ok := t.failures[failureKey(clientIP, providerName)]; ok && now.Before(failures.blockedUntil) {
+		return &loginThrottleError{reason: "Too many failed login attempts. Please try again later.", retryAfter: failures.blockedUntil.Sub(now)}
+	}
+	if t.perIP > 0 {
+		if ok, wait := takeFromBucket(t.ipBuckets, clientIP, t.perIP, now); !ok {
+			return &loginThrottleError{reason: "Too many login attempts. Please try again later.", retryAfter: wait}
+		}
+	}
+	if t.perProvider > 0 && providerName != "" {
+		if ok, wait := takeFromBucket(t.providerBuckets, providerName, t.perProvider, now); !ok {
+			return &loginThrottleError{reason: "Too many login attempts for this authentication provider. Please try again later.", retryAfter: wait}
+		}
+	}
+	return nil
+}
+
+func (t *loginThrottle) recordFailure(clientIP, providerName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := failureKey(clientIP, providerName)
+	failures, ok := t.failures[key]
+	if !ok {
+		failures = &loginFailures{}
+		t.failures[key] = failures
+	}
+	failures.count++
+	failures.lastFailure = t.now()
+	if failures.count >= loginFailureThreshold {
+		exponent := float64(failures.count - loginFailureThreshold)
+		backoff := time.Duration(math.Min(float64(loginBackoffMax), float64(loginBackoffBase)*math.Pow(2, exponent)))
+		failures.blockedUntil = t.now().Add(backoff)
+		log.GetLogger().Warnf("Login for provider %q from %s failed %d times in a row, backing off for %s", providerName, clientIP, failures.count, backoff)
+	}
+}
+
+func (t *loginThrottle) recordSuccess(clientIP, providerName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, failureKey(clientIP, providerName))
+}
+
+// beginTransaction registers a login flow started by the client, unless it already has too many in progress
+func (t *loginThrottle) beginTransaction(clientIP, state string) *loginThrottleError {
+	if t.maxPending <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+
+	transactions, ok := t.pending[clientIP]
+	if !ok {
+		transactions = map[string]time.Time{}
+		t.pending[clientIP] = transactions
+	}
+	oldest := time.Time{}
+	for key, expires := range transactions {
+		if now.After(expires) {
+			delete(transactions, key)
+		} else if oldest.IsZero() || expires.Before(oldest) {
+			oldest = expires
+		}
+	}
+	if len(transactions) >= t.maxPending {
+		return &loginThrottleError{reason: "Too many login attempts in progress. Please complete or wait for a pending login.", retryAfter: oldest.Sub(now)}
+	}
+	transactions[state] = now.Add(loginTransactionTTL)
+	return nil
+}
+
+// endTransaction releases a login flow once its callback has been received
+func (t *loginThrottle) endTransaction(clientIP, state string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if transactions, ok := t.pending[clientIP]; ok {
+		delete(transactions, state)
+		if len(transactions) == 0 {
+			delete(t.pending, clientIP)
+		}
+	}
+}
+
+// cleanup drops the entries that no longer affect any decision, so memory stays bounded
+func (t *loginThrottle) cleanup(now time.Time) {
+	if now.Sub(t.lastCleanup) < loginThrottleCleanupAge {
+		return
+	}
+	t.lastCleanup = now
+	for key, bucket := range t.ipBuckets {
+		if bucket.isFull(now) {
+			delete(t.ipBuckets, key)
+		}
+	}
+	for key, bucket := range t.providerBuckets {
+		if bucket.isFull(now) {
+			delete(t.providerBuckets, key)
+		}
+	}
+	for key, failures := range t.failures {
+		// Failures older than the maximum backoff no longer count towards the next one
+		if now.After(failures.lastFailure.Add(loginBackoffMax)) && now.After(failures.blockedUntil) {
+			delete(t.failures, key)
+		}
+	}
+	for clientIP, transactions := range t.pending {
+		for state, expires := range transactions {
+			if now.After(expires) {
+				delete(transactions, state)
+			}
+		}
+		if len(transactions) == 0 {
+			delete(t.pending, clientIP)
+		}
+	}
+}
+
+func respondThrottled(w http.ResponseWriter, throttleErr *loginThrottleError) {
+	retryAfterSeconds := int(math.Ceil(throttleErr.retryAfter.Seconds()))
+	if retryAfterSeconds < 1 {
+		retryAfterSeconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	respondWithError(w, http.StatusTooManyRequests, throttleErr.reason)
+}
+
+func clientIPKey(r *http.Request) string {
+	ip := config.ClientIP(r)
+	if ip == nil {
+		return fmt.Sprintf("unknown:%s", r.RemoteAddr)
+	}
+	return ip.String()
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/log"
+)
+
+func TestMain(m *testing.M) {
+	log.InitLogs()
+	os.Exit(m.Run())
+}
+
+func newTestLoginThrottle(perIP, perProvider, maxPending int) (*loginThrottle, *time.Time) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	throttle := newLoginThrottle(perIP, perProvider, maxPending)
+	throttle.now = func() time.Time { return now }
+	return throttle, &now
+}
+
+func TestLoginThrottlePerIPLimit(t *testing.T) {
+	t.Parallel()
+	throttle, now := newTestLoginThrottle(2, 0, 0)
+
+	for i := 0; i < 2; i++ {
+		if err := throttle.allow("192.0.2.1", "k8s"); err != nil {
+			t.Fatalf("expected attempt %d to be allowed, got: %v", i+1, err)
+		}
+	}
+	err := throttle.allow("192.0.2.1", "k8s")
+	if err == nil {
+		t.Fatal("expected the third attempt within a minute to be throttled")
+	}
+	if err.retryAfter <= 0 || err.retryAfter > 30*time.Second {
+		t.Fatalf("unexpected retryAfter %s", err.retryAfter)
+	}
+	if err := throttle.allow("192.0.2.2", "k8s"); err != nil {
+		t.Fatalf("expected a different client IP not to be throttled, got: %v", err)
+	}
+
+	*now = now.Add(30 * time.Second)
+	if err := throttle.allow("192.0.2.1", "k8s"); err != nil {
+		t.Fatalf("expected the bucket to refill, got: %v", err)
+	}
+}
+
+func TestLoginThrottleFailureBackoff(t *testing.T) {
+	t.Parallel()
+	throttle, now := newTestLoginThrottle(0, 0, 0)
+
+	for i := 0; i < loginFailureThreshold-1; i++ {
+		throttle.recordFailure("192.0.2.1", "k8s")
+	}
+	if err := throttle.allow("192.0.2.1", "k8s"); err != nil {
+		t.Fatalf("expected no backoff below the failure threshold, got: %v", err)
+	}
+
+	throttle.recordFailure("192.0.2.1", "k8s")
+	err := throttle.allow("192.0.2.1", "k8s")
+	if err == nil || err.retryAfter != loginBackoffBase {
+		t.Fatalf("expected a backoff of %s, got: %v", loginBackoffBase, err)
+	}
+	if err := throttle.allow("192.0.2.1", "oidc"); err != nil {
+		t.Fatalf("expected other providers not to be affected, got: %v", err)
+	}
+
+	*now = now.Add(loginBackoffBase)
+	throttle.recordFailure("192.0.2.1", "k8s")
+	if err := throttle.allow("192.0.2.1", "k8s"); err == nil || err.retryAfter != 2*loginBackoffBase {
+		t.Fatalf("expected the backoff to double, got: %v", err)
+	}
+
+	throttle.recordSuccess("192.0.2.1", "k8s")
+	if err := throttle.allow("192.0.2.1", "k8s"); err != nil {
+		t.Fatalf("expected a successful login to reset the backoff, got: %v", err)
+	}
+}
+
+func TestLoginThrottlePendingTransactions(t *testing.T) {
+	t.Parallel()
+	throttle, now := newTestLoginThrottle(0, 0, 2)
+
+	if err := throttle.beginTransaction("192.0.2.1", "state-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := throttle.beginTransaction("192.0.2.1", "state-2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := throttle.beginTransaction("192.0.2.1", "state-3"); err == nil {
+		t.Fatal("expected the pending transaction cap to be enforced")
+	}
+
+	throttle.endTransaction("192.0.2.1", "state-1")
+	if err := throttle.beginTransaction("192.0.2.1", "state-3"); err != nil {
+		t.Fatalf("expected a completed transaction to free a slot, got: %v", err)
+	}
+
+	*now = now.Add(loginTransactionTTL + time.Second)
+	if err := throttle.beginTransaction("192.0.2.1", "state-4"); err != nil {
+		t.Fatalf("expected expired transactions not to count, got: %v", err)
+	}
+}
+
+func TestRespondThrottled(t *testing.T) {
+	t.Parallel()
+	w := httptest.NewRecorder()
+	respondThrottled(w, &loginThrottleError{reason: "Too many login attempts. Please try again later.", retryAfter: 1500 * time.Millisecond})
+
+	if w.Code != 429 {
+		t.Fatalf("expected status 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("expected Retry-After to be rounded up to 2, got %q", w.Header().Get("Retry-After"))
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected a JSON error, got content type %q", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestClientIPKeySpoofedForwardedFor(t *testing.T) { //nolint:paralleltest // mutates package-level config
+	oldTrust := config.TrustXForwardedHeaders
+	defer func() { config.TrustXForwardedHeaders = oldTrust }()
+	config.TrustXForwardedHeaders = true
+
+	// Without trusted proxy CIDRs, the entries a client prepends must not change its throttle key
+	keys := map[string]bool{}
+	for _, forwardedFor := range []string{"198.51.100.7", "203.0.113.1, 198.51.100.7", "203.0.113.2, 203.0.113.3, 198.51.100.7"} {
+		req := httptest.NewRequest("POST", "/api/login", nil)
+		req.RemoteAddr = "10.0.0.5:12345"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		keys[clientIPKey(req)] = true
+	}
+	if len(keys) != 1 || !keys["198.51.100.7"] {
+		t.Fatalf("expected the address seen by the proxy as the only key, got %v", keys)
+	}
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// usernameCacheTTL bounds how long a resolved username is reused before asking the API server again
+const usernameCacheTTL = time.Minute
+
+type usernameCacheEntry struct {
+	username string
+	expires  time.Time
+}
+
+// usernameCache maps session tokens to usernames so that resolving the requesting user
+// does not cost a userinfo call on every request. Tokens are only kept as SHA-256 digests.
+type usernameCache struct {
+	mu      sync.Mutex
+	entries map[string]usernameCacheEntry
+}
+
+func newUsernameCache() *usernameCache {
+	return &usernameCache{entries: map[string]usernameCacheEntry{}}
+}
+
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *usernameCache) get(token string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[tokenDigest(token)]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.username, true
+}
+
+func (c *usernameCache) set(token string, username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[tokenDigest(token)] = usernameCacheEntry{username: username, expires: now.Add(usernameCacheTTL)}
+}
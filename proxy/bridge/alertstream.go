@@ -0,0 +1,400 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/log"
+	"github.com/flightctl/flightctl-ui/metrics"
+	"github.com/flightctl/flightctl-ui/tracing"
+)
+
+const (
+	alertStreamHeartbeatInterval = 15 * time.Second
+	// alertStreamHistory is the number of events kept to resume the streams of reconnecting browsers
+	alertStreamHistory = 500
+	// alertSubscriberBuffer is the number of events a slow browser may lag behind before it is
+	// disconnected, after which it resumes from its Last-Event-ID
+	alertSubscriberBuffer = 64
+)
+
+// Alert stream events
+const (
+	alertEventSnapshot = "alerts-snapshot"
+	alertEventFiring   = "alert-firing"
+	alertEventResolved = "alert-resolved"
+)
+
+var alertStreamSubscribers = metrics.NewGaugeVec(
+	"flightctl_ui_alert_stream_subscribers",
+	"Browsers subscribed to the alert stream.",
+	"instance",
+)
+
+type alertEvent struct {
+	id   string
+	seq  uint64
+	name string
+	data []byte
+}
+
+type alertSubscriber struct {
+	token  string
+	events chan alertEvent
+	// done is closed when the subscriber is disconnected by the stream
+	done chan struct{}
+}
+
+// orgAlertStream polls the firing alerts of an organization while browsers are subscribed to them,
+// and pushes the alerts that start or stop firing to every subscriber
+type orgAlertStream struct {
+	orgID string
+	// epoch prefixes the event IDs, so that browsers do not resume from the events of a previous stream
+	epoch  string
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	subscribers []*alertSubscriber
+	alerts      map[string]json.RawMessage
+	polled      bool
+	history     []alertEvent
+	lastID      uint64
+}
+
+// AlertStreamHandler serves the server-sent events of /api/alerts-stream for a Flight Control instance
+type AlertStreamHandler struct {
+	instance     string
+	target       *url.URL
+	client       *http.Client
+	pollInterval time.Duration
+
+	mu      sync.Mutex
+	streams map[string]*orgAlertStream
+}
+
+func NewAlertStreamHandler(instance config.Instance, tlsConfig *tls.Config) *AlertStreamHandler {
+	target, err := url.Parse(instance.AlertManagerUrl)
+	if err != nil {
+		log.GetLogger().WithError(err).Fatalf("Failed to parse URL '%s'", instance.AlertManagerUrl)
+	}
+	return &AlertStreamHandler{
+		instance:     instance.Name,
+		target:       target,
+		client:       &http.Client{Transport: newUpstreamTransport(instance, upstreamAlertManager, tlsConfig), Timeout: 30 * time.Second},
+		pollInterval: config.AlertsStreamPollInterval,
+		streams:      map[string]*orgAlertStream{},
+	}
+}
+
+// fetchAlerts returns the alerts firing in the organization, as seen with the given token
+func (h *AlertStreamHandler) fetchAlerts(ctx context.Context, token, orgID string) ([]json.RawMessage, int, error) {
+	alertsURL := *h.target
+	alertsURL.Path = path.Join("/", h.target.Path, "api/v2/alerts")
+	alertsURL.RawQuery = url.Values{
+		"active":    {"true"},
+		"silenced":  {"false"},
+		"inhibited": {"false"},
+		"filter":    {common.OrgIDLabel + "=" + orgID},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, alertsURL.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set(common.AuthHeaderKey, token)
+	resp, err := tracing.Do(h.client, req, "fetchAlerts")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, nil
+	}
+	var alerts []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&alerts); err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("invalid alerts response: %w", err)
+	}
+	return filterOrgAlerts(alerts, orgID), resp.StatusCode, nil
+}
+
+func alertFingerprint(alert json.RawMessage) string {
+	var decoded struct {
+		Fingerprint string `json:"fingerprint"`
+	}
+	_ = json.Unmarshal(alert, &decoded)
+	return decoded.Fingerprint
+}
+
+// update replaces the firing alerts of the stream and pushes the differences to the subscribers
+func (s *orgAlertStream) update(alerts []json.RawMessage) {
+	firing := make(map[string]json.RawMessage, len(alerts))
+	for _, alert := range alerts {
+		fingerprint := alertFingerprint(alert)
+		// Events are sent on a single data line, which requires compact JSON
+		compact, err := json.Marshal(alert)
+		if fingerprint != "" && err == nil {
+			firing[fingerprint] = compact
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.polled {
+		for fingerprint, alert := range firing {
+			if _, ok := s.alerts[fingerprint]; !ok {
+				s.publishLocked(alertEventFiring, alert)
+			}
+		}
+		for fingerprint, alert := range s.alerts {
+			if _, ok := firing[fingerprint]; !ok {
+				s.publishLocked(alertEventResolved, alert)
+			}
+		}
+	}
+	s.alerts = firing
+	s.polled = true
+}
+
+func (s *orgAlertStream) publishLocked(name string, data []byte) {
+	s.lastID++
+	event := alertEvent{id: s.eventID(s.lastID), seq: s.lastID, name: name, data: data}
+	s.history = append(s.history, event)
+	if len(s.history) > alertStreamHistory {
+		s.history = s.history[len(s.history)-alertStreamHistory:]
+	}
+	remaining := s.subscribers[:0]
+	for _, subscriber := range s.subscribers {
+		select {
+		case subscriber.events <- event:
+			remaining = append(remaining, subscriber)
+		default:
+			close(subscriber.done)
+		}
+	}
+	s.subscribers = remaining
+}
+
+// snapshotLocked returns an event listing all the firing alerts
+func (s *orgAlertStream) snapshotLocked() alertEvent {
+	alerts := make([]json.RawMessage, 0, len(s.alerts))
+	for _, alert := range s.alerts {
+		alerts = append(alerts, alert)
+	}
+	data, _ := json.Marshal(alerts)
+	return alertEvent{id: s.eventID(s.lastID), seq: s.lastID, name: alertEventSnapshot, data: data}
+}
+
+func (s *orgAlertStream) eventID(seq uint64) string {
+	return s.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// subscribe adds a subscriber and returns the events it must receive first: the events it
+// missed when it resumes from lastEventID, or a snapshot of the firing alerts
+func (s *orgAlertStream) subscribe(subscriber *alertSubscriber, lastEventID string) []alertEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = append(s.subscribers, subscriber)
+
+	epoch, seq, _ := strings.Cut(lastEventID, "-")
+	if lastID, err := strconv.ParseUint(seq, 10, 64); err == nil && epoch == s.epoch && lastID <= s.lastID {
+		if lastID == s.lastID {
+			return nil
+		}
+		if len(s.history) > 0 && s.history[0].seq <= lastID+1 {
+			var missed []alertEvent
+			for _, event := range s.history {
+				if event.seq > lastID {
+					missed = append(missed, event)
+				}
+			}
+			return missed
+		}
+	}
+	return []alertEvent{s.snapshotLocked()}
+}
+
+// removeLocked disconnects the subscribers matching the predicate and returns how many are left
+func (s *orgAlertStream) removeLocked(match func(*alertSubscriber) bool) int {
+	remaining := s.subscribers[:0]
+	for _, subscriber := range s.subscribers {
+		if match(subscriber) {
+			select {
+			case <-subscriber.done:
+			default:
+				close(subscriber.done)
+			}
+			continue
+		}
+		remaining = append(remaining, subscriber)
+	}
+	s.subscribers = remaining
+	return len(remaining)
+}
+
+// pollToken returns the token of the most recent subscriber, which was verified when it subscribed
+func (s *orgAlertStream) pollToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subscribers) == 0 {
+		return ""
+	}
+	return s.subscribers[len(s.subscribers)-1].token
+}
+
+// join returns the stream of the organization, and starts polling when it is new
+func (h *AlertStreamHandler) join(orgID string, subscriber *alertSubscriber, lastEventID string, alerts []json.RawMessage) []alertEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stream, ok := h.streams[orgID]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream = &orgAlertStream{
+			orgID:  orgID,
+			epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+			cancel: cancel,
+			alerts: map[string]json.RawMessage{},
+		}
+		// The alerts fetched to verify the first subscriber are the initial state of the stream
+		stream.update(alerts)
+		h.streams[orgID] = stream
+		go h.poll(ctx, stream)
+	}
+	alertStreamSubscribers.Add(1, h.instance)
+	return stream.subscribe(subscriber, lastEventID)
+}
+
+// leave removes the subscriber, and stops polling once the organization has no subscribers left
+func (h *AlertStreamHandler) leave(orgID string, subscriber *alertSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	alertStreamSubscribers.Add(-1, h.instance)
+	stream, ok := h.streams[orgID]
+	if !ok {
+		return
+	}
+	stream.mu.Lock()
+	remaining := stream.removeLocked(func(s *alertSubscriber) bool { return s == subscriber })
+	stream.mu.Unlock()
+	if remaining == 0 {
+		stream.cancel()
+		delete(h.streams, orgID)
+	}
+}
+
+func (h *AlertStreamHandler) poll(ctx context.Context, stream *orgAlertStream) {
+	ticker := time.NewTicker(h.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		token := stream.pollToken()
+		if token == "" {
+			continue
+		}
+		alerts, status, err := h.fetchAlerts(ctx, token, stream.orgID)
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				log.GetLogger().WithError(err).Warnf("Failed to poll the alerts of organization %s", stream.orgID)
+			}
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			// The session expired or lost access: its browsers reconnect and get verified again
+			stream.mu.Lock()
+			stream.removeLocked(func(s *alertSubscriber) bool { return s.token == token })
+			stream.mu.Unlock()
+		case status != http.StatusOK:
+			log.GetLogger().Warnf("Failed to poll the alerts of organization %s: status %d", stream.orgID, status)
+		default:
+			stream.update(alerts)
+		}
+	}
+}
+
+func writeAlertEvent(w http.ResponseWriter, event alertEvent) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.id, event.name, event.data)
+	return err
+}
+
+func (h *AlertStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	orgID := r.URL.Query().Get("org_id")
+	if !common.IsSafeResourceName(orgID) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPreconditionRequired)
+		_, _ = w.Write([]byte(`{"error": "Organization selection required", "code": "ORGANIZATION_REQUIRED"}`))
+		return
+	}
+	token := r.Header.Get(common.AuthHeaderKey)
+	if token == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// Every browser is verified with its own session before receiving the alerts of the organization
+	alerts, status, err := h.fetchAlerts(r.Context(), token, orgID)
+	if err != nil {
+		handleUpstreamError(w, r, err)
+		return
+	}
+	switch status {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		// Same as the alerts API, a 401 means that alerts are disabled
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	default:
+		w.WriteHeader(status)
+		return
+	}
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	subscriber := &alertSubscriber{token: token, events: make(chan alertEvent, alertSubscriberBuffer), done: make(chan struct{})}
+	initial := h.join(orgID, subscriber, r.Header.Get("Last-Event-ID"), alerts)
+	defer h.leave(orgID, subscriber)
+
+	for _, event := range initial {
+		if writeAlertEvent(w, event) != nil {
+			return
+		}
+	}
+	if controller.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(alertStreamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-subscriber.done:
+			return
+		case event := <-subscriber.events:
+			err = writeAlertEvent(w, event)
+		case <-heartbeat.C:
+			_, err = w.Write([]byte(": heartbeat\n\n"))
+		}
+		if err != nil || controller.Flush() != nil {
+			return
+		}
+	}
+}
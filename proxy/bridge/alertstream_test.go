@@ -0,0 +1,117 @@
+package bridge
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAlertStream() *orgAlertStream {
+	return &orgAlertStream{orgID: "org1", epoch: "e1", cancel: func() {}, alerts: map[string]json.RawMessage{}}
+}
+
+func testAlert(fingerprint string) json.RawMessage {
+	return json.RawMessage(`{"fingerprint": "` + fingerprint + `", "labels": {"org_id": "org1"}}`)
+}
+
+func TestOrgAlertStreamPublishesDifferences(t *testing.T) {
+	stream := newTestAlertStream()
+	stream.update([]json.RawMessage{testAlert("a")})
+
+	subscriber := &alertSubscriber{events: make(chan alertEvent, 10), done: make(chan struct{})}
+	initial := stream.subscribe(subscriber, "")
+	if len(initial) != 1 || initial[0].name != alertEventSnapshot || initial[0].id != "e1-0" {
+		t.Fatalf("expected a snapshot for a new subscriber, got %+v", initial)
+	}
+
+	stream.update([]json.RawMessage{testAlert("b")})
+	events := []alertEvent{<-subscriber.events, <-subscriber.events}
+	names := map[string]string{}
+	for _, event := range events {
+		names[alertFingerprint(event.data)] = event.name
+	}
+	if names["b"] != alertEventFiring || names["a"] != alertEventResolved {
+		t.Errorf("unexpected events: %v", names)
+	}
+
+	// A browser reconnecting with the ID of the first event only receives the second one
+	resumed := stream.subscribe(&alertSubscriber{events: make(chan alertEvent, 10), done: make(chan struct{})}, events[0].id)
+	if len(resumed) != 1 || resumed[0].id != events[1].id {
+		t.Errorf("expected the missed event to be replayed, got %+v", resumed)
+	}
+	// Event IDs of another stream cannot be resumed
+	other := stream.subscribe(&alertSubscriber{events: make(chan alertEvent, 10), done: make(chan struct{})}, "e0-1")
+	if len(other) != 1 || other[0].name != alertEventSnapshot {
+		t.Errorf("expected a snapshot for an unknown stream, got %+v", other)
+	}
+}
+
+func TestAlertStreamHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("filter") != "org_id=org1" {
+			t.Errorf("unexpected filter %q", r.URL.Query().Get("filter"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`[{"fingerprint": "a", "labels": {"org_id": "org1"}}, {"fingerprint": "x", "labels": {"org_id": "org2"}}]`))
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+	handler := &AlertStreamHandler{
+		instance:     "default",
+		target:       target,
+		client:       upstream.Client(),
+		pollInterval: time.Hour,
+		streams:      map[string]*orgAlertStream{},
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/alerts-stream?org_id=org1", nil)
+	req.Header.Set("Authorization", "Bearer expired")
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("expected 401 to be reported as 501, got %d", rec.Code)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer valid")
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	streamReq, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/alerts-stream?org_id=org1", nil)
+	resp, err := http.DefaultClient.Do(streamReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	if !strings.HasPrefix(lines[0], "id: ") || lines[1] != "event: "+alertEventSnapshot {
+		t.Fatalf("unexpected event: %v", lines)
+	}
+	var snapshot []json.RawMessage
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &snapshot); err != nil || len(snapshot) != 1 {
+		t.Errorf("expected the snapshot to hold the alert of org1 only, got %s", lines[2])
+	}
+}
@@ -0,0 +1,293 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+)
+
+// Sub-request responses larger than this are discarded
+const maxBatchResponseSize = 4 << 20
+
+var errBatchResponseTooLarge = errors.New("response too large for a batch")
+
+// batchAllowedPrefixes are the API routes that can be called from a batch
+var batchAllowedPrefixes = []string{"/api/flightctl/", "/api/imagebuilder/", "/api/alerts/"}
+
+// batchForwardedHeaders are copied from the batch request to its sub-requests, so that they are
+// authenticated and scoped to an organization like direct calls
+var batchForwardedHeaders = []string{
+	"Cookie", "Accept-Language", "Flightctl-API-Version", "X-FlightCtl-Organization-ID", "User-Agent",
+	"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto",
+}
+
+// batchItemHeaders are the headers a sub-request may set for itself
+var batchItemHeaders = []string{"Accept", "Content-Type", "Flightctl-API-Version", "X-FlightCtl-Organization-ID", "If-None-Match"}
+
+// batchHiddenHeaders are not returned for the sub-requests, as the browser cannot act on them
+var batchHiddenHeaders = []string{"Set-Cookie", "Clear-Site-Data", "Content-Length", "Connection", "Transfer-Encoding"}
+
+// BatchRequestItem is a sub-request of a batch. Path includes the query string, e.g.
+// /api/flightctl/api/v1/devices?limit=10.
+type BatchRequestItem struct {
+	ID      string            `json:"id,omitempty"`
+	Method  string            `json:"method,omitempty"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// BatchResponseItem is the response of a sub-request. JSON bodies are embedded as they are, other
+// bodies as a string. Error is set when the proxy could not complete the sub-request.
+type BatchResponseItem struct {
+	ID      string            `json:"id,omitempty"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// BatchHandler runs the sub-requests of a batch concurrently through the API router, so that
+// they get the same authentication, organization and policy handling as direct calls
+type BatchHandler struct {
+	target         http.Handler
+	maxItems       int
+	maxConcurrency int
+	itemTimeout    time.Duration
+}
+
+func NewBatchHandler(target http.Handler) *BatchHandler {
+	return &BatchHandler{
+		target:         target,
+		maxItems:       config.BatchMaxItems,
+		maxConcurrency: max(config.BatchMaxConcurrency, 1),
+		itemTimeout:    config.BatchItemTimeout,
+	}
+}
+
+func writeBatchError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message, "code": "INVALID_BATCH"})
+}
+
+// batchResponseBuffer captures the response of a sub-request, and aborts it once it grows too large
+type batchResponseBuffer struct {
+	header    http.Header
+	status    int
+	body      bytes.Buffer
+	oversized bool
+}
+
+func (b *batchResponseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *batchResponseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *batchResponseBuffer) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	if b.body.Len()+len(p) > maxBatchResponseSize {
+		b.oversized = true
+		return 0, errBatchResponseTooLarge
+	}
+	return b.body.Write(p)
+}
+
+// validateBatchItem checks that the sub-request targets an upstream API, and returns its URL
+func validateBatchItem(item *BatchRequestItem) (*url.URL, error) {
+	if item.Method == "" {
+		item.Method = http.MethodGet
+	}
+	item.Method = strings.ToUpper(item.Method)
+	if item.Method == http.MethodConnect || item.Method == http.MethodOptions || item.Method == http.MethodTrace {
+		return nil, fmt.Errorf("method %s is not allowed", item.Method)
+	}
+	itemURL, err := url.ParseRequestURI(item.Path)
+	if err != nil || itemURL.Host != "" || itemURL.Scheme != "" {
+		return nil, errors.New("path must be an absolute path")
+	}
+	// Dot segments would let a path escape the allowed prefixes after being cleaned by the router
+	if path.Clean(itemURL.Path) != itemURL.Path && path.Clean(itemURL.Path)+"/" != itemURL.Path {
+		return nil, errors.New("path must not contain dot segments or empty segments")
+	}
+	for _, prefix := range batchAllowedPrefixes {
+		if strings.HasPrefix(itemURL.Path, prefix) {
+			return itemURL, nil
+		}
+	}
+	return nil, fmt.Errorf("path must start with one of %s", strings.Join(batchAllowedPrefixes, ", "))
+}
+
+func (h *BatchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeBatchError(w, http.StatusMethodNotAllowed, "Batches must be sent with POST")
+		return
+	}
+	var items []BatchRequestItem
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeBatchError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Batch exceeds the limit of %d bytes", maxBytesErr.Limit))
+			return
+		}
+		writeBatchError(w, http.StatusBadRequest, "The batch must be a JSON array of requests")
+		return
+	}
+	if len(items) == 0 {
+		writeBatchError(w, http.StatusBadRequest, "The batch is empty")
+		return
+	}
+	if h.maxItems > 0 && len(items) > h.maxItems {
+		writeBatchError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("The batch has %d requests, the limit is %d", len(items), h.maxItems))
+		return
+	}
+
+	results := make([]BatchResponseItem, len(items))
+	clearSiteData := make([]bool, len(items))
+	semaphore := make(chan struct{}, h.maxConcurrency)
+	var wg sync.WaitGroup
+	for i := range items {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-r.Context().Done():
+				results[i] = BatchResponseItem{ID: items[i].ID, Status: http.StatusServiceUnavailable, Error: "The batch was cancelled"}
+				return
+			}
+			results[i], clearSiteData[i] = h.serveItem(r, i, &items[i])
+		}(i)
+	}
+	wg.Wait()
+
+	// An expired session must still clear the session cookie
+	for _, clear := range clearSiteData {
+		if clear {
+			w.Header().Set("Clear-Site-Data", `"cookies"`)
+			break
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+// serveItem runs a sub-request and reports whether its response asked to clear the session cookie
+func (h *BatchHandler) serveItem(r *http.Request, index int, item *BatchRequestItem) (BatchResponseItem, bool) {
+	result := BatchResponseItem{ID: item.ID}
+	itemURL, err := validateBatchItem(item)
+	if err != nil {
+		result.Status = http.StatusBadRequest
+		result.Error = err.Error()
+		return result, false
+	}
+
+	ctx := r.Context()
+	if h.itemTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.itemTimeout)
+		defer cancel()
+	}
+	var body io.Reader = http.NoBody
+	if len(item.Body) > 0 {
+		body = bytes.NewReader(item.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, item.Method, itemURL.String(), body)
+	if err != nil {
+		result.Status = http.StatusBadRequest
+		result.Error = err.Error()
+		return result, false
+	}
+	req.RequestURI = itemURL.RequestURI()
+	req.RemoteAddr = r.RemoteAddr
+	req.Host = r.Host
+	req.TLS = r.TLS
+	for _, name := range batchForwardedHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			req.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	for name, value := range item.Headers {
+		for _, allowed := range batchItemHeaders {
+			if strings.EqualFold(name, allowed) {
+				req.Header.Set(allowed, value)
+			}
+		}
+	}
+	if len(item.Body) > 0 && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// Each sub-request is identified by the batch request ID and its position
+	if requestID := r.Header.Get(common.RequestIDHeader); requestID != "" {
+		req.Header.Set(common.RequestIDHeader, requestID+"."+strconv.Itoa(index))
+	}
+
+	buffer := &batchResponseBuffer{header: http.Header{}}
+	h.target.ServeHTTP(buffer, req)
+
+	if ctx.Err() != nil && buffer.status == 0 {
+		result.Status = http.StatusGatewayTimeout
+		result.Error = "The request timed out"
+		return result, false
+	}
+	if buffer.oversized {
+		result.Status = http.StatusBadGateway
+		result.Error = fmt.Sprintf("The response exceeds the batch limit of %d bytes", maxBatchResponseSize)
+		return result, false
+	}
+	result.Status = buffer.status
+	if result.Status == 0 {
+		result.Status = http.StatusOK
+	}
+	result.Headers = map[string]string{}
+	for name, values := range buffer.header {
+		hidden := false
+		for _, h := range batchHiddenHeaders {
+			hidden = hidden || strings.EqualFold(name, h)
+		}
+		if !hidden {
+			result.Headers[name] = strings.Join(values, ", ")
+		}
+	}
+	result.Body = batchResponseBody(buffer)
+	return result, buffer.header.Get("Clear-Site-Data") != ""
+}
+
+// batchResponseBody embeds JSON bodies as they are, and wraps other bodies in a JSON string
+func batchResponseBody(buffer *batchResponseBuffer) json.RawMessage {
+	body := buffer.body.Bytes()
+	if len(body) == 0 {
+		return nil
+	}
+	if strings.Contains(buffer.header.Get("Content-Type"), "json") && json.Valid(body) {
+		return body
+	}
+	encoded, err := json.Marshal(string(body))
+	if err != nil {
+		return nil
+	}
+	return encoded
+}
@@ -0,0 +1,438 @@
+package bridge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/metrics"
+)
+
+// Responses larger than this are passed through without being cached
+const maxCachedResponseSize = 4 << 20
+
+var cacheRequests = metrics.NewCounterVec(
+	"flightctl_ui_api_cache_requests_total",
+	"GET requests to the Flight Control API handled by the response cache, by result.",
+	"result",
+)
+
+// Cache results
+const (
+	cacheHit         = "hit"
+	cacheMiss        = "miss"
+	cacheRevalidated = "revalidated"
+	cacheCoalesced   = "coalesced"
+)
+
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+type cacheEntry struct {
+	response  *cachedResponse
+	etag      string
+	path      string
+	org       string
+	fetchedAt time.Time
+}
+
+// inflightRequest is shared by the identical requests that arrive while the first one is being served
+type inflightRequest struct {
+	done     chan struct{}
+	response *cachedResponse
+	// streamed is set when the response turned out to be too large or a stream, and was written
+	// to the first request only
+	streamed bool
+	// abandoned is set when the first request ended before getting the response of the upstream
+	abandoned bool
+}
+
+// responseBuffer captures a response so that it can be cached and replayed. Responses that
+// turn out to be streams or too large to be cached are written through to w instead.
+type responseBuffer struct {
+	w      http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+	// streaming is set once the response is written through to w
+	streaming bool
+	// onStream is called when the response starts being written through
+	onStream func()
+	err      error
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status != 0 {
+		return
+	}
+	b.status = status
+	if isStreamingContentType(b.header.Get("Content-Type")) {
+		b.stream()
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.WriteHeader(http.StatusOK)
+	}
+	if !b.streaming && b.body.Len()+len(p) > maxCachedResponseSize {
+		b.stream()
+	}
+	if b.streaming {
+		if b.err != nil {
+			return 0, b.err
+		}
+		return b.w.Write(p)
+	}
+	return b.body.Write(p)
+}
+
+func (b *responseBuffer) Flush() {
+	if b.streaming {
+		_ = http.NewResponseController(b.w).Flush()
+	}
+}
+
+// stream writes the response captured so far to w, which receives the rest of the response directly
+func (b *responseBuffer) stream() {
+	b.streaming = true
+	for key, values := range b.header {
+		b.w.Header()[key] = values
+	}
+	b.w.Header().Set("X-Cache", cacheMiss)
+	b.w.WriteHeader(b.status)
+	if b.body.Len() > 0 {
+		_, b.err = b.w.Write(b.body.Bytes())
+		b.body.Reset()
+	}
+	if b.onStream != nil {
+		b.onStream()
+	}
+}
+
+// isStreamingContentType tells whether a response is delivered progressively, such as server-sent
+// events and followed logs
+func isStreamingContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/event-stream") || strings.HasPrefix(contentType, "application/x-ndjson")
+}
+
+// responseCache serves repeated GET requests to the Flight Control API from memory. Entries are
+// private to the session token and organization they were fetched with, are fresh for a short
+// TTL and then revalidated with the ETag returned by the API.
+type responseCache struct {
+	next       http.Handler
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	inflight map[string]*inflightRequest
+}
+
+func newResponseCache(next http.Handler, ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{
+		next:       next,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		entries:    map[string]*cacheEntry{},
+		inflight:   map[string]*inflightRequest{},
+	}
+}
+
+// WithResponseCache wraps the Flight Control API handler with the response cache when it is enabled
+func WithResponseCache(next http.Handler) http.Handler {
+	if config.ApiCacheEnabled != "true" {
+		return next
+	}
+	return newResponseCache(next, config.ApiCacheTTL, config.ApiCacheMaxEntries)
+}
+
+// normalizedRequestURL returns the path with the query parameters in a stable order
+func normalizedRequestURL(r *http.Request) string {
+	query := r.URL.Query()
+	if len(query) == 0 {
+		return r.URL.Path
+	}
+	return r.URL.Path + "?" + query.Encode()
+}
+
+func cacheKey(r *http.Request) string {
+	token := sha256.Sum256([]byte(r.Header.Get(common.AuthHeaderKey)))
+	// The API version, media type and encoding change the representation of the same URL
+	parts := []string{
+		hex.EncodeToString(token[:]),
+		r.URL.Query().Get("org_id"),
+		r.Header.Get("Flightctl-API-Version"),
+		r.Header.Get("Accept"),
+		r.Header.Get("Accept-Encoding"),
+		normalizedRequestURL(r),
+	}
+	return strings.Join(parts, "\n")
+}
+
+// resourceCollectionPath returns the collection a resource path belongs to, e.g.
+// /api/flightctl/api/v1/devices for /api/flightctl/api/v1/devices/my-device/decommission
+func resourceCollectionPath(path string) string {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 6)
+	if len(segments) < 5 {
+		return path
+	}
+	return "/" + strings.Join(segments[:5], "/")
+}
+
+func isCacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "text/event-stream") || strings.Contains(accept, "application/x-ndjson") {
+		return false
+	}
+	if r.URL.Query().Get("follow") == "true" {
+		return false
+	}
+	return !strings.Contains(r.Header.Get("Cache-Control"), "no-cache")
+}
+
+func isCacheableResponse(buffer *responseBuffer) bool {
+	if buffer.status != http.StatusOK || buffer.streaming {
+		return false
+	}
+	cacheControl := buffer.header.Get("Cache-Control")
+	if strings.Contains(cacheControl, "no-store") {
+		return false
+	}
+	return buffer.header.Get("Set-Cookie") == ""
+}
+
+func (c *responseCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isMutatingRequest(r.Method) {
+		c.invalidate(r)
+		c.next.ServeHTTP(w, r)
+		// Lists fetched while the mutation was in progress may already be outdated
+		c.invalidate(r)
+		return
+	}
+	if !isCacheableRequest(r) {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	key := cacheKey(r)
+	clientETag := r.Header.Get("If-None-Match")
+
+	for {
+		c.mu.Lock()
+		entry := c.entries[key]
+		if entry != nil && c.now().Sub(entry.fetchedAt) < c.ttl {
+			c.mu.Unlock()
+			cacheRequests.Inc(cacheHit)
+			writeCachedResponse(w, entry.response, clientETag, cacheHit)
+			return
+		}
+		call, ok := c.inflight[key]
+		if !ok {
+			call = &inflightRequest{done: make(chan struct{})}
+			c.inflight[key] = call
+			c.mu.Unlock()
+			c.fetch(w, r, key, entry, call)
+			return
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			return
+		}
+		switch {
+		case call.abandoned:
+			// The request fetching the response was cancelled or timed out, so its response
+			// is not the one of the upstream: fetch it again
+			continue
+		case call.streamed:
+			c.next.ServeHTTP(w, r)
+			return
+		}
+		cacheRequests.Inc(cacheCoalesced)
+		writeCachedResponse(w, call.response, clientETag, cacheCoalesced)
+		return
+	}
+}
+
+// fetch serves the request from the upstream on behalf of the identical requests waiting on call,
+// and caches the response
+func (c *responseCache) fetch(w http.ResponseWriter, r *http.Request, key string, entry *cacheEntry, call *inflightRequest) {
+	var release sync.Once
+	done := func() {
+		release.Do(func() {
+			c.mu.Lock()
+			delete(c.inflight, key)
+			c.mu.Unlock()
+			close(call.done)
+		})
+	}
+	defer done()
+
+	upstreamReq := r.Clone(r.Context())
+	upstreamReq.Header.Del("If-None-Match")
+	upstreamReq.Header.Del("If-Modified-Since")
+	if entry != nil && entry.etag != "" {
+		upstreamReq.Header.Set("If-None-Match", entry.etag)
+	}
+	buffer := &responseBuffer{w: w, header: http.Header{}}
+	// The waiting requests get their own response rather than waiting for the end of a stream
+	buffer.onStream = func() {
+		call.streamed = true
+		done()
+	}
+	c.next.ServeHTTP(buffer, upstreamReq)
+
+	if buffer.streaming {
+		c.remove(key)
+		cacheRequests.Inc(cacheMiss)
+		return
+	}
+	if r.Context().Err() != nil {
+		call.abandoned = true
+		done()
+		cacheRequests.Inc(cacheMiss)
+		if buffer.status != 0 {
+			writeCachedResponse(w, &cachedResponse{status: buffer.status, header: buffer.header, body: buffer.body.Bytes()}, "", cacheMiss)
+		}
+		return
+	}
+
+	result := cacheMiss
+	switch {
+	case buffer.status == http.StatusNotModified && entry != nil:
+		result = cacheRevalidated
+		c.mu.Lock()
+		entry.fetchedAt = c.now()
+		c.mu.Unlock()
+		call.response = entry.response
+	default:
+		call.response = &cachedResponse{status: buffer.status, header: buffer.header, body: buffer.body.Bytes()}
+		if isCacheableResponse(buffer) {
+			c.store(key, &cacheEntry{
+				response:  call.response,
+				etag:      buffer.header.Get("ETag"),
+				path:      r.URL.Path,
+				org:       r.URL.Query().Get("org_id"),
+				fetchedAt: c.now(),
+			})
+		} else {
+			c.remove(key)
+		}
+	}
+	done()
+	cacheRequests.Inc(result)
+	writeCachedResponse(w, call.response, r.Header.Get("If-None-Match"), result)
+}
+
+func (c *responseCache) store(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		c.evict()
+	}
+	c.entries[key] = entry
+}
+
+func (c *responseCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// evict drops the expired entries, or the oldest one when none has expired. Entries are kept
+// beyond their TTL because their ETag still saves the transfer of unchanged responses.
+func (c *responseCache) evict() {
+	var oldestKey string
+	var oldest time.Time
+	expiry := c.now().Add(-10 * c.ttl)
+	for key, entry := range c.entries {
+		if entry.fetchedAt.Before(expiry) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldestKey == "" || entry.fetchedAt.Before(oldest) {
+			oldestKey, oldest = key, entry.fetchedAt
+		}
+	}
+	if len(c.entries) >= c.maxEntries && oldestKey != "" {
+		delete(c.entries, oldestKey)
+	}
+}
+
+// invalidate drops the cached responses of the collection modified by r, for every user of the organization
+func (c *responseCache) invalidate(r *http.Request) {
+	collection := resourceCollectionPath(r.URL.Path)
+	org := r.URL.Query().Get("org_id")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if entry.org == org && (entry.path == collection || strings.HasPrefix(entry.path, collection+"/")) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func isMutatingRequest(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// etagMatches implements the weak comparison used by If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func writeCachedResponse(w http.ResponseWriter, response *cachedResponse, clientETag, result string) {
+	if response == nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	for key, values := range response.header {
+		// Coalesced and cached responses keep the request ID of the request being answered
+		if key == common.RequestIDHeader {
+			continue
+		}
+		w.Header()[key] = append([]string(nil), values...)
+	}
+	w.Header().Set("X-Cache", result)
+	if response.status == http.StatusOK && clientETag != "" && etagMatches(clientETag, response.header.Get("ETag")) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(response.status)
+	_, _ = w.Write(response.body)
+}
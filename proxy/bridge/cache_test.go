@@ -0,0 +1,198 @@
+package bridge
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCacheTestRequest(method, target, token string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestResponseCache(t *testing.T) {
+	var calls atomic.Int32
+	var revalidations atomic.Int32
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		calls.Add(1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidations.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(`{"items":[]}`))
+	})
+
+	now := time.Now()
+	cache := newResponseCache(upstream, 5*time.Second, 100)
+	cache.now = func() time.Time { return now }
+	devices := "/api/flightctl/api/v1/devices?org_id=org1&limit=10"
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(newCacheTestRequest(http.MethodGet, devices, "a")); w.Header().Get("X-Cache") != cacheMiss || w.Body.String() != `{"items":[]}` {
+		t.Fatalf("expected first request to miss, got %q %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if w := serve(newCacheTestRequest(http.MethodGet, "/api/flightctl/api/v1/devices?limit=10&org_id=org1", "a")); w.Header().Get("X-Cache") != cacheHit {
+		t.Errorf("expected reordered query to hit the cache, got %q", w.Header().Get("X-Cache"))
+	}
+	if w := serve(newCacheTestRequest(http.MethodGet, devices, "b")); w.Header().Get("X-Cache") != cacheMiss {
+		t.Errorf("expected another session not to share the cached response, got %q", w.Header().Get("X-Cache"))
+	}
+
+	r := newCacheTestRequest(http.MethodGet, devices, "a")
+	r.Header.Set("If-None-Match", `"v1"`)
+	if w := serve(r); w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching client ETag, got %d", w.Code)
+	}
+
+	now = now.Add(6 * time.Second)
+	if w := serve(newCacheTestRequest(http.MethodGet, devices, "a")); w.Header().Get("X-Cache") != cacheRevalidated || w.Body.String() != `{"items":[]}` {
+		t.Errorf("expected stale entry to be revalidated, got %q %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if revalidations.Load() != 1 {
+		t.Errorf("expected one revalidation, got %d", revalidations.Load())
+	}
+
+	serve(newCacheTestRequest(http.MethodDelete, "/api/flightctl/api/v1/devices/dev1?org_id=org1", "b"))
+	before := calls.Load()
+	if w := serve(newCacheTestRequest(http.MethodGet, devices, "a")); w.Header().Get("X-Cache") != cacheMiss || calls.Load() != before+1 {
+		t.Errorf("expected mutation to invalidate the cached list, got %q", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestResponseCacheCoalescesRequests(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		_, _ = w.Write([]byte("ok"))
+	})
+	cache := newResponseCache(upstream, 5*time.Second, 100)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			cache.ServeHTTP(w, newCacheTestRequest(http.MethodGet, "/api/flightctl/api/v1/fleets?org_id=org1", "a"))
+			if w.Body.String() != "ok" {
+				t.Errorf("unexpected body %q", w.Body.String())
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("expected identical requests to be coalesced into one upstream call, got %d", calls.Load())
+	}
+}
+
+func TestResponseCacheRetriesAbandonedRequests(t *testing.T) {
+	var calls atomic.Int32
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// The first request is cancelled while the upstream answers
+			<-r.Context().Done()
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	cache := newResponseCache(upstream, 5*time.Second, 100)
+	target := "/api/flightctl/api/v1/fleets?org_id=org1"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		cache.ServeHTTP(httptest.NewRecorder(), newCacheTestRequest(http.MethodGet, target, "a").WithContext(ctx))
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	followerDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, newCacheTestRequest(http.MethodGet, target, "a"))
+		followerDone <- w
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-leaderDone
+
+	if w := <-followerDone; w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("expected the waiting request to fetch the response again, got %d %q", w.Code, w.Body.String())
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected two upstream calls, got %d", calls.Load())
+	}
+}
+
+func TestResponseCacheStreamsLargeResponses(t *testing.T) {
+	var calls atomic.Int32
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Query().Get("follow") == "true" {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		chunk := make([]byte, maxCachedResponseSize/2)
+		for i := 0; i < 3; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+	cache := newResponseCache(upstream, 5*time.Second, 100)
+
+	for _, target := range []string{
+		"/api/flightctl/api/v1/devices/dev1/rendered?org_id=org1",
+		"/api/flightctl/api/v1/devices/dev1/logs?org_id=org1&follow=true",
+	} {
+		for i := 0; i < 2; i++ {
+			before := calls.Load()
+			w := httptest.NewRecorder()
+			cache.ServeHTTP(w, newCacheTestRequest(http.MethodGet, target, "a"))
+			if w.Body.Len() != 3*maxCachedResponseSize/2 || calls.Load() != before+1 {
+				t.Errorf("expected %s to be streamed from the upstream, got %d bytes", target, w.Body.Len())
+			}
+			if len(cache.entries) != 0 {
+				t.Errorf("expected %s not to be cached", target)
+			}
+		}
+	}
+}
+
+func TestResourceCollectionPath(t *testing.T) {
+	tests := map[string]string{
+		"/api/flightctl/api/v1/devices":                        "/api/flightctl/api/v1/devices",
+		"/api/flightctl/api/v1/devices/dev1":                   "/api/flightctl/api/v1/devices",
+		"/api/flightctl/api/v1/devices/dev1/decommission":      "/api/flightctl/api/v1/devices",
+		"/api/flightctl/api/v1/fleets/fleet1/templateversions": "/api/flightctl/api/v1/fleets",
+	}
+	for path, expected := range tests {
+		if got := resourceCollectionPath(path); got != expected {
+			t.Errorf("resourceCollectionPath(%q) = %q, expected %q", path, got, expected)
+		}
+	}
+}
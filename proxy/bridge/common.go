@@ -12,18 +12,27 @@ import (
 )
 
 func GetTlsConfig() (*tls.Config, error) {
+	return GetInstanceTlsConfig(config.DefaultInstance())
+}
+
+// GetInstanceTlsConfig returns the TLS configuration used to reach the upstreams of a Flight Control instance
+func GetInstanceTlsConfig(instance config.Instance) (*tls.Config, error) {
 	tlsConfig := &tls.Config{}
 
-	if config.FctlApiInsecure == "true" {
-		log.Warn("Using InsecureSkipVerify for API communication")
+	if instance.InsecureSkipVerify {
+		log.Warnf("Using InsecureSkipVerify for API communication with instance %s", instance.Name)
 		tlsConfig.InsecureSkipVerify = true
 	}
 
-	_, err := os.Stat("../certs/ca.crt")
+	if instance.CACertFile == "" {
+		return tlsConfig, nil
+	}
+	// The CA of the FLIGHTCTL_* variables is optional, those of the instances file are checked when loaded
+	_, err := os.Stat(instance.CACertFile)
 	if errors.Is(err, os.ErrNotExist) {
 		return tlsConfig, nil
 	}
-	caCert, err := os.ReadFile("../certs/ca.crt")
+	caCert, err := os.ReadFile(instance.CACertFile)
 	if err != nil {
 		return nil, err
 	}
@@ -4,31 +4,57 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/flightctl/flightctl-ui/common"
 	"github.com/flightctl/flightctl-ui/config"
 	"github.com/flightctl/flightctl-ui/log"
+	"github.com/flightctl/flightctl-ui/tracing"
 )
 
 type handler struct {
-	target *url.URL
-	proxy  *httputil.ReverseProxy
+	upstream string
+	target   *url.URL
+	proxy    *httputil.ReverseProxy
+	policy   *apiPolicy
 }
 
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	forward := mux.Vars(r)["forward"]
+	if !h.policy.enforce(w, r, forward) {
+		return
+	}
+
+	ctx, span := tracing.Start(r.Context(), "proxy "+h.upstream, trace.SpanKindClient,
+		semconv.HTTPRequestMethodKey.String(r.Method),
+		semconv.ServerAddress(h.target.Hostname()),
+	)
+	r = r.WithContext(ctx)
+	// The upstream continues the trace of the proxy hop
+	tracing.Inject(ctx, r.Header)
+
 	r.URL.Host = h.target.Host
 	r.URL.Scheme = h.target.Scheme
 	r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
 	r.Host = h.target.Host
-	r.URL.Path = mux.Vars(r)["forward"]
-	h.proxy.ServeHTTP(w, r)
+	r.URL.Path = forward
+	span.SetAttributes(semconv.URLPath(r.URL.Path))
+
+	recorder := common.NewStatusRecorder(w)
+	h.proxy.ServeHTTP(recorder, r)
+	tracing.EndWithStatus(span, recorder.Status(), nil)
 }
 
 func createReverseProxy(apiURL string) (*url.URL, *httputil.ReverseProxy) {
@@ -68,6 +94,12 @@ func createAlertsReverseProxy(apiURL string) (*url.URL, *httputil.ReverseProxy)
 		os.Exit(1)
 	}
 	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		// Responses are filtered by organization, which requires them to be uncompressed
+		r.Header.Del("Accept-Encoding")
+	}
 	proxy.ModifyResponse = func(r *http.Response) error {
 		filterHeaders := []string{
 			"Access-Control-Allow-Headers",
@@ -79,6 +111,13 @@ func createAlertsReverseProxy(apiURL string) (*url.URL, *httputil.ReverseProxy)
 			r.Header.Del(h)
 		}
 
+		if err := filterAlertsByOrg(r); err != nil {
+			return err
+		}
+		if err := filterSilencesByOrg(r); err != nil {
+			return err
+		}
+
 		// For alerts API, we may sometimes receive 401 instead of 403.
 		// To prevent login out the user, we convert 401 to 501.
 		if r.StatusCode == http.StatusUnauthorized {
@@ -92,34 +131,323 @@ func createAlertsReverseProxy(apiURL string) (*url.URL, *httputil.ReverseProxy)
 	return target, proxy
 }
 
-func NewFlightCtlHandler(tlsConfig *tls.Config) handler {
-	target, proxy := createReverseProxy(config.FctlApiUrl)
+// requestOrgID returns the organization the AlertManager query was scoped to by OrganizationMiddleware
+func requestOrgID(r *http.Request) string {
+	for _, filter := range r.URL.Query()["filter"] {
+		if matcher, err := common.ParseAlertMatcher(filter); err == nil && matcher.Name == common.OrgIDLabel && matcher.Operator == "=" {
+			return matcher.Value
+		}
+	}
+	return ""
+}
 
-	proxy.Transport = &http.Transport{
-		TLSClientConfig: tlsConfig,
+// alertLabels decodes the labels of an alert
+func alertLabels(alert json.RawMessage) map[string]string {
+	var decoded struct {
+		Labels map[string]string `json:"labels"`
 	}
+	_ = json.Unmarshal(alert, &decoded)
+	return decoded.Labels
+}
 
-	return handler{target: target, proxy: proxy}
+// filterOrgAlerts keeps the alerts labelled with the organization
+func filterOrgAlerts(alerts []json.RawMessage, orgID string) []json.RawMessage {
+	filtered := make([]json.RawMessage, 0, len(alerts))
+	for _, alert := range alerts {
+		if orgID != "" && alertLabels(alert)[common.OrgIDLabel] == orgID {
+			filtered = append(filtered, alert)
+		}
+	}
+	return filtered
 }
 
-func NewFlightCtlCliArtifactsHandler(tlsConfig *tls.Config) handler {
-	target, proxy := createReverseProxy(config.FctlCliArtifactsUrl)
+// filterAlertsByOrg removes the alerts of other organizations from alert and alert group listings.
+// AlertManager already applies the organization filter, this guards against alerts it let through.
+func filterAlertsByOrg(resp *http.Response) error {
+	req := resp.Request
+	isAlerts := strings.HasSuffix(req.URL.Path, "/api/v2/alerts")
+	isGroups := strings.HasSuffix(req.URL.Path, "/api/v2/alerts/groups")
+	if req.Method != http.MethodGet || resp.StatusCode != http.StatusOK || (!isAlerts && !isGroups) {
+		return nil
+	}
+	orgID := requestOrgID(req)
 
-	proxy.Transport = &http.Transport{
-		TLSClientConfig: tlsConfig,
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	var filtered []byte
+	if isAlerts {
+		var alerts []json.RawMessage
+		if err := json.Unmarshal(body, &alerts); err != nil {
+			return fmt.Errorf("invalid alerts response: %w", err)
+		}
+		filtered, err = json.Marshal(filterOrgAlerts(alerts, orgID))
+	} else {
+		var groups []map[string]json.RawMessage
+		if err := json.Unmarshal(body, &groups); err != nil {
+			return fmt.Errorf("invalid alert groups response: %w", err)
+		}
+		orgGroups := make([]map[string]json.RawMessage, 0, len(groups))
+		for _, group := range groups {
+			var alerts []json.RawMessage
+			_ = json.Unmarshal(group["alerts"], &alerts)
+			alerts = filterOrgAlerts(alerts, orgID)
+			if len(alerts) == 0 {
+				continue
+			}
+			group["alerts"], _ = json.Marshal(alerts)
+			orgGroups = append(orgGroups, group)
+		}
+		filtered, err = json.Marshal(orgGroups)
+	}
+	if err != nil {
+		return err
 	}
 
-	return handler{target: target, proxy: proxy}
+	resp.Body = io.NopCloser(bytes.NewReader(filtered))
+	resp.ContentLength = int64(len(filtered))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(filtered)))
+	return nil
 }
 
-func NewAlertManagerHandler(tlsConfig *tls.Config) handler {
-	target, proxy := createAlertsReverseProxy(config.AlertManagerApiUrl)
+// silenceMatcher is a matcher of an AlertManager silence. IsEqual defaults to true when omitted.
+type silenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual *bool  `json:"isEqual,omitempty"`
+}
+
+func (m silenceMatcher) isOrgMatcher(orgID string) bool {
+	return m.Name == common.OrgIDLabel && m.Value == orgID && !m.IsRegex && (m.IsEqual == nil || *m.IsEqual)
+}
 
-	proxy.Transport = &http.Transport{
-		TLSClientConfig: tlsConfig,
+// silenceBelongsToOrg reports whether the silence only applies to alerts of the organization
+func silenceBelongsToOrg(matchers []silenceMatcher, orgID string) bool {
+	for _, matcher := range matchers {
+		if orgID != "" && matcher.isOrgMatcher(orgID) {
+			return true
+		}
 	}
+	return false
+}
 
-	return handler{target: target, proxy: proxy}
+// filterSilencesByOrg removes from silence listings the silences that are not restricted to the organization
+func filterSilencesByOrg(resp *http.Response) error {
+	req := resp.Request
+	if req.Method != http.MethodGet || resp.StatusCode != http.StatusOK || !strings.HasSuffix(req.URL.Path, "/api/v2/silences") {
+		return nil
+	}
+	orgID := requestOrgID(req)
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	var silences []json.RawMessage
+	if err := json.Unmarshal(body, &silences); err != nil {
+		return fmt.Errorf("invalid silences response: %w", err)
+	}
+	orgSilences := make([]json.RawMessage, 0, len(silences))
+	for _, silence := range silences {
+		var decoded struct {
+			Matchers []silenceMatcher `json:"matchers"`
+		}
+		if json.Unmarshal(silence, &decoded) == nil && silenceBelongsToOrg(decoded.Matchers, orgID) {
+			orgSilences = append(orgSilences, silence)
+		}
+	}
+	filtered, err := json.Marshal(orgSilences)
+	if err != nil {
+		return err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(filtered))
+	resp.ContentLength = int64(len(filtered))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(filtered)))
+	return nil
+}
+
+// silenceGuard keeps the silences managed through the proxy scoped to the selected organization.
+// New silences get an org_id equality matcher, and existing silences can only be read, updated
+// or expired when they carry that matcher. Listings are filtered by filterSilencesByOrg. The silence
+// endpoints of the other API versions cannot be scoped, so they are rejected.
+type silenceGuard struct {
+	next   http.Handler
+	target *url.URL
+	client *http.Client
+}
+
+func writeSilenceError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message, "code": "SILENCE_NOT_ALLOWED"})
+}
+
+func (g *silenceGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	forward := path.Clean("/" + mux.Vars(r)["forward"])
+	orgID := requestOrgID(r)
+
+	switch {
+	case isSilencePath(forward) && !strings.HasPrefix(forward, "/api/v2/"):
+		writeSilenceError(w, http.StatusForbidden, "Silences can only be managed through the v2 API")
+		return
+	case forward == "/api/v2/silences" && r.Method == http.MethodPost:
+		if !g.scopeNewSilence(w, r, orgID) {
+			return
+		}
+	case strings.HasPrefix(forward, "/api/v2/silence/"):
+		silenceID := strings.TrimPrefix(forward, "/api/v2/silence/")
+		if !g.checkSilence(w, r, silenceID, orgID) {
+			return
+		}
+	}
+	g.next.ServeHTTP(w, r)
+}
+
+// isSilencePath reports whether the AlertManager path is a silence endpoint, such as /api/v1/silences
+// or /api/v1/silence/{id}
+func isSilencePath(forward string) bool {
+	for _, segment := range strings.Split(forward, "/") {
+		if segment == "silence" || segment == "silences" {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeNewSilence adds the organization matcher to a silence being created, or makes sure that
+// the silence being updated belongs to the organization
+func (g *silenceGuard) scopeNewSilence(w http.ResponseWriter, r *http.Request, orgID string) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		handleUpstreamError(w, r, err)
+		return false
+	}
+	var silence map[string]json.RawMessage
+	var matchers []silenceMatcher
+	if err := json.Unmarshal(body, &silence); err != nil || json.Unmarshal(silence["matchers"], &matchers) != nil {
+		writeSilenceError(w, http.StatusBadRequest, "Invalid silence")
+		return false
+	}
+
+	hasOrgMatcher := false
+	for _, matcher := range matchers {
+		if matcher.Name != common.OrgIDLabel {
+			continue
+		}
+		if !matcher.isOrgMatcher(orgID) {
+			writeSilenceError(w, http.StatusForbidden, "Silences can only match alerts of the current organization")
+			return false
+		}
+		hasOrgMatcher = true
+	}
+	if !hasOrgMatcher {
+		isEqual := true
+		matchers = append(matchers, silenceMatcher{Name: common.OrgIDLabel, Value: orgID, IsEqual: &isEqual})
+	}
+
+	// Posting a silence with an ID replaces the existing silence
+	var silenceID string
+	if rawID, ok := silence["id"]; ok && json.Unmarshal(rawID, &silenceID) == nil && silenceID != "" {
+		if !g.checkSilence(w, r, silenceID, orgID) {
+			return false
+		}
+	}
+
+	silence["matchers"], _ = json.Marshal(matchers)
+	body, err = json.Marshal(silence)
+	if err != nil {
+		writeSilenceError(w, http.StatusBadRequest, "Invalid silence")
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return true
+}
+
+// checkSilence fetches an existing silence and replies with a 404 when it does not belong to the organization
+func (g *silenceGuard) checkSilence(w http.ResponseWriter, r *http.Request, silenceID, orgID string) bool {
+	if !common.IsSafeResourceName(silenceID) {
+		writeSilenceError(w, http.StatusBadRequest, "Invalid silence ID")
+		return false
+	}
+	silenceURL := *g.target
+	silenceURL.Path = path.Join("/", g.target.Path, "api/v2/silence", silenceID)
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, silenceURL.String(), nil)
+	if err != nil {
+		handleUpstreamError(w, r, err)
+		return false
+	}
+	req.Header.Set(common.AuthHeaderKey, r.Header.Get(common.AuthHeaderKey))
+	req.Header.Set(common.RequestIDHeader, r.Header.Get(common.RequestIDHeader))
+	resp, err := tracing.Do(g.client, req, "getSilence")
+	if err != nil {
+		handleUpstreamError(w, r, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		writeSilenceError(w, http.StatusNotFound, "Silence not found")
+		return false
+	case http.StatusUnauthorized:
+		// Same as the alerts API responses, a 401 means that alerts are disabled for the user
+		w.WriteHeader(http.StatusNotImplemented)
+		return false
+	default:
+		upstreamErrorLogger(r).Warnf("Failed to fetch silence %s: status %d", silenceID, resp.StatusCode)
+		w.WriteHeader(http.StatusBadGateway)
+		return false
+	}
+
+	var silence struct {
+		Matchers []silenceMatcher `json:"matchers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&silence); err != nil || !silenceBelongsToOrg(silence.Matchers, orgID) {
+		// Silences of other organizations are reported as missing, so that their IDs cannot be probed
+		writeSilenceError(w, http.StatusNotFound, "Silence not found")
+		return false
+	}
+	return true
+}
+
+func NewFlightCtlHandler(instance config.Instance, tlsConfig *tls.Config) handler {
+	target, proxy := createReverseProxy(instance.ApiUrl)
+
+	proxy.Transport = newUpstreamTransport(instance, upstreamFlightCtl, tlsConfig)
+	proxy.ErrorHandler = handleUpstreamError
+
+	return handler{upstream: upstreamFlightCtl, target: target, proxy: proxy, policy: newApiPolicy(upstreamFlightCtl)}
+}
+
+func NewFlightCtlCliArtifactsHandler(instance config.Instance, tlsConfig *tls.Config) handler {
+	target, proxy := createReverseProxy(instance.CliArtifactsUrl)
+
+	proxy.Transport = newUpstreamTransport(instance, upstreamCliArtifacts, tlsConfig)
+	proxy.ErrorHandler = handleUpstreamError
+
+	return handler{upstream: upstreamCliArtifacts, target: target, proxy: proxy, policy: newApiPolicy(upstreamCliArtifacts)}
+}
+
+func NewAlertManagerHandler(instance config.Instance, tlsConfig *tls.Config) http.Handler {
+	target, proxy := createAlertsReverseProxy(instance.AlertManagerUrl)
+
+	proxy.Transport = newUpstreamTransport(instance, upstreamAlertManager, tlsConfig)
+	proxy.ErrorHandler = handleUpstreamError
+
+	return &silenceGuard{
+		next:   handler{upstream: upstreamAlertManager, target: target, proxy: proxy, policy: newApiPolicy(upstreamAlertManager)},
+		target: target,
+		client: &http.Client{Transport: proxy.Transport},
+	}
 }
 
 // To be able to trigger the download in the browser, the UI must be able to obtain the "Location" header for a redirect.
@@ -159,15 +487,13 @@ func (t *imagebuilderDownloadRewriteTransport) RoundTrip(req *http.Request) (*ht
 	return resp, nil
 }
 
-func NewImageBuilderHandler(tlsConfig *tls.Config) handler {
-	target, proxy := createReverseProxy(config.FctlImageBuilderApiUrl)
+func NewImageBuilderHandler(instance config.Instance, tlsConfig *tls.Config) handler {
+	target, proxy := createReverseProxy(instance.ImageBuilderUrl)
 
-	baseTransport := &http.Transport{
-		TLSClientConfig: tlsConfig,
-	}
-	proxy.Transport = &imagebuilderDownloadRewriteTransport{base: baseTransport}
+	proxy.Transport = &imagebuilderDownloadRewriteTransport{base: newUpstreamTransport(instance, upstreamImageBuilder, tlsConfig)}
+	proxy.ErrorHandler = handleUpstreamError
 
-	return handler{target: target, proxy: proxy}
+	return handler{upstream: upstreamImageBuilder, target: target, proxy: proxy, policy: newApiPolicy(upstreamImageBuilder)}
 }
 
 func UnimplementedHandler(w http.ResponseWriter, r *http.Request) {
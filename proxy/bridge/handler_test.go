@@ -0,0 +1,141 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAlertsReverseProxyFiltersOtherOrganizations(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v2/alerts":
+			_, _ = w.Write([]byte(`[
+				{"fingerprint": "a", "labels": {"org_id": "org1", "severity": "critical"}},
+				{"fingerprint": "b", "labels": {"org_id": "org2"}},
+				{"fingerprint": "c", "labels": {}}
+			]`))
+		case "/api/v2/alerts/groups":
+			_, _ = w.Write([]byte(`[
+				{"labels": {"alertname": "x"}, "alerts": [{"fingerprint": "a", "labels": {"org_id": "org1"}}, {"fingerprint": "b", "labels": {"org_id": "org2"}}]},
+				{"labels": {"alertname": "y"}, "alerts": [{"fingerprint": "d", "labels": {"org_id": "org2"}}]}
+			]`))
+		}
+	}))
+	defer upstream.Close()
+	_, proxy := createAlertsReverseProxy(upstream.URL)
+
+	get := func(path string) []map[string]json.RawMessage {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"?filter=severity%3Dcritical&filter=org_id%3Dorg1", nil))
+		var items []map[string]json.RawMessage
+		if err := json.Unmarshal(rec.Body.Bytes(), &items); err != nil {
+			t.Fatalf("invalid response for %s: %v", path, err)
+		}
+		return items
+	}
+
+	alerts := get("/api/v2/alerts")
+	if len(alerts) != 1 || string(alerts[0]["fingerprint"]) != `"a"` {
+		t.Errorf("expected only the alert of org1, got %v", alerts)
+	}
+	groups := get("/api/v2/alerts/groups")
+	if len(groups) != 1 {
+		t.Fatalf("expected only the group with alerts of org1, got %d groups", len(groups))
+	}
+	var groupAlerts []json.RawMessage
+	_ = json.Unmarshal(groups[0]["alerts"], &groupAlerts)
+	if len(groupAlerts) != 1 {
+		t.Errorf("expected the alerts of other organizations to be removed from the group, got %d", len(groupAlerts))
+	}
+}
+
+func TestSilenceGuardScopesSilencesToOrganization(t *testing.T) {
+	var posted []silenceMatcher
+	var deleted []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v2/silences":
+			var silence struct {
+				Matchers []silenceMatcher `json:"matchers"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&silence)
+			posted = silence.Matchers
+			_, _ = w.Write([]byte(`{"silenceID": "new"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v2/silences":
+			_, _ = w.Write([]byte(`[
+				{"id": "s1", "matchers": [{"name": "org_id", "value": "org1", "isRegex": false, "isEqual": true}]},
+				{"id": "s2", "matchers": [{"name": "org_id", "value": "org.*", "isRegex": true}]},
+				{"id": "s3", "matchers": [{"name": "alertname", "value": "x", "isRegex": false}]}
+			]`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v2/silence/s1":
+			_, _ = w.Write([]byte(`{"id": "s1", "matchers": [{"name": "org_id", "value": "org1", "isRegex": false}]}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v2/silence/s2":
+			_, _ = w.Write([]byte(`{"id": "s2", "matchers": [{"name": "org_id", "value": "org2", "isRegex": false}]}`))
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+	target, proxy := createAlertsReverseProxy(upstream.URL)
+	guard := &silenceGuard{
+		next:   handler{upstream: upstreamAlertManager, target: target, proxy: proxy, policy: &apiPolicy{defaultAllow: true}},
+		target: target,
+		client: upstream.Client(),
+	}
+
+	serve := func(method, forward, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/alerts/"+forward+"?filter=org_id%3Dorg1", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"forward": forward})
+		rec := httptest.NewRecorder()
+		guard.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(http.MethodPost, "api/v2/silences", `{"matchers": [{"name": "alertname", "value": "x", "isRegex": false}], "comment": "c"}`)
+	if rec.Code != http.StatusOK || len(posted) != 2 || !posted[1].isOrgMatcher("org1") {
+		t.Errorf("expected the organization matcher to be added, got %d %+v", rec.Code, posted)
+	}
+	rec = serve(http.MethodPost, "api/v2/silences", `{"matchers": [{"name": "org_id", "value": ".*", "isRegex": true}]}`)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected a silence matching other organizations to be rejected, got %d", rec.Code)
+	}
+	rec = serve(http.MethodPost, "api/v2/silences", `{"id": "s2", "matchers": [{"name": "alertname", "value": "x", "isRegex": false}]}`)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected the update of a silence of another organization to be rejected, got %d", rec.Code)
+	}
+
+	rec = serve(http.MethodGet, "api/v2/silences", "")
+	var silences []map[string]any
+	_ = json.Unmarshal(rec.Body.Bytes(), &silences)
+	if len(silences) != 1 || silences[0]["id"] != "s1" {
+		t.Errorf("expected only the silence of org1 to be listed, got %v", silences)
+	}
+
+	if rec = serve(http.MethodDelete, "api/v2/silence/s2", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the deletion of a silence of another organization to be rejected, got %d", rec.Code)
+	}
+	if rec = serve(http.MethodDelete, "api/v2/silence/s1", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected the deletion of a silence of the organization to succeed, got %d", rec.Code)
+	}
+	if len(deleted) != 1 || deleted[0] != "/api/v2/silence/s1" {
+		t.Errorf("unexpected deletions: %v", deleted)
+	}
+
+	// The v1 API cannot be scoped to the organization
+	for _, forward := range []string{"api/v1/silences", "api/v1/silence/s2", "api/v1/../v1/silences"} {
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+			if rec = serve(method, forward, `{"matchers": []}`); rec.Code != http.StatusForbidden {
+				t.Errorf("expected %s %s to be rejected, got %d", method, forward, rec.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/log"
+)
+
+const (
+	instanceHealthTimeout  = 5 * time.Second
+	instanceHealthCacheTTL = 15 * time.Second
+)
+
+// InstanceHandler dispatches requests to the handler of the Flight Control instance selected for them
+type InstanceHandler map[string]http.Handler
+
+func (h InstanceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	instance := common.InstanceFromContext(r.Context())
+	handler, ok := h[instance.Name]
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"error": fmt.Sprintf("Unknown Flight Control instance %q", instance.Name),
+			"code":  "INSTANCE_NOT_FOUND",
+		})
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// NewInstanceHandler creates a handler for every configured instance using its own TLS configuration
+func NewInstanceHandler(newHandler func(instance config.Instance, tlsConfig *tls.Config) http.Handler) (InstanceHandler, error) {
+	handlers := InstanceHandler{}
+	for _, instance := range config.Instances() {
+		tlsConfig, err := GetInstanceTlsConfig(instance)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the TLS configuration of instance %s: %w", instance.Name, err)
+		}
+		handlers[instance.Name] = newHandler(instance, tlsConfig)
+	}
+	return handlers, nil
+}
+
+type InstanceHealth struct {
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+type InstanceInfo struct {
+	Name         string         `json:"name"`
+	DisplayName  string         `json:"displayName"`
+	Default      bool           `json:"default"`
+	ImageBuilder bool           `json:"imageBuilder"`
+	AlertManager bool           `json:"alertManager"`
+	CliArtifacts bool           `json:"cliArtifacts"`
+	Health       InstanceHealth `json:"health"`
+}
+
+// Instance health statuses
+const (
+	instanceHealthy     = "healthy"
+	instanceUnhealthy   = "unhealthy"
+	instanceUnreachable = "unreachable"
+)
+
+// InstancesHandler lists the Flight Control instances served by the UI and the health of their API
+type InstancesHandler struct {
+	clients map[string]*http.Client
+	// authStatus returns the error preventing the auth config of an instance from being fetched
+	authStatus func(ctx context.Context, instance string) error
+
+	mu     sync.Mutex
+	health map[string]InstanceHealth
+}
+
+func NewInstancesHandler(authStatus func(ctx context.Context, instance string) error) (*InstancesHandler, error) {
+	clients := map[string]*http.Client{}
+	for _, instance := range config.Instances() {
+		tlsConfig, err := GetInstanceTlsConfig(instance)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the TLS configuration of instance %s: %w", instance.Name, err)
+		}
+		clients[instance.Name] = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   instanceHealthTimeout,
+		}
+	}
+	return &InstancesHandler{clients: clients, authStatus: authStatus, health: map[string]InstanceHealth{}}, nil
+}
+
+// checkHealth probes the readiness endpoint of the instance API, reusing a recent result when available
+func (h *InstancesHandler) checkHealth(ctx context.Context, instance config.Instance) InstanceHealth {
+	h.mu.Lock()
+	cached, ok := h.health[instance.Name]
+	h.mu.Unlock()
+	if ok && time.Since(cached.CheckedAt) < instanceHealthCacheTTL {
+		return cached
+	}
+
+	health := InstanceHealth{Status: instanceHealthy, CheckedAt: time.Now()}
+	readyURL, err := common.BuildFctlApiUrl(instance, "readyz")
+	if err != nil {
+		health.Status, health.Message = instanceUnreachable, err.Error()
+	} else if req, err := http.NewRequestWithContext(ctx, http.MethodGet, readyURL, nil); err != nil {
+		health.Status, health.Message = instanceUnreachable, err.Error()
+	} else if resp, err := h.clients[instance.Name].Do(req); err != nil {
+		log.GetLogger().WithError(err).Debugf("Health check of instance %s failed", instance.Name)
+		health.Status, health.Message = instanceUnreachable, "The Flight Control API cannot be reached"
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			health.Status, health.Message = instanceUnhealthy, fmt.Sprintf("The Flight Control API is not ready (status %d)", resp.StatusCode)
+		}
+	}
+	if health.Status == instanceHealthy && h.authStatus != nil {
+		if err := h.authStatus(ctx, instance.Name); err != nil {
+			log.GetLogger().WithError(err).Debugf("Auth config of instance %s is unavailable", instance.Name)
+			health.Status, health.Message = instanceUnhealthy, "The authentication configuration cannot be fetched"
+		}
+	}
+
+	h.mu.Lock()
+	h.health[instance.Name] = health
+	h.mu.Unlock()
+	return health
+}
+
+func (h *InstancesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	instances := config.Instances()
+	infos := make([]InstanceInfo, len(instances))
+
+	var wg sync.WaitGroup
+	for i, instance := range instances {
+		infos[i] = InstanceInfo{
+			Name:         instance.Name,
+			DisplayName:  instance.DisplayName,
+			Default:      instance.IsDefault(),
+			ImageBuilder: instance.ImageBuilderUrl != "",
+			AlertManager: instance.AlertManagerUrl != "",
+			CliArtifacts: instance.CliArtifactsUrl != "",
+		}
+		wg.Add(1)
+		go func(i int, instance config.Instance) {
+			defer wg.Done()
+			infos[i].Health = h.checkHealth(r.Context(), instance)
+		}(i, instance)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(infos)
+}
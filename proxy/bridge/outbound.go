@@ -0,0 +1,338 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/log"
+)
+
+const (
+	outboundRequestTimeout  = 10 * time.Second
+	outboundDialTimeout     = 5 * time.Second
+	outboundMaxRedirects    = 5
+	outboundMaxResponseSize = 1 << 20 // 1 MiB is far more than any discovery document needs
+)
+
+// blockedNetworks lists the reserved ranges that are not covered by the net.IP helpers
+// (loopback, private, link-local, multicast, unspecified) but must never be reached
+// from a request whose destination is chosen by the user.
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // "this network"
+	"100.64.0.0/10",  // carrier-grade NAT, also hosts the Alibaba Cloud metadata service (100.100.100.200)
+	"169.254.0.0/16", // link-local, including the cloud metadata service (169.254.169.254)
+	"192.0.0.0/24",   // IETF protocol assignments, including the Oracle Cloud metadata service (192.0.0.192)
+	"198.18.0.0/15",  // network benchmarking
+	"240.0.0.0/4",    // reserved, including the limited broadcast address
+	"fc00::/7",       // IPv6 unique local addresses, including the AWS metadata service (fd00:ec2::254)
+	"64:ff9b:1::/48", // local-use IPv4/IPv6 translation
+	"2002::/16",      // 6to4, which can embed any IPv4 address
+	"100::/64",       // IPv6 discard-only
+)
+
+// neverAllowedNetworks cannot be reached even when the destination is allowlisted through
+// OUTBOUND_ALLOWED_PRIVATE_CIDRS or OUTBOUND_ALLOWED_PRIVATE_HOSTS, since they expose cloud metadata services.
+var neverAllowedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"169.254.0.0/16",
+	"fe80::/10",
+	"100.100.100.200/32",
+	"192.0.0.192/32",
+	"fd00:ec2::254/128",
+)
+
+// nat64Network is the well-known NAT64 prefix. Addresses inside it embed an IPv4 address in the
+// last 4 bytes, which is checked against the blocked ranges.
+var nat64Network = mustParseCIDRs("64:ff9b::/96")[0]
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(fmt.Sprintf("invalid CIDR %q: %v", cidr, err))
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+// blockedDestinationError is returned when an outbound request would reach a private or reserved address
+type blockedDestinationError struct {
+	host string
+	ip   net.IP
+}
+
+func (e *blockedDestinationError) Error() string {
+	if e.ip == nil {
+		return "localhost URLs are not allowed"
+	}
+	if e.host == e.ip.String() {
+		return fmt.Sprintf("destination %s is a private or reserved address", e.ip)
+	}
+	return fmt.Sprintf("destination %q resolves to %s, which is a private or reserved address", e.host, e.ip)
+}
+
+// normalizeIP returns the IPv4 form of IPv4-mapped and NAT64 addresses so they are checked like plain IPv4
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	if nat64Network.Contains(ip) {
+		return net.IP(ip[12:16])
+	}
+	return ip
+}
+
+func inNetworks(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlockedIP checks if an IP address belongs to a private, local or otherwise reserved range
+func isBlockedIP(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	ip = normalizeIP(ip)
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	return inNetworks(ip, blockedNetworks)
+}
+
+// isAllowlistedPrivateDestination reports whether the blocked address ip may still be reached because
+// the admin allowlisted either the address or the host name it was resolved from.
+func isAllowlistedPrivateDestination(host string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	ip = normalizeIP(ip)
+	if ip.IsMulticast() || inNetworks(ip, neverAllowedNetworks) {
+		return false
+	}
+	// The proxy itself and the services of its pod listen on loopback, so it is only reachable
+	// when a loopback range is listed, never through a host name or a broader range
+	if ip.IsLoopback() {
+		return config.IsOutboundLoopbackIPAllowed(ip)
+	}
+	if config.IsOutboundPrivateIPAllowed(ip) {
+		return true
+	}
+	return net.ParseIP(host) == nil && config.IsOutboundPrivateHostAllowed(host)
+}
+
+type outboundSessionKey struct{}
+
+// outboundSession identifies the user on whose behalf outbound requests are made, and records the
+// allowlisted private destinations those requests reached.
+type outboundSession struct {
+	user                string
+	mu                  sync.Mutex
+	privateDestinations []string
+}
+
+// WithOutboundSession returns a copy of ctx that attributes the outbound requests made with it to user
+func WithOutboundSession(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, outboundSessionKey{}, &outboundSession{user: user})
+}
+
+func outboundSessionFromContext(ctx context.Context) *outboundSession {
+	session, _ := ctx.Value(outboundSessionKey{}).(*outboundSession)
+	return session
+}
+
+func (s *outboundSession) requestingUser() string {
+	if s == nil || s.user == "" {
+		return "unknown"
+	}
+	return s.user
+}
+
+func (s *outboundSession) recordPrivateDestination(destination string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.privateDestinations = append(s.privateDestinations, destination)
+}
+
+// takePrivateDestinations returns the private destinations recorded since the last call
+func (s *outboundSession) takePrivateDestinations() []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	destinations := s.privateDestinations
+	s.privateDestinations = nil
+	return destinations
+}
+
+// validateOutboundURL runs validateURLForSSRF and logs rejected private destinations with the requesting user
+func validateOutboundURL(ctx context.Context, rawURL string) error {
+	err := validateURLForSSRF(rawURL)
+	if isBlockedDestination(err) {
+		log.GetLogger().Warnf("Blocked outbound request by user %q to private destination: %v", outboundSessionFromContext(ctx).requestingUser(), err)
+	}
+	return err
+}
+
+// outboundDialer resolves the destination host itself, rejects the connection if any of the resolved
+// addresses is blocked, and then dials the checked addresses directly. Pinning the connection to the
+// addresses that were checked prevents DNS rebinding between validation and connection.
+type outboundDialer struct {
+	dialer   *net.Dialer
+	resolver *net.Resolver
+}
+
+func (d *outboundDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ipAddrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ipAddrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %q", host)
+	}
+
+	session := outboundSessionFromContext(ctx)
+	var privateIPs []string
+	for _, ipAddr := range ipAddrs {
+		if !isBlockedIP(ipAddr.IP) {
+			continue
+		}
+		if !isAllowlistedPrivateDestination(host, ipAddr.IP) {
+			err := &blockedDestinationError{host: host, ip: ipAddr.IP}
+			log.GetLogger().Warnf("Blocked outbound request by user %q to private destination: %v", session.requestingUser(), err)
+			return nil, err
+		}
+		privateIPs = append(privateIPs, ipAddr.IP.String())
+	}
+	if len(privateIPs) > 0 {
+		destination := host
+		if net.ParseIP(host) == nil {
+			destination = fmt.Sprintf("%s (%s)", host, strings.Join(privateIPs, ", "))
+		}
+		log.GetLogger().Infof("Outbound request by user %q to allowlisted private destination %s", session.requestingUser(), destination)
+		session.recordPrivateDestination(destination)
+	}
+
+	var dialErr error
+	for _, ipAddr := range ipAddrs {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ipAddr.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		dialErr = err
+	}
+	return nil, dialErr
+}
+
+// errResponseTooLarge is returned when reading a response body that exceeds outboundMaxResponseSize
+var errResponseTooLarge = fmt.Errorf("response body exceeds the maximum size of %d bytes", outboundMaxResponseSize)
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Probe for one more byte to tell a body of exactly the limit apart from an oversized one
+		var probe [1]byte
+		n, err := b.ReadCloser.Read(probe[:])
+		if n > 0 {
+			return 0, errResponseTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// limitedResponseTransport caps the size of every response body read through it
+type limitedResponseTransport struct {
+	base    http.RoundTripper
+	maxSize int64
+}
+
+func (t *limitedResponseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+	if resp.ContentLength > t.maxSize {
+		_ = resp.Body.Close()
+		return nil, errResponseTooLarge
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: t.maxSize}
+	return resp, nil
+}
+
+// checkOutboundRedirect re-validates every redirect hop, since a public endpoint could otherwise
+// bounce the request to an internal one.
+func checkOutboundRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= outboundMaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", outboundMaxRedirects)
+	}
+	if err := validateOutboundURL(req.Context(), req.URL.String()); err != nil {
+		return fmt.Errorf("redirect to %q is not allowed: %w", req.URL.Redacted(), err)
+	}
+	return nil
+}
+
+// NewOutboundClient creates an HTTP client for requests whose destination is supplied by a user.
+// Every resolved address is checked at dial time, redirects are re-validated and capped, and
+// response bodies are limited in size.
+func NewOutboundClient(tlsConfig *tls.Config) *http.Client {
+	dialer := &outboundDialer{
+		dialer:   &net.Dialer{Timeout: outboundDialTimeout},
+		resolver: net.DefaultResolver,
+	}
+	transport := &http.Transport{
+		// Never route through an environment-configured proxy: the proxy would resolve the
+		// destination itself and bypass the address checks.
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   outboundDialTimeout,
+		ResponseHeaderTimeout: outboundRequestTimeout,
+		// Every request dials again so that each attempt is checked and logged
+		DisableKeepAlives: true,
+	}
+	return &http.Client{
+		Transport:     &limitedResponseTransport{base: transport, maxSize: outboundMaxResponseSize},
+		CheckRedirect: checkOutboundRedirect,
+		Timeout:       outboundRequestTimeout,
+	}
+}
+
+// isBlockedDestination reports whether an outbound request failed because of the SSRF checks
+func isBlockedDestination(err error) bool {
+	var blockedErr *blockedDestinationError
+	return errors.As(err, &blockedErr)
+}
@@ -0,0 +1,124 @@
+package bridge
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/flightctl/flightctl-ui/log"
+)
+
+func TestMain(m *testing.M) {
+	log.InitLogs()
+	os.Exit(m.Run())
+}
+
+func TestIsBlockedIP(t *testing.T) {
+	t.Parallel()
+
+	blocked := []string{
+		"127.0.0.1",
+		"10.20.0.15",
+		"172.16.0.1",
+		"192.168.1.1",
+		"169.254.169.254",
+		"100.64.0.1",
+		"100.100.100.200",
+		"0.0.0.0",
+		"255.255.255.255",
+		"::1",
+		"::",
+		"fe80::1",
+		"fd00:ec2::254",
+		"fc00::1",
+		"::ffff:127.0.0.1",
+		"64:ff9b::a9fe:a9fe", // NAT64 form of 169.254.169.254
+	}
+	for _, addr := range blocked {
+		if !isBlockedIP(net.ParseIP(addr)) {
+			t.Errorf("expected %s to be blocked", addr)
+		}
+	}
+
+	allowed := []string{
+		"8.8.8.8",
+		"1.1.1.1",
+		"2606:4700:4700::1111",
+		"64:ff9b::808:808", // NAT64 form of 8.8.8.8
+	}
+	for _, addr := range allowed {
+		if isBlockedIP(net.ParseIP(addr)) {
+			t.Errorf("expected %s to be allowed", addr)
+		}
+	}
+}
+
+func TestOutboundDialerRejectsHostnamesResolvingToBlockedAddresses(t *testing.T) {
+	t.Parallel()
+
+	dialer := &outboundDialer{dialer: &net.Dialer{}, resolver: net.DefaultResolver}
+	_, err := dialer.DialContext(context.Background(), "tcp", "localhost:80")
+	if err == nil {
+		t.Fatal("expected dialing a hostname that resolves to loopback to fail")
+	}
+	if !isBlockedDestination(err) {
+		t.Fatalf("expected a blocked destination error, got: %v", err)
+	}
+}
+
+func TestCheckOutboundRedirect(t *testing.T) {
+	t.Parallel()
+
+	via := []*http.Request{httptest.NewRequest(http.MethodGet, "https://idp.example.com/", nil)}
+
+	if err := checkOutboundRedirect(httptest.NewRequest(http.MethodGet, "https://idp.example.com/next", nil), via); err != nil {
+		t.Fatalf("expected redirect to a public host to be allowed, got: %v", err)
+	}
+	if err := checkOutboundRedirect(httptest.NewRequest(http.MethodGet, "http://169.254.169.254/latest/meta-data", nil), via); err == nil {
+		t.Fatal("expected redirect to the metadata service to be rejected")
+	}
+
+	for len(via) < outboundMaxRedirects {
+		via = append(via, via[0])
+	}
+	if err := checkOutboundRedirect(httptest.NewRequest(http.MethodGet, "https://idp.example.com/next", nil), via); err == nil {
+		t.Fatal("expected redirects past the limit to be rejected")
+	}
+}
+
+func TestLimitedResponseTransport(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Stream the body so no Content-Length is advertised
+		w.(http.Flusher).Flush()
+		w.Write([]byte(strings.Repeat("a", 32)))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &limitedResponseTransport{base: http.DefaultTransport, maxSize: 16}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadAll(resp.Body); err != errResponseTooLarge {
+		t.Fatalf("expected errResponseTooLarge, got: %v", err)
+	}
+
+	client = &http.Client{Transport: &limitedResponseTransport{base: http.DefaultTransport, maxSize: 32}}
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || len(body) != 32 {
+		t.Fatalf("expected a body of exactly the limit to be read, got %d bytes, err: %v", len(body), err)
+	}
+}
@@ -0,0 +1,150 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/metrics"
+)
+
+var policyDecisions = metrics.NewCounterVec(
+	"flightctl_ui_api_policy_decisions_total",
+	"API calls checked against the method and path policy of their upstream, by decision.",
+	"upstream", "decision",
+)
+
+// Policy decisions
+const (
+	policyAllowed  = "allowed"
+	policyDenied   = "denied"
+	policyReadOnly = "read_only"
+)
+
+// upstreamPolicyKeys maps the upstreams to their key in the policy file
+var upstreamPolicyKeys = map[string]string{
+	upstreamFlightCtl:    "flightctl",
+	upstreamImageBuilder: "imagebuilder",
+	upstreamAlertManager: "alerts",
+	upstreamCliArtifacts: "cli-artifacts",
+}
+
+// readOnlyExemptions are the paths of each upstream that accept mutating calls in read-only mode,
+// so that users can still authenticate
+var readOnlyExemptions = map[string][]string{
+	"flightctl": {"/api/v1/auth/**"},
+}
+
+// apiPolicy decides which calls are forwarded to an upstream
+type apiPolicy struct {
+	name            string
+	readOnly        bool
+	defaultAllow    bool
+	rules           []config.ApiPolicyRule
+	readOnlyExempts []string
+}
+
+func newApiPolicy(upstream string) *apiPolicy {
+	name := upstreamPolicyKeys[upstream]
+	upstreamPolicy := config.ApiPolicies[name]
+	return &apiPolicy{
+		name:            name,
+		readOnly:        config.ApiReadOnly,
+		defaultAllow:    upstreamPolicy.Default != config.PolicyDeny,
+		rules:           upstreamPolicy.Rules,
+		readOnlyExempts: readOnlyExemptions[name],
+	}
+}
+
+// matchPolicyPath reports whether the path matches the pattern, where "*" matches a single
+// segment and a trailing "/**" matches any number of segments, including none
+func matchPolicyPath(pattern, requestPath string) bool {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(requestPath, "/"), "/")
+	if patternSegments[len(patternSegments)-1] == "**" {
+		patternSegments = patternSegments[:len(patternSegments)-1]
+		if len(pathSegments) < len(patternSegments) {
+			return false
+		}
+		pathSegments = pathSegments[:len(patternSegments)]
+	}
+	if len(patternSegments) != len(pathSegments) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		if segment != "*" && segment != pathSegments[i] {
+			return false
+		}
+		if segment == "*" && pathSegments[i] == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func matchPolicyMethod(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if m == "*" || m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// decide returns the decision for a call to the upstream path
+func (p *apiPolicy) decide(method, requestPath string) string {
+	requestPath = path.Clean("/" + requestPath)
+	if p.readOnly && isMutatingRequest(method) {
+		exempt := false
+		for _, pattern := range p.readOnlyExempts {
+			exempt = exempt || matchPolicyPath(pattern, requestPath)
+		}
+		if !exempt {
+			return policyReadOnly
+		}
+	}
+	for _, rule := range p.rules {
+		if matchPolicyMethod(rule.Methods, method) && matchPolicyPath(rule.Path, requestPath) {
+			if rule.Action == config.PolicyAllow {
+				return policyAllowed
+			}
+			return policyDenied
+		}
+	}
+	if p.defaultAllow {
+		return policyAllowed
+	}
+	return policyDenied
+}
+
+// enforce replies with a 403 and returns false when the call must not reach the upstream
+func (p *apiPolicy) enforce(w http.ResponseWriter, r *http.Request, requestPath string) bool {
+	requestPath = path.Clean("/" + requestPath)
+	decision := p.decide(r.Method, requestPath)
+	policyDecisions.Inc(p.name, decision)
+	if decision == policyAllowed {
+		return true
+	}
+
+	body := map[string]string{
+		"error":    "The API call is not allowed by the proxy policy",
+		"code":     "FORBIDDEN_BY_POLICY",
+		"upstream": p.name,
+		"method":   r.Method,
+		"path":     requestPath,
+	}
+	if decision == policyReadOnly {
+		body["error"] = "The UI is in read-only mode"
+		body["code"] = "READ_ONLY_MODE"
+	}
+	upstreamErrorLogger(r).Infof("Rejected %s %s to upstream %s: %s", r.Method, requestPath, p.name, decision)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(body)
+	return false
+}
@@ -0,0 +1,94 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flightctl/flightctl-ui/config"
+)
+
+func TestMatchPolicyPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/api/v1/devices", "/api/v1/devices", true},
+		{"/api/v1/devices", "/api/v1/devices/dev1", false},
+		{"/api/v1/devices/*", "/api/v1/devices/dev1", true},
+		{"/api/v1/devices/*", "/api/v1/devices", false},
+		{"/api/v1/devices/*/console", "/api/v1/devices/dev1/console", true},
+		{"/api/v1/agent/**", "/api/v1/agent", true},
+		{"/api/v1/agent/**", "/api/v1/agent/devices/dev1/status", true},
+		{"/api/v1/agent/**", "/api/v1/agents", false},
+		{"/**", "/anything/at/all", true},
+	}
+	for _, tt := range tests {
+		if got := matchPolicyPath(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchPolicyPath(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestApiPolicyDecide(t *testing.T) {
+	policy := &apiPolicy{
+		name:         "flightctl",
+		defaultAllow: true,
+		rules: []config.ApiPolicyRule{
+			{Action: config.PolicyAllow, Methods: []string{"GET"}, Path: "/api/v1/internal/version"},
+			{Action: config.PolicyDeny, Path: "/api/v1/internal/**"},
+			{Action: config.PolicyDeny, Methods: []string{"DELETE"}, Path: "/api/v1/fleets/*"},
+		},
+		readOnlyExempts: readOnlyExemptions["flightctl"],
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		readOnly bool
+		want     string
+	}{
+		{http.MethodGet, "/api/v1/internal/version", false, policyAllowed},
+		{http.MethodGet, "/api/v1/internal/secrets", false, policyDenied},
+		{http.MethodGet, "/api/v1/devices/../internal/secrets", false, policyDenied},
+		{http.MethodDelete, "/api/v1/fleets/fleet1", false, policyDenied},
+		{http.MethodGet, "/api/v1/fleets/fleet1", false, policyAllowed},
+		{http.MethodPatch, "/api/v1/devices/dev1", true, policyReadOnly},
+		{http.MethodGet, "/api/v1/devices/dev1", true, policyAllowed},
+		{http.MethodPost, "/api/v1/auth/token", true, policyAllowed},
+	}
+	for _, tt := range tests {
+		policy.readOnly = tt.readOnly
+		if got := policy.decide(tt.method, tt.path); got != tt.want {
+			t.Errorf("decide(%s %s, readOnly=%v) = %s, want %s", tt.method, tt.path, tt.readOnly, got, tt.want)
+		}
+	}
+
+	policy.defaultAllow = false
+	policy.readOnly = false
+	if got := policy.decide(http.MethodGet, "/api/v1/devices"); got != policyDenied {
+		t.Errorf("expected calls matching no rule to be denied by default, got %s", got)
+	}
+}
+
+func TestApiPolicyEnforceRejectsWithStructuredError(t *testing.T) {
+	policy := &apiPolicy{name: "flightctl", readOnly: true, defaultAllow: true}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodDelete, "/api/flightctl/api/v1/devices/dev1", nil)
+	if policy.enforce(rec, req, "api/v1/devices/dev1") {
+		t.Fatal("expected the call to be rejected")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON body: %v", err)
+	}
+	if body["code"] != "READ_ONLY_MODE" || body["path"] != "/api/v1/devices/dev1" || body["method"] != http.MethodDelete {
+		t.Errorf("unexpected body: %v", body)
+	}
+}
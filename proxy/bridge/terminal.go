@@ -1,7 +1,10 @@
 package bridge
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/textproto"
@@ -12,10 +15,16 @@ import (
 	"sync"
 	"time"
 
+	"github.com/flightctl/flightctl-ui/audit"
 	"github.com/flightctl/flightctl-ui/common"
 	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/recording"
+	"github.com/flightctl/flightctl-ui/tracing"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -30,17 +39,46 @@ var (
 	}
 )
 
+// Channels of the console protocol, sent as the first byte of every message
+const (
+	terminalStdin  = 0
+	terminalStdout = 1
+	terminalStderr = 2
+	terminalError  = 3
+	terminalResize = 4
+)
+
+// terminalSize is the payload of the resize channel
+type terminalSize struct {
+	Width  int `json:"Width"`
+	Height int `json:"Height"`
+}
+
 type TerminalBridge struct {
 	TlsConfig *tls.Config
+	// ResumeGracePeriod keeps the device console open after the browser disconnects unexpectedly, so
+	// that the session can be resumed. Zero disables resuming.
+	ResumeGracePeriod time.Duration
 }
 
-func copyMsgs(writeMutex *sync.Mutex, dest, src *websocket.Conn) error {
+// messageWriter is the destination of copyMsgs: a websocket connection, or a terminal session
+// forwarding messages to the browser connected at the time
+type messageWriter interface {
+	WriteMessage(messageType int, data []byte) error
+}
+
+// copyMsgs forwards messages from src to dest. onMessage, when set, sees every message before it is forwarded.
+func copyMsgs(writeMutex *sync.Mutex, dest messageWriter, src *websocket.Conn, onMessage func(messageType int, msg []byte)) error {
 	for {
 		messageType, msg, err := src.ReadMessage()
 		if err != nil {
 			return err
 		}
 
+		if onMessage != nil {
+			onMessage(messageType, msg)
+		}
+
 		if writeMutex == nil {
 			err = dest.WriteMessage(messageType, msg)
 		} else {
@@ -55,9 +93,51 @@ func copyMsgs(writeMutex *sync.Mutex, dest, src *websocket.Conn) error {
 	}
 }
 
+// websocketSchemes maps the scheme of an upstream URL to the scheme used to open websockets on it
+var websocketSchemes = map[string]string{
+	"http":  "ws",
+	"https": "wss",
+	"ws":    "ws",
+	"wss":   "wss",
+}
+
+var (
+	errOrganizationRequired = errors.New("organization selection required")
+	errInvalidOrganization  = errors.New("invalid organization")
+)
+
+// validateQueryOrganization checks the organization selected by the org_id query parameter of a
+// WebSocket connection, which is required
+func validateQueryOrganization(query url.Values) error {
+	orgIDs := query["org_id"]
+	if len(orgIDs) == 0 || orgIDs[0] == "" {
+		return errOrganizationRequired
+	}
+	if len(orgIDs) > 1 || !common.IsSafeResourceName(orgIDs[0]) {
+		return errInvalidOrganization
+	}
+	return nil
+}
+
+// rejectOrganizationError reports an organization error with a close frame that the UI can
+// display, since the browser cannot read the response of a failed upgrade. It returns false for
+// other errors.
+func rejectOrganizationError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case errors.Is(err, errOrganizationRequired):
+		rejectWebsocket(w, r, websocket.ClosePolicyViolation, "Organization selection required")
+	case errors.Is(err, errInvalidOrganization):
+		rejectWebsocket(w, r, websocket.ClosePolicyViolation, "Invalid organization")
+	default:
+		return false
+	}
+	return true
+}
+
 // buildDeviceConsoleURL constructs a websocket URL for the device console endpoint.
 // It extracts and validates the deviceId from the request path, sanitizes the query string,
 // and safely builds the URL using Go's url package to prevent SSRF attacks.
+// The session is scoped to the organization in the org_id query parameter, which is required.
 func buildDeviceConsoleURL(r *http.Request) (string, error) {
 	deviceId, found := strings.CutPrefix(r.URL.Path, "/api/terminal/")
 	if !found || !common.IsSafeResourceName(deviceId) {
@@ -69,27 +149,41 @@ func buildDeviceConsoleURL(r *http.Request) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("invalid query string: %w", err)
 	}
-
-	// Parse the base API URL to safely construct the websocket URL
-	baseURL, err := url.Parse(config.FctlApiUrl)
+	parsedQuery, err := url.ParseQuery(sanitizedQuery)
 	if err != nil {
-		return "", fmt.Errorf("invalid base API URL: %w", err)
+		return "", fmt.Errorf("invalid sanitized query string: %w", err)
 	}
 
-	// Construct the websocket URL safely using url.URL to prevent SSRF
-	consoleURL := &url.URL{
-		Scheme: "wss",
-		Host:   baseURL.Host,
-		Path:   path.Join("/ws/v1/devices", deviceId, "console"),
+	if err := validateQueryOrganization(parsedQuery); err != nil {
+		return "", err
 	}
 
-	// Add query parameters if present
-	if sanitizedQuery != "" {
-		parsedQuery, err := url.ParseQuery(sanitizedQuery)
-		if err != nil {
-			return "", fmt.Errorf("invalid sanitized query string: %w", err)
-		}
-		consoleURL.RawQuery = parsedQuery.Encode()
+	return deviceConsoleURL(common.InstanceFromContext(r.Context()), deviceId, parsedQuery)
+}
+
+// deviceConsoleURL builds the websocket URL of the console of a device of the instance
+func deviceConsoleURL(instance config.Instance, deviceId string, query url.Values) (string, error) {
+	// The console is served by the API, unless the instance exposes it separately
+	base := instance.ApiUrl
+	if instance.ConsoleUrl != "" {
+		base = instance.ConsoleUrl
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid base console URL: %w", err)
+	}
+	scheme, ok := websocketSchemes[baseURL.Scheme]
+	if !ok {
+		return "", fmt.Errorf("unsupported base console URL scheme %q", baseURL.Scheme)
+	}
+
+	// Construct the websocket URL safely using url.URL to prevent SSRF. The base path is kept for
+	// deployments serving the API under a prefix.
+	consoleURL := &url.URL{
+		Scheme:   scheme,
+		Host:     baseURL.Host,
+		Path:     path.Join("/", baseURL.Path, "ws/v1/devices", deviceId, "console"),
+		RawQuery: query.Encode(),
 	}
 
 	return consoleURL.String(), nil
@@ -134,6 +228,91 @@ func checkOrigin(r *http.Request) bool {
 	return false
 }
 
+// terminalAuditEntry describes the terminal session opened by r for the audit log
+func terminalAuditEntry(r *http.Request, deviceId string) audit.Entry {
+	entry := audit.Entry{
+		Event:        audit.EventTerminalOpen,
+		RequestID:    r.Header.Get(common.RequestIDHeader),
+		Instance:     common.InstanceFromContext(r.Context()).Name,
+		Organization: r.URL.Query().Get("org_id"),
+		Path:         r.URL.Path,
+		Device:       deviceId,
+	}
+	if identity, ok := common.UserIdentityFromContext(r.Context()); ok {
+		entry.Username = identity.Username
+		entry.Provider = identity.Provider
+	}
+	if ip := config.ClientIP(r); ip != nil {
+		entry.ClientIP = ip.String()
+	}
+	return entry
+}
+
+// recordBackendMsg records the output of the device, sent on the stdout and stderr channels
+func recordBackendMsg(recorder *recording.Recorder) func(int, []byte) {
+	if recorder == nil {
+		return nil
+	}
+	return func(_ int, msg []byte) {
+		if len(msg) == 0 {
+			return
+		}
+		if msg[0] == terminalStdout || msg[0] == terminalStderr {
+			recorder.Output(msg[1:])
+		}
+	}
+}
+
+// recordFrontendMsg records the input typed by the user and the resizes of the browser terminal
+func recordFrontendMsg(recorder *recording.Recorder) func(int, []byte) {
+	if recorder == nil {
+		return nil
+	}
+	return func(_ int, msg []byte) {
+		if len(msg) == 0 {
+			return
+		}
+		switch msg[0] {
+		case terminalStdin:
+			recorder.Input(msg[1:])
+		case terminalResize:
+			var size terminalSize
+			if err := json.Unmarshal(msg[1:], &size); err == nil {
+				recorder.Resize(size.Width, size.Height)
+			}
+		}
+	}
+}
+
+// upstreamWebsocketHeaders returns the headers of r to send when dialing the upstream end of a
+// proxied WebSocket, without those of the handshake with the browser. The upstream continues the
+// trace of ctx.
+func upstreamWebsocketHeaders(ctx context.Context, r *http.Request) http.Header {
+	headers := http.Header{}
+	for key := range r.Header {
+		if !slices.Contains(websocketHeaders, textproto.CanonicalMIMEHeaderKey(key)) {
+			headers.Add(key, r.Header.Get(key))
+		}
+	}
+	tracing.Inject(ctx, headers)
+	return headers
+}
+
+// rejectWebsocket upgrades the client connection only to close it with the given code and reason
+func rejectWebsocket(w http.ResponseWriter, r *http.Request, closeCode int, closeReason string) {
+	upgrader := &websocket.Upgrader{
+		Subprotocols: websocket.Subprotocols(r),
+		CheckOrigin:  checkOrigin,
+	}
+	frontend, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warnf("Failed to upgrade websocket for error response: %v", err)
+		return
+	}
+	_ = frontend.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, closeReason), time.Now().Add(5*time.Second))
+	frontend.Close()
+}
+
 func (t TerminalBridge) HandleTerminal(w http.ResponseWriter, r *http.Request) {
 	isWebsocket := false
 	upgrades := r.Header["Upgrade"]
@@ -155,27 +334,55 @@ func (t TerminalBridge) HandleTerminal(w http.ResponseWriter, r *http.Request) {
 	consoleURL, err := buildDeviceConsoleURL(r)
 	if err != nil {
 		log.Warnf("Failed to build console URL: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
+		if !rejectOrganizationError(w, r, err) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
 		return
 	}
 
 	// Extract deviceId for logging purposes
 	deviceId, _ := strings.CutPrefix(r.URL.Path, "/api/terminal/")
+
+	// Resuming reattaches the browser to a session that is already open on the device
+	if token := r.URL.Query().Get("resume"); token != "" {
+		resumeTerminal(w, r, deviceId, token)
+		return
+	}
+
+	instanceName := common.InstanceFromContext(r.Context()).Name
+	userKey := ""
+	if identity, ok := common.UserIdentityFromContext(r.Context()); ok && identity.Username != "" {
+		userKey = instanceName + "/" + identity.Username
+	}
+	deviceKey := instanceName + "/" + r.URL.Query().Get("org_id") + "/" + deviceId
+	releaseSession, err := terminalLimits.acquire(userKey, deviceKey)
+	if err != nil {
+		var limitErr *terminalLimitError
+		errors.As(err, &limitErr)
+		log.Warnf("Rejected terminal session for device %s: %s", deviceId, limitErr.reason)
+		rejectWebsocket(w, r, limitErr.code, limitErr.reason)
+		return
+	}
+	defer releaseSession()
+	terminalSessionsGauge.Add(1, instanceName)
+	defer terminalSessionsGauge.Add(-1, instanceName)
+
 	log.Infof("Starting terminal session for device: %s", deviceId)
 
+	ctx, span := tracing.Start(r.Context(), "terminal session", trace.SpanKindClient,
+		attribute.String("flightctl.device", deviceId),
+	)
+	defer span.End()
+
 	dialer := &websocket.Dialer{
+		Proxy:           http.ProxyFromEnvironment,
 		TLSClientConfig: t.TlsConfig,
 	}
 
-	headers := http.Header{}
-	for key := range r.Header {
-		if !slices.Contains(websocketHeaders, textproto.CanonicalMIMEHeaderKey(key)) {
-			headers.Add(key, r.Header.Get(key))
-		}
-	}
-
-	backend, resp, err := dialer.Dial(consoleURL, headers)
+	backend, resp, err := dialer.DialContext(ctx, consoleURL, upstreamWebsocketHeaders(ctx, r))
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to dial the device console")
 		errMsg := fmt.Sprintf("Failed to dial backend: '%v'", err)
 		statusCode := http.StatusBadGateway
 		if resp == nil || resp.StatusCode == 0 {
@@ -192,19 +399,7 @@ func (t TerminalBridge) HandleTerminal(w http.ResponseWriter, r *http.Request) {
 
 		// On any backend error, upgrade the client to WebSocket to send a close frame
 		// The UI will receive a CloseEvent with a websocket code error and reason.
-		closeReason := fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode))
-		closeCode := websocket.CloseInternalServerErr
-		upgrader := &websocket.Upgrader{
-			Subprotocols: websocket.Subprotocols(r),
-			CheckOrigin:  checkOrigin,
-		}
-		frontend, upgErr := upgrader.Upgrade(w, r, nil)
-		if upgErr != nil {
-			log.Warnf("Failed to upgrade websocket for error response: %v", upgErr)
-			return
-		}
-		_ = frontend.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, closeReason), time.Now().Add(5*time.Second))
-		frontend.Close()
+		rejectWebsocket(w, r, websocket.CloseInternalServerErr, fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)))
 		return
 	}
 	defer backend.Close()
@@ -221,33 +416,189 @@ func (t TerminalBridge) HandleTerminal(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ticker := time.NewTicker(websocketPingInterval)
-	var writeMutex sync.Mutex // Needed because ticker & copy are writing to frontend in separate goroutines
+	var backendMutex sync.Mutex // Needed because a resumed browser connection can replace the previous one while it is still being read
+
+	// Pings keep the connection open, so the session lifetime is bounded by the user input
+	var idleTimer *terminalIdleTimer
+	var idleCheckTimer *time.Timer
+	var idleCheck <-chan time.Time
+	if config.TerminalIdleTimeout > 0 {
+		idleTimer = newTerminalIdleTimer(config.TerminalIdleTimeout, config.TerminalIdleWarning)
+		_, _, next := idleTimer.check(time.Now())
+		idleCheckTimer = time.NewTimer(next)
+		defer idleCheckTimer.Stop()
+		idleCheck = idleCheckTimer.C
+	}
+	var maxDuration <-chan time.Time
+	if config.TerminalMaxDuration > 0 {
+		maxDurationTimer := time.NewTimer(config.TerminalMaxDuration)
+		defer maxDurationTimer.Stop()
+		maxDuration = maxDurationTimer.C
+	}
+	// gracePeriod is set while the browser is disconnected and the session can be resumed
+	var gracePeriodTimer *time.Timer
+	var gracePeriod <-chan time.Time
+	defer func() {
+		if gracePeriodTimer != nil {
+			gracePeriodTimer.Stop()
+		}
+	}()
+
+	auditEntry := terminalAuditEntry(r, deviceId)
+	audit.Record(auditEntry)
+	start := time.Now()
+
+	session := newTerminalSession(TerminalSessionInfo{
+		ID:           recording.NewSessionID(),
+		Username:     auditEntry.Username,
+		Provider:     auditEntry.Provider,
+		Instance:     auditEntry.Instance,
+		Organization: auditEntry.Organization,
+		Device:       deviceId,
+		ClientIP:     auditEntry.ClientIP,
+		StartedAt:    start,
+	}, frontend)
+	session.resumeGracePeriod = t.ResumeGracePeriod
+	terminalSessions.add(session)
+	defer terminalSessions.remove(session)
+
+	recorder, err := recording.NewRecorder(recording.Metadata{
+		SessionID:    session.info.ID,
+		Username:     auditEntry.Username,
+		Provider:     auditEntry.Provider,
+		Instance:     auditEntry.Instance,
+		Organization: auditEntry.Organization,
+		Device:       deviceId,
+		ClientIP:     auditEntry.ClientIP,
+		StartedAt:    start,
+	})
+	if err != nil {
+		log.WithError(err).Errorf("Failed to start the recording of the terminal session for device: %s", deviceId)
+	}
+
+	// The input goes through the command policy of the organization, when it has one
+	var backendInput messageWriter = backend
+	if policy := newCommandPolicy(auditEntry.Organization); policy != nil {
+		backendInput = &commandFilter{
+			policy:  policy,
+			backend: backend,
+			notify: func(message string) {
+				_ = session.writeFrontend(websocket.BinaryMessage, append([]byte{terminalStdout}, message...))
+			},
+			entry: auditEntry,
+		}
+	}
 
+	sessionEnded := make(chan struct{})
 	defer func() {
 		log.Infof("Closing terminal session for device: %s", deviceId)
+		close(sessionEnded)
 		ticker.Stop()
-		frontend.Close()
+		session.closeFrontend(0, "")
+		recorder.Close()
+
+		auditEntry.Event = audit.EventTerminalClose
+		auditEntry.Timestamp = time.Time{}
+		auditEntry.DurationMs = time.Since(start).Milliseconds()
+		audit.Record(auditEntry)
 	}()
 
-	errc := make(chan error, 2)
+	recordInput := recordFrontendMsg(recorder)
+	onFrontendMsg := func(messageType int, msg []byte) {
+		session.received(len(msg))
+		if idleTimer != nil && len(msg) > 0 && msg[0] == terminalStdin {
+			idleTimer.touch()
+		}
+		if recordInput != nil {
+			recordInput(messageType, msg)
+		}
+	}
+	recordOutput := recordBackendMsg(recorder)
+	onBackendMsg := func(messageType int, msg []byte) {
+		session.sent(len(msg))
+		if recordOutput != nil {
+			recordOutput(messageType, msg)
+		}
+	}
 
 	// Can't just use io.Copy here since browsers care about frame headers.
-	go func() { errc <- copyMsgs(nil, frontend, backend) }()
-	go func() { errc <- copyMsgs(&writeMutex, backend, frontend) }()
+	// The device output goes through the session, which forwards it to the browser connected at the time.
+	backendErrc := make(chan error, 1)
+	go func() { backendErrc <- copyMsgs(nil, session, backend, onBackendMsg) }()
+
+	type frontendResult struct {
+		conn *websocket.Conn
+		err  error
+	}
+	frontendDone := make(chan frontendResult)
+	readFrontend := func(conn *websocket.Conn) {
+		err := copyMsgs(&backendMutex, backendInput, conn, onFrontendMsg)
+		select {
+		case frontendDone <- frontendResult{conn: conn, err: err}:
+		case <-sessionEnded:
+		}
+	}
+	go readFrontend(frontend)
+	session.sendResumeToken()
 
 	for {
 		select {
-		case <-errc:
+		case <-backendErrc:
 			// Only wait for a single error and let the defers close both connections.
 			return
+		case result := <-frontendDone:
+			if !session.isFrontend(result.conn) {
+				// The connection was replaced by a resumed one
+				continue
+			}
+			if !session.isResumableDisconnect(result.err) {
+				return
+			}
+			log.Infof("Browser disconnected from the terminal session for device %s, keeping it open for %s", deviceId, t.ResumeGracePeriod)
+			session.detach()
+			gracePeriodTimer = time.NewTimer(t.ResumeGracePeriod)
+			gracePeriod = gracePeriodTimer.C
+		case attachment := <-session.attach:
+			if gracePeriodTimer != nil {
+				gracePeriodTimer.Stop()
+				gracePeriod = nil
+			}
+			session.resume(attachment.conn, attachment.offset)
+			go readFrontend(attachment.conn)
+		case <-gracePeriod:
+			log.Infof("Terminal session for device %s was not resumed", deviceId)
+			closeTerminalSession(session, backend, 0, "")
+			return
 		case <-ticker.C:
-			writeMutex.Lock()
 			// Send pings to client to prevent load balancers and other middlemen from closing the connection early
-			err := frontend.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(websocketTimeout))
-			writeMutex.Unlock()
-			if err != nil {
+			session.pingFrontend()
+		case <-idleCheck:
+			warn, expired, next := idleTimer.check(time.Now())
+			if expired {
+				log.Infof("Terminal session for device %s is idle", deviceId)
+				closeTerminalSession(session, backend, closeIdleTimeout, fmt.Sprintf(terminalIdleReason, config.TerminalIdleTimeout))
 				return
 			}
+			if warn {
+				warning := append([]byte{terminalStdout}, fmt.Sprintf(terminalIdleWarningFmt, next.Round(time.Second))...)
+				_ = session.writeFrontend(websocket.BinaryMessage, warning)
+			}
+			idleCheckTimer.Reset(next)
+		case <-maxDuration:
+			log.Infof("Terminal session for device %s reached its maximum duration", deviceId)
+			closeTerminalSession(session, backend, closeMaxDurationReached, fmt.Sprintf(terminalMaxDurationReason, config.TerminalMaxDuration))
+			return
+		case admin := <-session.terminate:
+			log.Infof("Terminal session for device %s terminated by administrator %q", deviceId, admin)
+			closeTerminalSession(session, backend, closeTerminatedByAdmin, "Session terminated by an administrator")
+			return
 		}
 	}
 }
+
+// closeTerminalSession ends a session on behalf of the proxy: the browser, if connected, receives
+// the close code and reason to display, and the device console a normal closure
+func closeTerminalSession(session *terminalSession, backend *websocket.Conn, closeCode int, closeReason string) {
+	session.closeFrontend(closeCode, closeReason)
+	_ = backend.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(websocketTimeout))
+}
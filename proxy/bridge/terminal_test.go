@@ -0,0 +1,91 @@
+package bridge
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/gorilla/websocket"
+)
+
+func TestBuildDeviceConsoleURLOrganization(t *testing.T) {
+	t.Parallel()
+
+	instance := config.Instance{Name: "default", ApiUrl: "https://api.example.com:3443"}
+	tests := []struct {
+		query   string
+		want    string
+		wantErr error
+	}{
+		{"org_id=org1&metadata=%7B%7D", "wss://api.example.com:3443/ws/v1/devices/dev1/console?metadata=%7B%7D&org_id=org1", nil},
+		{"metadata=%7B%7D", "", errOrganizationRequired},
+		{"org_id=", "", errOrganizationRequired},
+		{"org_id=org1&org_id=org2", "", errInvalidOrganization},
+		{"org_id=..%2Fother", "", errInvalidOrganization},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/terminal/dev1?"+tt.query, nil)
+		req = req.WithContext(common.WithInstance(req.Context(), instance))
+		got, err := buildDeviceConsoleURL(req)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("query %q: expected error %v, got %v", tt.query, tt.wantErr, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("query %q: got %q, %v, want %q", tt.query, got, err, tt.want)
+		}
+	}
+}
+
+func TestBuildDeviceConsoleURLBase(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		instance config.Instance
+		want     string
+	}{
+		{config.Instance{ApiUrl: "https://api.example.com"}, "wss://api.example.com/ws/v1/devices/dev1/console?org_id=org1"},
+		{config.Instance{ApiUrl: "http://api.example.com:8080"}, "ws://api.example.com:8080/ws/v1/devices/dev1/console?org_id=org1"},
+		{config.Instance{ApiUrl: "https://gw.example.com/flightctl"}, "wss://gw.example.com/flightctl/ws/v1/devices/dev1/console?org_id=org1"},
+		{config.Instance{ApiUrl: "https://api.example.com", ConsoleUrl: "wss://console.example.com/edge"}, "wss://console.example.com/edge/ws/v1/devices/dev1/console?org_id=org1"},
+		{config.Instance{ApiUrl: "https://api.example.com", ConsoleUrl: "http://console.example.com"}, "ws://console.example.com/ws/v1/devices/dev1/console?org_id=org1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/terminal/dev1?org_id=org1", nil)
+		req = req.WithContext(common.WithInstance(req.Context(), tt.instance))
+		got, err := buildDeviceConsoleURL(req)
+		if err != nil || got != tt.want {
+			t.Errorf("instance %+v: got %q, %v, want %q", tt.instance, got, err, tt.want)
+		}
+	}
+}
+
+func TestHandleTerminalRejectsSessionWithoutOrganization(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(TerminalBridge{}.HandleTerminal))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/terminal/dev1?" + url.Values{"metadata": {"{}"}}.Encode()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("expected the connection to be upgraded before being closed: %v", err)
+	}
+	defer conn.Close()
+
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("expected a close frame, got %v", err)
+	}
+	if closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "Organization selection required" {
+		t.Errorf("unexpected close frame: %d %q", closeErr.Code, closeErr.Text)
+	}
+}
@@ -0,0 +1,563 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/audit"
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/recording"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// broadcastConsoleMetadata opens a shell with a terminal that does not use colors or cursor moves
+	broadcastConsoleMetadata = `{"tty":true,"term":"dumb"}`
+	// broadcastSettleDelay is how long the console must be quiet before the command is sent, when
+	// no prompt is recognized
+	broadcastSettleDelay = time.Second
+	// maxBroadcastOutputSize bounds the output returned for each device
+	maxBroadcastOutputSize = 64 * 1024
+	// maxBroadcastCommandSize bounds the command line
+	maxBroadcastCommandSize = 4096
+	// maxPromptSize is the end of the output in which the prompt is looked for
+	maxPromptSize = 1024
+	// defaultBroadcastPrompt matches the end of the usual shell prompts
+	defaultBroadcastPrompt = `[$#>%]\s*$`
+)
+
+// Statuses of the command on each device
+const (
+	broadcastCompleted  = "completed"
+	broadcastTimeout    = "timeout"
+	broadcastFailed     = "failed"
+	broadcastRejected   = "rejected"
+	broadcastTerminated = "terminated"
+)
+
+// broadcastEscapes matches the terminal escape sequences removed from the output
+var broadcastEscapes = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// TerminalBroadcastRequest runs Command in the console of the devices listed in Devices, or of the
+// devices matching LabelSelector
+type TerminalBroadcastRequest struct {
+	Command       string   `json:"command"`
+	Devices       []string `json:"devices,omitempty"`
+	LabelSelector string   `json:"labelSelector,omitempty"`
+	// TimeoutSeconds is the longest the command may run on each device, at most TERMINAL_BROADCAST_TIMEOUT
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+	// Prompt is a regular expression matching the end of the shell prompt, which tells when the
+	// command has completed
+	Prompt string `json:"prompt,omitempty"`
+	// Confirmed runs commands that the console policy asks to confirm
+	Confirmed bool `json:"confirmed,omitempty"`
+}
+
+// TerminalBroadcastResult is the outcome of the command on a device, streamed as a line of NDJSON
+type TerminalBroadcastResult struct {
+	Device     string `json:"device"`
+	Status     string `json:"status"`
+	Output     string `json:"output,omitempty"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	Error      string `json:"error,omitempty"`
+	SessionID  string `json:"sessionId,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// TerminalBroadcastHandler runs a command in the console of several devices at once. Every device
+// gets its own terminal session, which counts towards the session limits, is recorded, audited and
+// visible to administrators like the sessions opened from the browser.
+type TerminalBroadcastHandler struct {
+	instance    config.Instance
+	tlsConfig   *tls.Config
+	client      *http.Client
+	maxDevices  int
+	concurrency int
+	timeout     time.Duration
+}
+
+func NewTerminalBroadcastHandler(instance config.Instance, tlsConfig *tls.Config) *TerminalBroadcastHandler {
+	concurrency := max(config.TerminalBroadcastConcurrency, 1)
+	if config.TerminalMaxSessionsPerUser > 0 && concurrency > config.TerminalMaxSessionsPerUser {
+		// More sessions would be rejected by the limit of sessions per user
+		log.Warnf("TERMINAL_BROADCAST_CONCURRENCY is lowered to %d, the value of TERMINAL_MAX_SESSIONS_PER_USER", config.TerminalMaxSessionsPerUser)
+		concurrency = config.TerminalMaxSessionsPerUser
+	}
+	return &TerminalBroadcastHandler{
+		instance:  instance,
+		tlsConfig: tlsConfig,
+		client: &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+			Timeout:   websocketTimeout,
+		},
+		maxDevices:  config.TerminalBroadcastMaxDevices,
+		concurrency: concurrency,
+		timeout:     config.TerminalBroadcastTimeout,
+	}
+}
+
+func writeBroadcastError(w http.ResponseWriter, status int, message, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message, "code": code})
+}
+
+// validateBroadcastRequest checks the request, and returns the prompt matcher and the timeout of each device
+func (h *TerminalBroadcastHandler) validateBroadcastRequest(req *TerminalBroadcastRequest) (*regexp.Regexp, time.Duration, error) {
+	req.Command = strings.TrimSpace(req.Command)
+	if req.Command == "" || len(req.Command) > maxBroadcastCommandSize {
+		return nil, 0, fmt.Errorf("the command must have between 1 and %d characters", maxBroadcastCommandSize)
+	}
+	for _, c := range req.Command {
+		if c < 0x20 || c == 0x7f {
+			return nil, 0, errors.New("the command must be a single line without control characters")
+		}
+	}
+	if (len(req.Devices) == 0) == (req.LabelSelector == "") {
+		return nil, 0, errors.New("either devices or labelSelector must be set")
+	}
+	for _, device := range req.Devices {
+		if !common.IsSafeResourceName(device) {
+			return nil, 0, fmt.Errorf("invalid device name %q", device)
+		}
+	}
+
+	prompt := req.Prompt
+	if prompt == "" {
+		prompt = defaultBroadcastPrompt
+	}
+	promptRegex, err := regexp.Compile(prompt)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid prompt: %w", err)
+	}
+
+	timeout := h.timeout
+	if req.TimeoutSeconds < 0 {
+		return nil, 0, errors.New("timeoutSeconds must not be negative")
+	}
+	if requested := time.Duration(req.TimeoutSeconds) * time.Second; requested > 0 && (timeout <= 0 || requested < timeout) {
+		timeout = requested
+	}
+	return promptRegex, timeout, nil
+}
+
+// deviceListError is returned when the API does not list the devices
+type deviceListError struct {
+	status int
+}
+
+func (e *deviceListError) Error() string {
+	return fmt.Sprintf("listing the devices failed with status %d", e.status)
+}
+
+// listDevices returns the names of the devices of the organization matching the label selector,
+// as the user sees them. It stops after limit devices.
+func (h *TerminalBroadcastHandler) listDevices(r *http.Request, orgID, labelSelector string, limit int) ([]string, error) {
+	var devices []string
+	continueToken := ""
+	for {
+		query := url.Values{"labelSelector": {labelSelector}, "org_id": {orgID}, "limit": {fmt.Sprint(min(limit, 1000))}}
+		if continueToken != "" {
+			query.Set("continue", continueToken)
+		}
+		listURL := strings.TrimSuffix(h.instance.ApiUrl, "/") + "/api/v1/devices?" + query.Encode()
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, listURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(common.AuthHeaderKey, r.Header.Get(common.AuthHeaderKey))
+		resp, err := h.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Items []struct {
+				Metadata struct {
+					Name string `json:"name"`
+				} `json:"metadata"`
+			} `json:"items"`
+			Metadata struct {
+				Continue string `json:"continue"`
+			} `json:"metadata"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, &deviceListError{status: resp.StatusCode}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid device list: %w", err)
+		}
+		for _, item := range list.Items {
+			devices = append(devices, item.Metadata.Name)
+		}
+		continueToken = list.Metadata.Continue
+		if continueToken == "" || len(devices) >= limit {
+			return devices, nil
+		}
+	}
+}
+
+func (h *TerminalBroadcastHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeBroadcastError(w, http.StatusMethodNotAllowed, "Broadcasts must be sent with POST", "INVALID_BROADCAST")
+		return
+	}
+	var req TerminalBroadcastRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBroadcastError(w, http.StatusBadRequest, "The request must be a JSON object", "INVALID_BROADCAST")
+		return
+	}
+	prompt, timeout, err := h.validateBroadcastRequest(&req)
+	if err != nil {
+		writeBroadcastError(w, http.StatusBadRequest, err.Error(), "INVALID_BROADCAST")
+		return
+	}
+	if err := validateQueryOrganization(r.URL.Query()); err != nil {
+		writeBroadcastError(w, http.StatusPreconditionRequired, "Organization selection required", "ORGANIZATION_REQUIRED")
+		return
+	}
+	orgID := r.URL.Query().Get("org_id")
+
+	auditEntry := terminalAuditEntry(r, "")
+	auditEntry.Event = audit.EventTerminalBroadcast
+
+	// The command goes through the console policy of the organization once for all the devices
+	if policy := newCommandPolicy(orgID); policy != nil {
+		switch action, pattern := policy.check(req.Command); {
+		case action == config.PolicyDeny:
+			recordCommandPolicyHit(auditEntry, commandDenied, req.Command, pattern)
+			writeBroadcastError(w, http.StatusForbidden, "The command is not allowed by the console policy", "COMMAND_DENIED")
+			return
+		case action == config.PolicyConfirm && !req.Confirmed:
+			recordCommandPolicyHit(auditEntry, commandCancelled, req.Command, pattern)
+			writeBroadcastError(w, http.StatusForbidden, "The command requires a confirmation, send it again with confirmed set to true", "COMMAND_CONFIRMATION_REQUIRED")
+			return
+		case action == config.PolicyConfirm:
+			recordCommandPolicyHit(auditEntry, commandConfirmed, req.Command, pattern)
+		}
+	}
+
+	devices := req.Devices
+	if req.LabelSelector != "" {
+		// One device more than the limit tells that the selector matches too many devices
+		limit := h.maxDevices + 1
+		if h.maxDevices <= 0 {
+			limit = math.MaxInt
+		}
+		devices, err = h.listDevices(r, orgID, req.LabelSelector, limit)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to list the devices matching %q for a console broadcast", req.LabelSelector)
+			// The user may not be allowed to list the devices, or have an expired session
+			var listErr *deviceListError
+			if errors.As(err, &listErr) && (listErr.status == http.StatusUnauthorized || listErr.status == http.StatusForbidden) {
+				writeBroadcastError(w, listErr.status, "Not allowed to list the devices matching the label selector", "DEVICE_LIST_FAILED")
+				return
+			}
+			writeBroadcastError(w, http.StatusBadGateway, "Failed to list the devices matching the label selector", "DEVICE_LIST_FAILED")
+			return
+		}
+	}
+	devices = uniqueStrings(devices)
+	if h.maxDevices > 0 && len(devices) > h.maxDevices {
+		writeBroadcastError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("The broadcast targets more than %d devices", h.maxDevices), "TOO_MANY_DEVICES")
+		return
+	}
+
+	auditEntry.Detail = fmt.Sprintf("command %q on %d devices", req.Command, len(devices))
+	audit.Record(auditEntry)
+	log.Infof("Broadcasting a console command to %d devices of organization %s", len(devices), orgID)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(w)
+	_ = controller.Flush()
+
+	results := make(chan TerminalBroadcastResult)
+	semaphore := make(chan struct{}, h.concurrency)
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		wg.Add(1)
+		go func(device string) {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-r.Context().Done():
+				return
+			}
+			result := h.runCommand(r, device, req.Command, prompt, timeout)
+			select {
+			case results <- result:
+			case <-r.Context().Done():
+			}
+		}(device)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Results are written by a single goroutine, as soon as each device is done
+	encoder := json.NewEncoder(w)
+	for result := range results {
+		if err := encoder.Encode(result); err != nil {
+			continue
+		}
+		_ = controller.Flush()
+	}
+}
+
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// runCommand runs the command in a new console session on the device
+func (h *TerminalBroadcastHandler) runCommand(r *http.Request, device, command string, prompt *regexp.Regexp, timeout time.Duration) (result TerminalBroadcastResult) {
+	start := time.Now()
+	result.Device = device
+	defer func() { result.DurationMs = time.Since(start).Milliseconds() }()
+
+	orgID := r.URL.Query().Get("org_id")
+	identity, _ := common.UserIdentityFromContext(r.Context())
+	userKey := ""
+	if identity.Username != "" {
+		userKey = h.instance.Name + "/" + identity.Username
+	}
+	releaseSession, err := terminalLimits.acquire(userKey, h.instance.Name+"/"+orgID+"/"+device)
+	if err != nil {
+		var limitErr *terminalLimitError
+		errors.As(err, &limitErr)
+		result.Status, result.Error = broadcastRejected, limitErr.reason
+		return result
+	}
+	defer releaseSession()
+	terminalSessionsGauge.Add(1, h.instance.Name)
+	defer terminalSessionsGauge.Add(-1, h.instance.Name)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	consoleURL, err := deviceConsoleURL(h.instance, device, url.Values{"org_id": {orgID}, "metadata": {broadcastConsoleMetadata}})
+	if err != nil {
+		result.Status, result.Error = broadcastFailed, err.Error()
+		return result
+	}
+	dialer := &websocket.Dialer{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: h.tlsConfig,
+		Subprotocols:    []string{"v5.channel.k8s.io"},
+	}
+	// Only the credentials of the user are sent, the other headers describe the broadcast request
+	headers := http.Header{}
+	if authorization := r.Header.Get(common.AuthHeaderKey); authorization != "" {
+		headers.Set(common.AuthHeaderKey, authorization)
+	}
+	backend, resp, err := dialer.DialContext(ctx, consoleURL, headers)
+	if err != nil {
+		result.Status, result.Error = broadcastFailed, "failed to open the console"
+		if resp != nil && resp.StatusCode != 0 {
+			result.Error = fmt.Sprintf("failed to open the console: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		}
+		log.Warnf("Failed to dial the console of device %s for a broadcast: %v", device, err)
+		return result
+	}
+	defer backend.Close()
+
+	auditEntry := terminalAuditEntry(r, device)
+	auditEntry.Detail = fmt.Sprintf("broadcast command %q", command)
+	audit.Record(auditEntry)
+	session := newTerminalSession(TerminalSessionInfo{
+		ID:           recording.NewSessionID(),
+		Username:     auditEntry.Username,
+		Provider:     auditEntry.Provider,
+		Instance:     auditEntry.Instance,
+		Organization: auditEntry.Organization,
+		Device:       device,
+		ClientIP:     auditEntry.ClientIP,
+		StartedAt:    start,
+	}, nil)
+	terminalSessions.add(session)
+	defer terminalSessions.remove(session)
+	result.SessionID = session.info.ID
+
+	recorder, err := recording.NewRecorder(recording.Metadata{
+		SessionID:    session.info.ID,
+		Username:     auditEntry.Username,
+		Provider:     auditEntry.Provider,
+		Instance:     auditEntry.Instance,
+		Organization: auditEntry.Organization,
+		Device:       device,
+		ClientIP:     auditEntry.ClientIP,
+		StartedAt:    start,
+	})
+	if err != nil {
+		log.WithError(err).Errorf("Failed to start the recording of the terminal session for device: %s", device)
+	}
+	defer func() {
+		session.endObservers()
+		recorder.Close()
+		auditEntry.Event = audit.EventTerminalClose
+		auditEntry.Timestamp = time.Time{}
+		auditEntry.Detail = fmt.Sprintf("broadcast command %s", result.Status)
+		auditEntry.DurationMs = time.Since(start).Milliseconds()
+		audit.Record(auditEntry)
+	}()
+
+	output := make(chan []byte, 16)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			_, msg, err := backend.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if len(msg) == 0 || (msg[0] != terminalStdout && msg[0] != terminalStderr) {
+				continue
+			}
+			_ = session.WriteMessage(websocket.BinaryMessage, msg)
+			recorder.Output(msg[1:])
+			select {
+			case output <- msg[1:]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// captured keeps the beginning of the output for the result, and tail its end to recognize the prompt
+	var captured, tail bytes.Buffer
+	sent := false
+	sendCommand := func() error {
+		sent = true
+		captured.Reset()
+		tail.Reset()
+		input := append([]byte{terminalStdin}, command+"\r"...)
+		session.received(len(input))
+		recorder.Input(input[1:])
+		_ = backend.SetWriteDeadline(time.Now().Add(websocketTimeout))
+		return backend.WriteMessage(websocket.BinaryMessage, input)
+	}
+	settle := time.NewTimer(broadcastSettleDelay)
+	defer settle.Stop()
+
+	for {
+		select {
+		case data := <-output:
+			session.sent(len(data) + 1)
+			if captured.Len() <= maxBroadcastOutputSize*2 {
+				captured.Write(data)
+			}
+			tail.Write(data)
+			if tail.Len() > maxPromptSize {
+				tail.Next(tail.Len() - maxPromptSize)
+			}
+			// The prompt is only looked for after the echo of the command, which may look like one
+			if (sent && !bytes.Contains(captured.Bytes(), []byte("\n"))) || !promptShown(tail.Bytes(), prompt) {
+				if !sent {
+					settle.Reset(broadcastSettleDelay)
+				}
+				continue
+			}
+			if sent {
+				result.Status = broadcastCompleted
+				result.Output, result.Truncated = commandOutput(captured.Bytes(), command, true)
+				closeBroadcastSession(backend)
+				return result
+			}
+			if err := sendCommand(); err != nil {
+				result.Status, result.Error = broadcastFailed, "failed to send the command"
+				return result
+			}
+		case <-settle.C:
+			// Run the command even if the prompt was not recognized
+			if !sent {
+				if err := sendCommand(); err != nil {
+					result.Status, result.Error = broadcastFailed, "failed to send the command"
+					return result
+				}
+			}
+		case err := <-readErr:
+			result.Output, result.Truncated = commandOutput(captured.Bytes(), command, false)
+			result.Status, result.Error = broadcastFailed, "the console closed before the command completed"
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Text != "" {
+				result.Error += ": " + closeErr.Text
+			}
+			return result
+		case admin := <-session.terminate:
+			log.Infof("Broadcast terminal session for device %s terminated by administrator %q", device, admin)
+			result.Status, result.Error = broadcastTerminated, "terminated by an administrator"
+			result.Output, result.Truncated = commandOutput(captured.Bytes(), command, false)
+			closeBroadcastSession(backend)
+			return result
+		case <-ctx.Done():
+			result.Status = broadcastTimeout
+			result.Output, result.Truncated = commandOutput(captured.Bytes(), command, false)
+			closeBroadcastSession(backend)
+			return result
+		}
+	}
+}
+
+func closeBroadcastSession(backend *websocket.Conn) {
+	_ = backend.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(websocketTimeout))
+}
+
+// cleanTerminalOutput removes the escape sequences and carriage returns of the terminal output
+func cleanTerminalOutput(output []byte) string {
+	cleaned := broadcastEscapes.ReplaceAllString(string(output), "")
+	cleaned = strings.ReplaceAll(cleaned, "\r\n", "\n")
+	return strings.ReplaceAll(cleaned, "\r", "")
+}
+
+// promptShown reports whether the last line of the output is a shell prompt
+func promptShown(output []byte, prompt *regexp.Regexp) bool {
+	cleaned := cleanTerminalOutput(output)
+	lastLine := cleaned[strings.LastIndex(cleaned, "\n")+1:]
+	return lastLine != "" && prompt.MatchString(lastLine)
+}
+
+// commandOutput returns the output of the command without its echo, and without the prompt that
+// follows it when the command completed
+func commandOutput(output []byte, command string, completed bool) (string, bool) {
+	cleaned := cleanTerminalOutput(output)
+	if first, rest, found := strings.Cut(cleaned, "\n"); found && strings.HasSuffix(strings.TrimSpace(first), command) {
+		cleaned = rest
+	}
+	if completed {
+		cleaned = cleaned[:strings.LastIndex(cleaned, "\n")+1]
+	}
+	if len(cleaned) > maxBroadcastOutputSize {
+		return cleaned[:maxBroadcastOutputSize], true
+	}
+	return cleaned, false
+}
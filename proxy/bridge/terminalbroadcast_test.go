@@ -0,0 +1,173 @@
+package bridge
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/gorilla/websocket"
+)
+
+// newTestShell starts a device console with a shell prompt, in which "hostname" prints the name of
+// the device and other commands never complete
+func newTestShell(t *testing.T) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{Subprotocols: []string{"v5.channel.k8s.io"}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/v1/devices/{device}/console", func(w http.ResponseWriter, r *http.Request) {
+		device := r.PathValue("device")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		write := func(s string) {
+			_ = conn.WriteMessage(websocket.BinaryMessage, append([]byte{terminalStdout}, s...))
+		}
+		write("\x1b[1mroot@" + device + "\x1b[0m:~# ")
+		var line []byte
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			for _, c := range msg[1:] {
+				if c != '\r' {
+					line = append(line, c)
+					continue
+				}
+				write(string(line) + "\r\n")
+				if string(line) == "hostname" {
+					write(device + "\r\n")
+					write("root@" + device + ":~# ")
+				}
+				line = nil
+			}
+		}
+	})
+	mux.HandleFunc("/api/v1/devices", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("labelSelector") != "site=a" || r.URL.Query().Get("org_id") != "org1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"items":[{"metadata":{"name":"dev1"}},{"metadata":{"name":"dev2"}}]}`))
+	})
+	server := httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTerminalBroadcast(t *testing.T) { //nolint:paralleltest // uses the package-level session registry
+	shell := newTestShell(t)
+	handler := &TerminalBroadcastHandler{
+		instance:    config.Instance{Name: "default", ApiUrl: shell.URL},
+		tlsConfig:   &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server certificate
+		client:      shell.Client(),
+		maxDevices:  2,
+		concurrency: 2,
+		timeout:     5 * time.Second,
+	}
+	broadcast := func(body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/console/broadcast?org_id=org1", strings.NewReader(body))
+		req = req.WithContext(common.WithUserIdentity(req.Context(), common.UserIdentity{Username: "alice"}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	results := func(rec *httptest.ResponseRecorder) []TerminalBroadcastResult {
+		t.Helper()
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("expected an NDJSON stream, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var parsed []TerminalBroadcastResult
+		scanner := bufio.NewScanner(bytes.NewReader(rec.Body.Bytes()))
+		for scanner.Scan() {
+			var result TerminalBroadcastResult
+			if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+				t.Fatalf("invalid result line %q: %v", scanner.Text(), err)
+			}
+			parsed = append(parsed, result)
+		}
+		sort.Slice(parsed, func(i, j int) bool { return parsed[i].Device < parsed[j].Device })
+		return parsed
+	}
+
+	// The output of the command is captured until the prompt comes back
+	got := results(broadcast(`{"command":"hostname","labelSelector":"site=a"}`))
+	if len(got) != 2 {
+		t.Fatalf("expected a result for each device, got %+v", got)
+	}
+	for i, device := range []string{"dev1", "dev2"} {
+		if got[i].Device != device || got[i].Status != broadcastCompleted || got[i].Output != device+"\n" || got[i].SessionID == "" {
+			t.Errorf("unexpected result for %s: %+v", device, got[i])
+		}
+	}
+
+	// Commands that do not complete time out with the output they printed
+	got = results(broadcast(`{"command":"tail -f /var/log/messages","devices":["dev1","dev1"],"timeoutSeconds":1}`))
+	if len(got) != 1 || got[0].Status != broadcastTimeout {
+		t.Errorf("expected a single timed out result, got %+v", got)
+	} else if got[0].DurationMs < 1000 {
+		t.Errorf("expected the duration to cover the timeout, got %d ms", got[0].DurationMs)
+	}
+	if len(terminalSessions.list()) != 0 {
+		t.Error("expected the broadcast sessions to be closed")
+	}
+
+	for body, code := range map[string]int{
+		`{"command":"hostname"}`:                                             http.StatusBadRequest,
+		`{"command":"ls\nreboot","devices":["dev1"]}`:                        http.StatusBadRequest,
+		`{"command":"hostname","devices":["dev1"],"labelSelector":"site=a"}`: http.StatusBadRequest,
+		`{"command":"hostname","devices":["dev1","dev2","dev3"]}`:            http.StatusRequestEntityTooLarge,
+	} {
+		if rec := broadcast(body); rec.Code != code {
+			t.Errorf("%s: expected %d, got %d", body, code, rec.Code)
+		}
+	}
+}
+
+func TestTerminalBroadcastCommandPolicy(t *testing.T) { //nolint:paralleltest // mutates package-level config
+	policies := config.TerminalCommandPolicies
+	config.TerminalCommandPolicies = map[string]config.TerminalCommandPolicy{
+		"org1": {Deny: []string{`^reboot\b`}, Confirm: []string{`^systemctl restart\b`}},
+	}
+	t.Cleanup(func() { config.TerminalCommandPolicies = policies })
+
+	handler := &TerminalBroadcastHandler{maxDevices: 10, concurrency: 1, timeout: time.Second}
+	for body, code := range map[string]string{
+		`{"command":"reboot","devices":["dev1"]}`:                            "COMMAND_DENIED",
+		`{"command":"systemctl restart flightctl-agent","devices":["dev1"]}`: "COMMAND_CONFIRMATION_REQUIRED",
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/console/broadcast?org_id=org1", strings.NewReader(body)))
+		if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), code) {
+			t.Errorf("%s: expected a 403 with code %s, got %d: %s", body, code, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestCommandOutput(t *testing.T) {
+	t.Parallel()
+
+	output := []byte("journalctl -n 2\r\n\x1b[32mline 1\x1b[0m\r\nline 2\r\nroot@dev1:~# ")
+	if got, _ := commandOutput(output, "journalctl -n 2", true); got != "line 1\nline 2\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+	if got, _ := commandOutput(output, "journalctl -n 2", false); got != "line 1\nline 2\nroot@dev1:~# " {
+		t.Errorf("expected the output of an incomplete command to be kept, got %q", got)
+	}
+	if !promptShown(output, regexp.MustCompile(defaultBroadcastPrompt)) {
+		t.Error("expected the prompt to be recognized")
+	}
+}
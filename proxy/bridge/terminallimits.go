@@ -0,0 +1,145 @@
+package bridge
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/metrics"
+)
+
+// WebSocket close codes of terminal sessions ended by the proxy, in the range reserved for
+// applications, so that the UI can tell them apart
+const (
+	closeTooManySessions       = 4001
+	closeTooManyUserSessions   = 4002
+	closeTooManyDeviceSessions = 4003
+	closeIdleTimeout           = 4004
+	closeMaxDurationReached    = 4005
+)
+
+const (
+	terminalIdleWarningFmt    = "\r\n*** This session has been idle and will be closed in %s unless there is input ***\r\n"
+	terminalIdleReason        = "Session closed after being idle for %s"
+	terminalMaxDurationReason = "Session closed after reaching the maximum duration of %s"
+)
+
+var terminalSessionsGauge = metrics.NewGaugeVec(
+	"flightctl_ui_terminal_sessions",
+	"Terminal sessions currently open through the proxy.",
+	"instance",
+)
+
+// terminalLimitError rejects a terminal session with a close code and reason shown by the UI
+type terminalLimitError struct {
+	code   int
+	reason string
+}
+
+func (e *terminalLimitError) Error() string {
+	return e.reason
+}
+
+// terminalSessionLimits counts the open terminal sessions, globally, per user and per device
+type terminalSessionLimits struct {
+	maxTotal     int
+	maxPerUser   int
+	maxPerDevice int
+
+	mu        sync.Mutex
+	total     int
+	perUser   map[string]int
+	perDevice map[string]int
+}
+
+var terminalLimits = newTerminalSessionLimits(config.TerminalMaxSessions, config.TerminalMaxSessionsPerUser, config.TerminalMaxSessionsPerDevice)
+
+func newTerminalSessionLimits(maxTotal, maxPerUser, maxPerDevice int) *terminalSessionLimits {
+	return &terminalSessionLimits{
+		maxTotal:     maxTotal,
+		maxPerUser:   maxPerUser,
+		maxPerDevice: maxPerDevice,
+		perUser:      map[string]int{},
+		perDevice:    map[string]int{},
+	}
+}
+
+// acquire reserves a session for the user and device, which must be released when the session ends.
+// Sessions whose user is unknown are only counted against the global and device limits.
+func (l *terminalSessionLimits) acquire(userKey, deviceKey string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return nil, &terminalLimitError{code: closeTooManySessions, reason: "Too many terminal sessions are open"}
+	}
+	if l.maxPerUser > 0 && userKey != "" && l.perUser[userKey] >= l.maxPerUser {
+		return nil, &terminalLimitError{
+			code:   closeTooManyUserSessions,
+			reason: fmt.Sprintf("You already have %d terminal sessions open", l.perUser[userKey]),
+		}
+	}
+	if l.maxPerDevice > 0 && l.perDevice[deviceKey] >= l.maxPerDevice {
+		return nil, &terminalLimitError{
+			code:   closeTooManyDeviceSessions,
+			reason: fmt.Sprintf("The device already has %d terminal sessions open", l.perDevice[deviceKey]),
+		}
+	}
+	l.total++
+	if userKey != "" {
+		l.perUser[userKey]++
+	}
+	l.perDevice[deviceKey]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if userKey != "" {
+				if l.perUser[userKey]--; l.perUser[userKey] <= 0 {
+					delete(l.perUser, userKey)
+				}
+			}
+			if l.perDevice[deviceKey]--; l.perDevice[deviceKey] <= 0 {
+				delete(l.perDevice, deviceKey)
+			}
+		})
+	}, nil
+}
+
+// terminalIdleTimer closes sessions without input, after warning the user
+type terminalIdleTimer struct {
+	timeout   time.Duration
+	warning   time.Duration
+	lastInput atomic.Int64
+	warned    bool
+}
+
+func newTerminalIdleTimer(timeout, warning time.Duration) *terminalIdleTimer {
+	t := &terminalIdleTimer{timeout: timeout, warning: min(warning, timeout)}
+	t.touch()
+	return t
+}
+
+// touch records input from the user
+func (t *terminalIdleTimer) touch() {
+	t.lastInput.Store(time.Now().UnixNano())
+}
+
+// check returns whether the user must be warned or the session closed, and when to check again
+func (t *terminalIdleTimer) check(now time.Time) (warn, expired bool, next time.Duration) {
+	idle := now.Sub(time.Unix(0, t.lastInput.Load()))
+	if idle < t.timeout-t.warning {
+		t.warned = false
+		return false, false, t.timeout - t.warning - idle
+	}
+	if idle >= t.timeout {
+		return false, true, 0
+	}
+	warn = !t.warned
+	t.warned = true
+	return warn, false, t.timeout - idle
+}
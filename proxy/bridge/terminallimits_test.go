@@ -0,0 +1,76 @@
+package bridge
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTerminalSessionLimits(t *testing.T) {
+	t.Parallel()
+
+	limits := newTerminalSessionLimits(3, 2, 1)
+	expectCode := func(err error, code int) {
+		t.Helper()
+		var limitErr *terminalLimitError
+		if !errors.As(err, &limitErr) || limitErr.code != code {
+			t.Fatalf("expected close code %d, got %v", code, err)
+		}
+	}
+
+	release1, err := limits.acquire("default/alice", "default/org/dev1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = limits.acquire("default/bob", "default/org/dev1")
+	expectCode(err, closeTooManyDeviceSessions)
+
+	if _, err = limits.acquire("default/alice", "default/org/dev2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = limits.acquire("default/alice", "default/org/dev3")
+	expectCode(err, closeTooManyUserSessions)
+
+	if _, err = limits.acquire("", "default/org/dev3"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = limits.acquire("default/bob", "default/org/dev4")
+	expectCode(err, closeTooManySessions)
+
+	// Releasing twice must not free more than one session
+	release1()
+	release1()
+	if _, err = limits.acquire("default/bob", "default/org/dev1"); err != nil {
+		t.Fatalf("expected the released session to be available: %v", err)
+	}
+	_, err = limits.acquire("default/carol", "default/org/dev5")
+	expectCode(err, closeTooManySessions)
+}
+
+func TestTerminalIdleTimer(t *testing.T) {
+	t.Parallel()
+
+	timer := newTerminalIdleTimer(10*time.Minute, time.Minute)
+	start := time.Unix(0, timer.lastInput.Load())
+
+	warn, expired, next := timer.check(start.Add(5 * time.Minute))
+	if warn || expired || next != 4*time.Minute {
+		t.Errorf("expected no action before the warning, got %v %v %v", warn, expired, next)
+	}
+	warn, expired, next = timer.check(start.Add(9 * time.Minute))
+	if !warn || expired || next != time.Minute {
+		t.Errorf("expected a warning, got %v %v %v", warn, expired, next)
+	}
+	warn, _, _ = timer.check(start.Add(9*time.Minute + 30*time.Second))
+	if warn {
+		t.Error("expected a single warning")
+	}
+	if _, expired, _ = timer.check(start.Add(10 * time.Minute)); !expired {
+		t.Error("expected the session to expire")
+	}
+
+	timer.touch()
+	if warn, expired, _ = timer.check(time.Now()); warn || expired {
+		t.Error("expected input to reset the idle timer")
+	}
+}
@@ -0,0 +1,314 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/audit"
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// observerCatchUpSize is the recent output sent to observers when they join a session
+	observerCatchUpSize = 64 * 1024
+	// observerQueueSize is the number of messages an observer can lag behind before being disconnected
+	observerQueueSize = 256
+	// closeObserverTooSlow is sent to observers that cannot keep up with the session output
+	closeObserverTooSlow = 4007
+)
+
+// outputRing keeps the most recent bytes written to it
+type outputRing struct {
+	size int
+	buf  []byte
+	// total counts every byte ever written, so that readers can tell what they missed
+	total int64
+}
+
+func newOutputRing(size int) *outputRing {
+	return &outputRing{size: size}
+}
+
+func (o *outputRing) write(p []byte) {
+	o.total += int64(len(p))
+	if len(p) >= o.size {
+		o.buf = append(o.buf[:0], p[len(p)-o.size:]...)
+		return
+	}
+	if len(o.buf)+len(p) > o.size {
+		// Drop the oldest bytes
+		drop := len(o.buf) + len(p) - o.size
+		o.buf = append(o.buf[:0], o.buf[drop:]...)
+	}
+	o.buf = append(o.buf, p...)
+}
+
+func (o *outputRing) bytes() []byte {
+	return append([]byte(nil), o.buf...)
+}
+
+// since returns the bytes written after the first offset bytes, and whether they are all still
+// in the buffer
+func (o *outputRing) since(offset int64) ([]byte, bool) {
+	offset = min(max(offset, 0), o.total)
+	missed := o.total - offset
+	if missed > int64(len(o.buf)) {
+		return o.bytes(), false
+	}
+	return append([]byte(nil), o.buf[int64(len(o.buf))-missed:]...), true
+}
+
+// terminalObserver receives the output of a session it cannot write to
+type terminalObserver struct {
+	conn     *websocket.Conn
+	username string
+	messages chan []byte
+	// closed is closed when the observer must stop, with closeCode and closeReason sent to it
+	closed      chan struct{}
+	closeOnce   sync.Once
+	closeCode   int
+	closeReason string
+}
+
+func (o *terminalObserver) close(code int, reason string) {
+	o.closeOnce.Do(func() {
+		o.closeCode, o.closeReason = code, reason
+		close(o.closed)
+	})
+}
+
+// addObserver registers an observer and returns the output it missed, atomically with respect to
+// broadcast so that no output is lost or repeated
+func (s *terminalSession) addObserver(o *terminalObserver) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return nil, false
+	}
+	s.observers[o] = struct{}{}
+	return s.output.bytes(), true
+}
+
+func (s *terminalSession) removeObserver(o *terminalObserver) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.observers, o)
+}
+
+// broadcastLocked keeps the output of the device for late observers and resumed sessions, and
+// sends it to the current observers
+func (s *terminalSession) broadcastLocked(msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+	if msg[0] == terminalStdout || msg[0] == terminalStderr {
+		s.output.write(msg[1:])
+	}
+	for o := range s.observers {
+		select {
+		case o.messages <- append([]byte(nil), msg...):
+		default:
+			delete(s.observers, o)
+			o.close(closeObserverTooSlow, "Observer too slow to follow the session")
+		}
+	}
+}
+
+// endObservers disconnects the observers once the session has ended
+func (s *terminalSession) endObservers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+	for o := range s.observers {
+		o.close(websocket.CloseNormalClosure, "Session ended")
+	}
+	s.observers = map[*terminalObserver]struct{}{}
+}
+
+// notifyOwner writes a message in the terminal of the session owner
+func (s *terminalSession) notifyOwner(message string) {
+	_ = s.writeFrontend(websocket.BinaryMessage, append([]byte{terminalStdout}, fmt.Sprintf("\r\n*** %s ***\r\n", message)...))
+}
+
+// TerminalObserveHandler attaches the caller to an open terminal session as a read-only observer.
+// The observer receives the recent output of the session, then follows it live, and anything it
+// sends is dropped. The owner of the session is told when observers join and leave.
+//
+// Administrators can observe the sessions opened through the instance of the handler, and global
+// administrators the sessions of every instance. The users listed in TERMINAL_OBSERVER_USERS can
+// observe the sessions opened through the instance of the handler on the devices they can read in
+// the organization of the session, which is checked against the API with their own token.
+type TerminalObserveHandler struct {
+	instance      config.Instance
+	client        *http.Client
+	isAdmin       func(instance, provider, username string) bool
+	isGlobalAdmin func(provider, username string) bool
+	isObserver    func(instance, provider, username string) bool
+}
+
+func NewTerminalObserveHandler(instance config.Instance, tlsConfig *tls.Config) *TerminalObserveHandler {
+	return &TerminalObserveHandler{
+		instance: instance,
+		client: &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+			Timeout:   websocketTimeout,
+		},
+		isAdmin:       config.IsAdminUser,
+		isGlobalAdmin: config.IsGlobalAdminUser,
+		isObserver:    config.IsTerminalObserverUser,
+	}
+}
+
+// authorize tells whether the user of the request may observe the session, writing the error
+// response when it may not
+func (h *TerminalObserveHandler) authorize(w http.ResponseWriter, r *http.Request, info TerminalSessionInfo) bool {
+	identity, _ := common.UserIdentityFromContext(r.Context())
+	if info.Instance != h.instance.Name && !h.isGlobalAdmin(identity.Provider, identity.Username) {
+		writeTerminalSessionError(w, http.StatusForbidden, "Not allowed to observe this terminal session", "TERMINAL_OBSERVE_FORBIDDEN")
+		return false
+	}
+	if h.isAdmin(h.instance.Name, identity.Provider, identity.Username) {
+		return true
+	}
+	if !h.isObserver(h.instance.Name, identity.Provider, identity.Username) {
+		writeTerminalSessionError(w, http.StatusForbidden, "Not allowed to observe this terminal session", "TERMINAL_OBSERVE_FORBIDDEN")
+		return false
+	}
+
+	deviceURL := strings.TrimSuffix(h.instance.ApiUrl, "/") + "/api/v1/devices/" + url.PathEscape(info.Device) + "?" + url.Values{"org_id": {info.Organization}}.Encode()
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, deviceURL, nil)
+	if err != nil {
+		writeTerminalSessionError(w, http.StatusInternalServerError, "Failed to check the access to the device", "TERMINAL_OBSERVE_CHECK_FAILED")
+		return false
+	}
+	req.Header.Set(common.AuthHeaderKey, r.Header.Get(common.AuthHeaderKey))
+	resp, err := h.client.Do(req)
+	if err != nil {
+		log.Warnf("Failed to check the access of user %q to device %s: %v", identity.Username, info.Device, err)
+		writeTerminalSessionError(w, http.StatusBadGateway, "Failed to check the access to the device", "TERMINAL_OBSERVE_CHECK_FAILED")
+		return false
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return true
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound:
+		writeTerminalSessionError(w, http.StatusForbidden, "Not allowed to observe this terminal session", "TERMINAL_OBSERVE_FORBIDDEN")
+	default:
+		log.Warnf("Checking the access of user %q to device %s failed with status %d", identity.Username, info.Device, resp.StatusCode)
+		writeTerminalSessionError(w, http.StatusBadGateway, "Failed to check the access to the device", "TERMINAL_OBSERVE_CHECK_FAILED")
+	}
+	return false
+}
+
+func (h *TerminalObserveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session := terminalSessions.get(mux.Vars(r)["id"])
+	if session == nil {
+		writeTerminalSessionError(w, http.StatusNotFound, "Terminal session not found", "TERMINAL_SESSION_NOT_FOUND")
+		return
+	}
+	if !h.authorize(w, r, session.snapshot()) {
+		return
+	}
+
+	upgrader := &websocket.Upgrader{
+		Subprotocols: websocket.Subprotocols(r),
+		CheckOrigin:  checkOrigin,
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warnf("Failed to upgrade websocket for observer: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	identity, _ := common.UserIdentityFromContext(r.Context())
+	observer := &terminalObserver{
+		conn:     conn,
+		username: identity.Username,
+		messages: make(chan []byte, observerQueueSize),
+		closed:   make(chan struct{}),
+	}
+	catchUp, ok := session.addObserver(observer)
+	if !ok {
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Session ended"), time.Now().Add(websocketTimeout))
+		return
+	}
+	defer session.removeObserver(observer)
+
+	info := session.snapshot()
+	entry := audit.Entry{
+		Event:        audit.EventTerminalObserve,
+		RequestID:    r.Header.Get(common.RequestIDHeader),
+		Username:     identity.Username,
+		Provider:     identity.Provider,
+		Instance:     info.Instance,
+		Organization: info.Organization,
+		Path:         r.URL.Path,
+		Device:       info.Device,
+		Detail:       "session " + info.ID + " of user " + info.Username,
+	}
+	if ip := config.ClientIP(r); ip != nil {
+		entry.ClientIP = ip.String()
+	}
+	audit.Record(entry)
+	start := time.Now()
+	log.Infof("User %q started observing terminal session %s on device %s", identity.Username, info.ID, info.Device)
+	session.notifyOwner(fmt.Sprintf("%s started observing this session", identity.Username))
+	defer func() {
+		log.Infof("User %q stopped observing terminal session %s on device %s", identity.Username, info.ID, info.Device)
+		session.notifyOwner(fmt.Sprintf("%s stopped observing this session", identity.Username))
+		entry.Timestamp = time.Time{}
+		entry.Detail += " ended"
+		entry.DurationMs = time.Since(start).Milliseconds()
+		audit.Record(entry)
+	}()
+
+	if len(catchUp) > 0 {
+		if err := conn.WriteMessage(websocket.BinaryMessage, append([]byte{terminalStdout}, catchUp...)); err != nil {
+			return
+		}
+	}
+
+	// Observer input is read only to process control frames, and dropped
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(websocketPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-observer.messages:
+			if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return
+			}
+		case <-observer.closed:
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(observer.closeCode, observer.closeReason), time.Now().Add(websocketTimeout))
+			return
+		case <-readErr:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(websocketTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
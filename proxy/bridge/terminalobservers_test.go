@@ -0,0 +1,212 @@
+package bridge
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestOutputRing(t *testing.T) {
+	t.Parallel()
+
+	ring := newOutputRing(8)
+	ring.write([]byte("abc"))
+	ring.write([]byte("defgh"))
+	if got := string(ring.bytes()); got != "abcdefgh" {
+		t.Errorf("got %q", got)
+	}
+	ring.write([]byte("ij"))
+	if got := string(ring.bytes()); got != "cdefghij" {
+		t.Errorf("expected the oldest bytes to be dropped, got %q", got)
+	}
+	ring.write([]byte("0123456789"))
+	if got := string(ring.bytes()); got != "23456789" {
+		t.Errorf("expected only the end of a large write to be kept, got %q", got)
+	}
+}
+
+func readUntil(t *testing.T, conn *websocket.Conn, want string) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var received []byte
+	for !bytes.Contains(received, []byte(want)) {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("expected to receive %q, got %q and %v", want, received, err)
+		}
+		received = append(received, msg[1:]...)
+	}
+}
+
+func TestObserveTerminalSession(t *testing.T) { //nolint:paralleltest // uses the package-level session registry
+	proxy := newTestConsole(t, nil, 0)
+	owner, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http")+"/api/terminal/dev1?org_id=org1", nil)
+	if err != nil {
+		t.Fatalf("failed to open the terminal: %v", err)
+	}
+	defer owner.Close()
+	if err := owner.WriteMessage(websocket.BinaryMessage, []byte("\x00before\r")); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, owner, "before")
+
+	sessions := terminalSessions.list()
+	if len(sessions) != 1 {
+		t.Fatalf("expected one open session, got %+v", sessions)
+	}
+
+	handler := &TerminalObserveHandler{
+		instance:      config.DefaultInstance(),
+		isAdmin:       func(instance, provider, username string) bool { return username == "bob" },
+		isGlobalAdmin: func(provider, username string) bool { return false },
+		isObserver:    func(instance, provider, username string) bool { return false },
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/admin/terminal-sessions/{id}/observe", func(w http.ResponseWriter, r *http.Request) {
+		ctx := common.WithUserIdentity(r.Context(), common.UserIdentity{Username: "bob"})
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+	observerServer := httptest.NewServer(router)
+	defer observerServer.Close()
+	observer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(observerServer.URL, "http")+"/api/admin/terminal-sessions/"+sessions[0].ID+"/observe", nil)
+	if err != nil {
+		t.Fatalf("failed to observe the session: %v", err)
+	}
+	defer observer.Close()
+
+	// The observer catches up with the output it missed, and the owner is told about it
+	readUntil(t, observer, "before")
+	readUntil(t, owner, "bob started observing this session")
+
+	// Input from the observer is dropped
+	if err := observer.WriteMessage(websocket.BinaryMessage, []byte("\x00observer-input\r")); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.WriteMessage(websocket.BinaryMessage, []byte("\x00after\r")); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, observer, "after")
+	if got := terminalSessions.list()[0]; got.BytesIn != int64(len("\x00before\r")+len("\x00after\r")) {
+		t.Errorf("expected the observer input to be dropped, the session received %d bytes", got.BytesIn)
+	}
+
+	observer.Close()
+	readUntil(t, owner, "bob stopped observing this session")
+
+	// Observers are disconnected when the session ends
+	observer, _, err = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(observerServer.URL, "http")+"/api/admin/terminal-sessions/"+sessions[0].ID+"/observe", nil)
+	if err != nil {
+		t.Fatalf("failed to observe the session: %v", err)
+	}
+	defer observer.Close()
+	readUntil(t, owner, "bob started observing this session")
+	_ = owner.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	owner.Close()
+	_ = observer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err = observer.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseNormalClosure {
+		t.Errorf("expected a normal closure when the session ends, got %v", err)
+	}
+}
+
+func TestObserveTerminalSessionAuthorization(t *testing.T) { //nolint:paralleltest // uses the package-level session registry
+	proxy := newTestConsole(t, nil, 0)
+	owner, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http")+"/api/terminal/dev1?org_id=org1", nil)
+	if err != nil {
+		t.Fatalf("failed to open the terminal: %v", err)
+	}
+	defer owner.Close()
+	if err := owner.WriteMessage(websocket.BinaryMessage, []byte("\x00before\r")); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, owner, "before")
+	sessions := terminalSessions.list()
+	if len(sessions) != 1 {
+		t.Fatalf("expected one open session, got %+v", sessions)
+	}
+
+	// The API lets carol read the device of the session, but not dave
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/devices/dev1" || r.URL.Query().Get("org_id") != "org1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get(common.AuthHeaderKey) != "Bearer carol" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer api.Close()
+
+	instance := config.DefaultInstance()
+	instance.ApiUrl = api.URL
+	handler := &TerminalObserveHandler{
+		instance:      instance,
+		client:        api.Client(),
+		isAdmin:       func(instance, provider, username string) bool { return username == "frank" || username == "grace" },
+		isGlobalAdmin: func(provider, username string) bool { return username == "grace" },
+		isObserver:    func(instance, provider, username string) bool { return username != "erin" },
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/admin/terminal-sessions/{id}/observe", func(w http.ResponseWriter, r *http.Request) {
+		username := r.URL.Query().Get("user")
+		r.Header.Set(common.AuthHeaderKey, "Bearer "+username)
+		ctx := common.WithUserIdentity(r.Context(), common.UserIdentity{Username: username, Provider: "oidc"})
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+	observerServer := httptest.NewServer(router)
+	defer observerServer.Close()
+
+	observe := func(username string) (*websocket.Conn, int) {
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(observerServer.URL, "http")+"/api/admin/terminal-sessions/"+sessions[0].ID+"/observe?user="+username, nil)
+		if err != nil {
+			if resp == nil {
+				t.Fatalf("failed to observe the session: %v", err)
+			}
+			return nil, resp.StatusCode
+		}
+		return conn, http.StatusSwitchingProtocols
+	}
+
+	observer, status := observe("carol")
+	if observer == nil {
+		t.Fatalf("expected an observer with access to the device to be accepted, got %d", status)
+	}
+	defer observer.Close()
+	readUntil(t, observer, "before")
+
+	// Observers need both to be listed and to access the device
+	for _, username := range []string{"dave", "erin"} {
+		if conn, status := observe(username); conn != nil || status != http.StatusForbidden {
+			t.Errorf("expected %s to be rejected with 403, got %d", username, status)
+		}
+	}
+
+	// Only the global administrators observe the sessions of another instance
+	handler.instance.Name = "eu"
+	if conn, status := observe("frank"); conn != nil || status != http.StatusForbidden {
+		t.Errorf("expected the administrator of another instance to be rejected with 403, got %d", status)
+	}
+	admin, status := observe("grace")
+	if admin == nil {
+		t.Fatalf("expected a global administrator to be accepted, got %d", status)
+	}
+	defer admin.Close()
+	readUntil(t, admin, "before")
+}
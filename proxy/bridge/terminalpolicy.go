@@ -0,0 +1,227 @@
+package bridge
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"github.com/flightctl/flightctl-ui/audit"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var commandPolicyHits = metrics.NewCounterVec(
+	"flightctl_ui_terminal_command_policy_hits_total",
+	"Command lines typed in terminal sessions that matched the command policy, by outcome.",
+	"outcome",
+)
+
+// Outcomes of the command lines matching the command policy
+const (
+	commandDenied    = "denied"
+	commandConfirmed = "confirmed"
+	commandCancelled = "cancelled"
+)
+
+const (
+	// commandConfirmation is the answer to type to run a command that needs a confirmation
+	commandConfirmation = "yes"
+	// maxCommandLineSize bounds the line reassembled from the input; longer lines are checked on their beginning
+	maxCommandLineSize = 4096
+	// maxCommandAnswerSize bounds the answer typed to a confirmation request
+	maxCommandAnswerSize = 64
+	// terminalInterrupt is sent instead of the end of a line that must not run, so that the shell discards it
+	terminalInterrupt = 0x03
+
+	terminalCommandDeniedMsg    = "\r\n*** This command is not allowed by the console policy ***\r\n"
+	terminalCommandConfirmMsg   = "\r\n*** This command requires a confirmation. Type \"" + commandConfirmation + "\" and press Enter to run it, anything else cancels it: "
+	terminalCommandCancelledMsg = "\r\n*** Command cancelled ***\r\n"
+)
+
+// commandPolicy holds the compiled patterns of the command policy of an organization
+type commandPolicy struct {
+	deny    []*regexp.Regexp
+	confirm []*regexp.Regexp
+}
+
+// newCommandPolicy returns the command policy of the organization, or nil when no pattern applies to it
+func newCommandPolicy(organization string) *commandPolicy {
+	policy := &commandPolicy{}
+	for _, key := range []string{config.AllOrganizations, organization} {
+		rules := config.TerminalCommandPolicies[key]
+		// The patterns were validated when the configuration was loaded
+		for _, pattern := range rules.Deny {
+			policy.deny = append(policy.deny, regexp.MustCompile(pattern))
+		}
+		for _, pattern := range rules.Confirm {
+			policy.confirm = append(policy.confirm, regexp.MustCompile(pattern))
+		}
+	}
+	if len(policy.deny) == 0 && len(policy.confirm) == 0 {
+		return nil
+	}
+	return policy
+}
+
+// check returns the action for a command line, config.PolicyDeny or config.PolicyConfirm, and the
+// pattern it matched. Lines matching no pattern get an empty action.
+func (p *commandPolicy) check(line string) (string, string) {
+	for _, re := range p.deny {
+		if re.MatchString(line) {
+			return config.PolicyDeny, re.String()
+		}
+	}
+	for _, re := range p.confirm {
+		if re.MatchString(line) {
+			return config.PolicyConfirm, re.String()
+		}
+	}
+	return "", ""
+}
+
+// commandFilter forwards the input of a terminal session to the device console, holding back the
+// end of the command lines that the policy denies or asks to confirm. The characters of a line
+// reach the shell as they are typed, so a line is stopped by replacing its Enter key with an
+// interrupt. Lines are reassembled from the keystrokes on a best-effort basis: backspaces and the
+// usual line-kill keys are followed, but escape sequences such as cursor moves and history
+// navigation are ignored, so the policy is a safeguard against mistakes rather than a security
+// boundary.
+type commandFilter struct {
+	policy  *commandPolicy
+	backend messageWriter
+	// notify writes a message in the terminal of the user
+	notify func(message string)
+	// entry describes the session in the audit log
+	entry audit.Entry
+
+	line []byte
+	// confirming is set while the user answers the confirmation of pending, which matched pendingPattern
+	confirming     bool
+	pending        string
+	pendingPattern string
+	answer         []byte
+}
+
+// WriteMessage filters a message sent by the browser. It is called with the backend write lock held.
+func (f *commandFilter) WriteMessage(messageType int, msg []byte) error {
+	if len(msg) == 0 || msg[0] != terminalStdin {
+		return f.backend.WriteMessage(messageType, msg)
+	}
+
+	input := msg[1:]
+	forward := make([]byte, 1, len(msg)+1)
+	forward[0] = terminalStdin
+	for i := 0; i < len(input); i++ {
+		c := input[i]
+		if f.confirming {
+			forward = append(forward, f.answerKey(c)...)
+			continue
+		}
+
+		switch {
+		case c == '\r' || c == '\n':
+			line := string(f.line)
+			f.line = f.line[:0]
+			action, pattern := f.policy.check(line)
+			switch action {
+			case config.PolicyDeny:
+				f.hit(commandDenied, line, pattern)
+				f.notify(terminalCommandDeniedMsg)
+				forward = append(forward, terminalInterrupt)
+			case config.PolicyConfirm:
+				log.Infof("Terminal session command %q on device %s needs a confirmation, matching pattern %q", line, f.entry.Device, pattern)
+				f.notify(terminalCommandConfirmMsg)
+				f.confirming = true
+				f.pending, f.pendingPattern = line, pattern
+			default:
+				forward = append(forward, c)
+			}
+			continue
+		case c == 0x7f || c == '\b':
+			_, size := utf8.DecodeLastRune(f.line)
+			f.line = f.line[:len(f.line)-size]
+		case c == 0x03 || c == 0x15:
+			// Ctrl-C and Ctrl-U discard the line
+			f.line = f.line[:0]
+		case c == 0x17:
+			// Ctrl-W deletes the last word
+			end := len(f.line)
+			for end > 0 && f.line[end-1] == ' ' {
+				end--
+			}
+			for end > 0 && f.line[end-1] != ' ' {
+				end--
+			}
+			f.line = f.line[:end]
+		case c == 0x1b:
+			// Escape sequences are forwarded without being added to the line
+			start := i
+			if i+1 < len(input) && (input[i+1] == '[' || input[i+1] == 'O') {
+				i += 2
+				for i < len(input) && (input[i] < 0x40 || input[i] > 0x7e) {
+					i++
+				}
+			}
+			i = min(i, len(input)-1)
+			forward = append(forward, input[start:i+1]...)
+			continue
+		case c >= 0x20 && len(f.line) < maxCommandLineSize:
+			f.line = append(f.line, c)
+		}
+		forward = append(forward, c)
+	}
+
+	if len(forward) == 1 {
+		return nil
+	}
+	return f.backend.WriteMessage(messageType, forward)
+}
+
+// answerKey handles a key typed in answer to a confirmation, echoing it since the shell does not
+// see it, and returns the input to forward to the shell
+func (f *commandFilter) answerKey(c byte) []byte {
+	switch {
+	case c == '\r' || c == '\n' || c == 0x03:
+		confirmed := c != 0x03 && string(f.answer) == commandConfirmation
+		f.confirming = false
+		f.answer = f.answer[:0]
+		if confirmed {
+			f.hit(commandConfirmed, f.pending, f.pendingPattern)
+			f.notify("\r\n")
+			return []byte{'\r'}
+		}
+		f.hit(commandCancelled, f.pending, f.pendingPattern)
+		f.notify(terminalCommandCancelledMsg)
+		return []byte{terminalInterrupt}
+	case c == 0x7f || c == '\b':
+		if len(f.answer) > 0 {
+			_, size := utf8.DecodeLastRune(f.answer)
+			f.answer = f.answer[:len(f.answer)-size]
+			f.notify("\b \b")
+		}
+	case c >= 0x20 && len(f.answer) < maxCommandAnswerSize:
+		f.answer = append(f.answer, c)
+		f.notify(string([]byte{c}))
+	}
+	return nil
+}
+
+// hit logs a command line that matched the policy, with the outcome for the user
+func (f *commandFilter) hit(outcome, line, pattern string) {
+	recordCommandPolicyHit(f.entry, outcome, line, pattern)
+}
+
+// recordCommandPolicyHit logs a command line of the session described by entry that matched the
+// policy, with the outcome for the user
+func recordCommandPolicyHit(entry audit.Entry, outcome, line, pattern string) {
+	commandPolicyHits.Inc(outcome)
+	log.Warnf("Terminal session command %q of user %q on device %s matched the console policy pattern %q: %s", line, entry.Username, entry.Device, pattern, outcome)
+
+	entry.Event = audit.EventTerminalCommand
+	entry.Timestamp = time.Time{}
+	entry.DurationMs = 0
+	entry.Detail = fmt.Sprintf("%s: %q matching %q", outcome, line, pattern)
+	audit.Record(entry)
+}
@@ -0,0 +1,110 @@
+package bridge
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/flightctl/flightctl-ui/config"
+)
+
+// inputRecorder collects the input forwarded to the device console
+type inputRecorder struct {
+	input strings.Builder
+}
+
+func (r *inputRecorder) WriteMessage(_ int, msg []byte) error {
+	r.input.Write(msg[1:])
+	return nil
+}
+
+func TestNewCommandPolicy(t *testing.T) { //nolint:paralleltest // mutates package-level config
+	policies := config.TerminalCommandPolicies
+	config.TerminalCommandPolicies = map[string]config.TerminalCommandPolicy{
+		config.AllOrganizations: {Deny: []string{`^\s*reboot\b`}},
+		"org1":                  {Confirm: []string{`\brm\s+-rf\b`}},
+	}
+	t.Cleanup(func() { config.TerminalCommandPolicies = policies })
+
+	policy := newCommandPolicy("org1")
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"reboot now", config.PolicyDeny},
+		{"rm -rf /tmp/x", config.PolicyConfirm},
+		{"ls -l", ""},
+	}
+	for _, tt := range tests {
+		if got, _ := policy.check(tt.line); got != tt.want {
+			t.Errorf("check(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+	if got, _ := newCommandPolicy("org2").check("rm -rf /tmp/x"); got != "" {
+		t.Errorf("expected the patterns of org1 not to apply to org2, got %q", got)
+	}
+
+	config.TerminalCommandPolicies = map[string]config.TerminalCommandPolicy{"org1": {Deny: []string{"reboot"}}}
+	if newCommandPolicy("org2") != nil {
+		t.Error("expected no policy for an organization without patterns")
+	}
+}
+
+func TestCommandFilter(t *testing.T) {
+	t.Parallel()
+
+	newFilter := func() (*commandFilter, *inputRecorder, *strings.Builder) {
+		backend := &inputRecorder{}
+		notified := &strings.Builder{}
+		return &commandFilter{
+			policy: &commandPolicy{
+				deny:    []*regexp.Regexp{regexp.MustCompile(`^\s*reboot\b`)},
+				confirm: []*regexp.Regexp{regexp.MustCompile(`\brm\s+-rf\b`)},
+			},
+			backend: backend,
+			notify:  func(message string) { notified.WriteString(message) },
+		}, backend, notified
+	}
+	send := func(f *commandFilter, frames ...string) {
+		for _, frame := range frames {
+			if err := f.WriteMessage(2, append([]byte{terminalStdin}, frame...)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name       string
+		frames     []string
+		wantInput  string
+		wantNotice string
+	}{
+		{"allowed", []string{"l", "s", "\r"}, "ls\r", ""},
+		{"denied", []string{"r", "e", "b", "o", "o", "t", "\r", "ls\r"}, "reboot\x03ls\r", terminalCommandDeniedMsg},
+		{"denied in a paste", []string{"reboot\rls\r"}, "reboot\x03ls\r", terminalCommandDeniedMsg},
+		{"edited line", []string{"rebooz", "\x7f", "t\r"}, "rebooz\x7ft\x03", terminalCommandDeniedMsg},
+		{"killed line", []string{"reboot", "\x15", "ls\r"}, "reboot\x15ls\r", ""},
+		{"cursor keys", []string{"reboot", "\x1b[D", "\r"}, "reboot\x1b[D\x03", terminalCommandDeniedMsg},
+		{"confirmed", []string{"rm -rf /tmp/x\r", "y", "e", "s", "\r"}, "rm -rf /tmp/x\r", terminalCommandConfirmMsg + "yes\r\n"},
+		{"cancelled", []string{"rm -rf /tmp/x\r", "no\r", "ls\r"}, "rm -rf /tmp/x\x03ls\r", terminalCommandConfirmMsg + "no" + terminalCommandCancelledMsg},
+	}
+	for _, tt := range tests {
+		filter, backend, notified := newFilter()
+		send(filter, tt.frames...)
+		if got := backend.input.String(); got != tt.wantInput {
+			t.Errorf("%s: forwarded %q, want %q", tt.name, got, tt.wantInput)
+		}
+		if got := notified.String(); got != tt.wantNotice {
+			t.Errorf("%s: notified %q, want %q", tt.name, got, tt.wantNotice)
+		}
+	}
+
+	// Resizes and other channels are forwarded as is
+	filter, backend, _ := newFilter()
+	if err := filter.WriteMessage(2, []byte{terminalResize, '{', '}'}); err != nil {
+		t.Fatal(err)
+	}
+	if got := backend.input.String(); got != "{}" {
+		t.Errorf("expected the resize to be forwarded, got %q", got)
+	}
+}
@@ -0,0 +1,202 @@
+package bridge
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/audit"
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// closeSessionResumed is sent to a browser connection replaced by a resumed one
+	closeSessionResumed = 4008
+	// closeResumeFailed is sent when the session to resume has ended or cannot be resumed by the caller
+	closeResumeFailed = 4009
+	// terminalOutputLost is shown when the output missed by a resumed session no longer fits in the buffer
+	terminalOutputLost = "\r\n*** Some output was lost while disconnected ***\r\n"
+)
+
+// terminalResumeStatus is sent on the error channel when a browser attaches to a resumable session.
+// It has the shape of the status objects of the console protocol, so that clients that do not
+// support resuming ignore it as a successful status.
+type terminalResumeStatus struct {
+	Kind    string              `json:"kind"`
+	Status  string              `json:"status"`
+	Reason  string              `json:"reason"`
+	Details terminalResumeToken `json:"details"`
+}
+
+type terminalResumeToken struct {
+	// ResumeToken is sent in the resume query parameter to reattach to the session
+	ResumeToken        string `json:"resumeToken"`
+	GracePeriodSeconds int    `json:"gracePeriodSeconds"`
+	// OutputOffset counts the stdout and stderr bytes sent so far. Clients adding the bytes they
+	// receive can send it in the resume_offset query parameter to get exactly what they missed.
+	OutputOffset int64 `json:"outputOffset"`
+}
+
+// isResumableDisconnect reports whether the browser dropped without closing the session on purpose
+func (s *terminalSession) isResumableDisconnect(err error) bool {
+	if s.resumeGracePeriod <= 0 {
+		return false
+	}
+	var closeErr *websocket.CloseError
+	return !errors.As(err, &closeErr) || closeErr.Code == websocket.CloseAbnormalClosure
+}
+
+// sendResumeTokenLocked issues a new resume token to the browser. Tokens are rotated on every
+// attachment, so that a token can only be used once.
+func (s *terminalSession) sendResumeTokenLocked() {
+	if s.resumeGracePeriod <= 0 || s.frontend == nil {
+		return
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.WithError(err).Warn("Failed to generate a terminal resume token")
+		return
+	}
+	s.resumeToken = s.info.ID + "." + hex.EncodeToString(secret)
+	status, err := json.Marshal(terminalResumeStatus{
+		Kind:   "Status",
+		Status: "Success",
+		Reason: "SessionResumable",
+		Details: terminalResumeToken{
+			ResumeToken:        s.resumeToken,
+			GracePeriodSeconds: int(s.resumeGracePeriod.Seconds()),
+			OutputOffset:       s.output.total,
+		},
+	})
+	if err != nil {
+		return
+	}
+	_ = s.writeFrontendLocked(websocket.BinaryMessage, append([]byte{terminalError}, status...))
+}
+
+// sendResumeToken issues the first resume token of the session
+func (s *terminalSession) sendResumeToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendResumeTokenLocked()
+}
+
+// detach keeps the session open without a browser, buffering the output it misses
+func (s *terminalSession) detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.frontend != nil {
+		s.frontend.Close()
+	}
+	s.frontend = nil
+	s.detachedAt = s.output.total
+}
+
+// resume attaches a browser connection to the session, replacing the current one if the proxy has
+// not noticed yet that it dropped. The output since offset is replayed; a negative offset replays
+// the output since the previous connection dropped.
+func (s *terminalSession) resume(conn *websocket.Conn, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if offset < 0 {
+		offset = s.detachedAt
+		if s.frontend != nil {
+			offset = s.output.total
+		}
+	}
+	if s.frontend != nil {
+		_ = s.frontend.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeSessionResumed, "Session resumed from another connection"), time.Now().Add(websocketTimeout))
+		s.frontend.Close()
+	}
+	s.frontend = conn
+
+	missed, complete := s.output.since(offset)
+	if !complete {
+		missed = append([]byte(terminalOutputLost), missed...)
+	}
+	if len(missed) > 0 {
+		if err := s.writeFrontendLocked(websocket.BinaryMessage, append([]byte{terminalStdout}, missed...)); err != nil {
+			s.frontend.Close()
+			return
+		}
+	}
+	s.sendResumeTokenLocked()
+}
+
+// consumeResumeToken reports whether token resumes this session, and invalidates it so that the
+// session cannot be resumed twice with the same token
+func (s *terminalSession) consumeResumeToken(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resumeToken == "" || subtle.ConstantTimeCompare([]byte(s.resumeToken), []byte(token)) != 1 {
+		return false
+	}
+	s.resumeToken = ""
+	return true
+}
+
+// resumeTerminal attaches the browser to the session identified by the resume token. Only the user
+// who opened the session can resume it, on the same instance, organization and device.
+func resumeTerminal(w http.ResponseWriter, r *http.Request, deviceId, token string) {
+	offset := int64(-1)
+	if value := r.URL.Query().Get("resume_offset"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			rejectWebsocket(w, r, websocket.ClosePolicyViolation, "Invalid resume offset")
+			return
+		}
+		offset = parsed
+	}
+
+	sessionID, _, _ := strings.Cut(token, ".")
+	session := terminalSessions.get(sessionID)
+	identity, _ := common.UserIdentityFromContext(r.Context())
+	if session == nil ||
+		session.info.Username != identity.Username ||
+		session.info.Instance != common.InstanceFromContext(r.Context()).Name ||
+		session.info.Organization != r.URL.Query().Get("org_id") ||
+		session.info.Device != deviceId ||
+		!session.consumeResumeToken(token) {
+		log.Warnf("Rejected the resume of a terminal session for device %s", deviceId)
+		rejectWebsocket(w, r, closeResumeFailed, "The terminal session can no longer be resumed")
+		return
+	}
+
+	upgrader := &websocket.Upgrader{
+		Subprotocols: websocket.Subprotocols(r),
+		CheckOrigin:  checkOrigin,
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warnf("Failed to upgrade websocket to client: '%v'", err)
+		return
+	}
+
+	select {
+	case session.attach <- &terminalAttachment{conn: conn, offset: offset}:
+	case <-session.done:
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeResumeFailed, "The terminal session has ended"), time.Now().Add(websocketTimeout))
+		conn.Close()
+		return
+	}
+
+	entry := terminalAuditEntry(r, deviceId)
+	entry.Event = audit.EventTerminalResume
+	entry.Detail = "session " + session.info.ID
+	audit.Record(entry)
+	log.Infof("Resumed terminal session %s for device: %s", session.info.ID, deviceId)
+}
+
+// terminalAttachment is a browser connection resuming a session from offset
+type terminalAttachment struct {
+	conn   *websocket.Conn
+	offset int64
+}
@@ -0,0 +1,110 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readResumeToken reads the messages of the terminal until it receives a resume token
+func readResumeToken(t *testing.T, conn *websocket.Conn) terminalResumeToken {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("expected a resume token: %v", err)
+		}
+		var status terminalResumeStatus
+		if msg[0] == terminalError && json.Unmarshal(msg[1:], &status) == nil && status.Reason == "SessionResumable" {
+			return status.Details
+		}
+	}
+}
+
+func TestResumeTerminalSession(t *testing.T) { //nolint:paralleltest // uses the package-level session registry
+	backendClosed := make(chan int, 1)
+	proxy := newTestConsole(t, backendClosed, time.Second)
+	baseURL := "ws" + strings.TrimPrefix(proxy.URL, "http") + "/api/terminal/dev1?org_id=org1"
+
+	conn, _, err := websocket.DefaultDialer.Dial(baseURL, nil)
+	if err != nil {
+		t.Fatalf("failed to open the terminal: %v", err)
+	}
+	token := readResumeToken(t, conn)
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("\x00one\r")); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "one\r")
+
+	// The network drops without a close frame
+	conn.NetConn().Close()
+	waitForDetach := func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !terminalSessions.get(strings.Split(token.ResumeToken, ".")[0]).isFrontend(nil) {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the browser to be detached from the session")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForDetach()
+
+	resumeURL := func(token string, offset string) string {
+		query := url.Values{"resume": {token}}
+		if offset != "" {
+			query.Set("resume_offset", offset)
+		}
+		return baseURL + "&" + query.Encode()
+	}
+	resumed, _, err := websocket.DefaultDialer.Dial(resumeURL(token.ResumeToken, "0"), nil)
+	if err != nil {
+		t.Fatalf("failed to resume the terminal: %v", err)
+	}
+	defer resumed.Close()
+	// The output is replayed from the requested offset, and a new token is issued
+	readUntil(t, resumed, "one\r")
+	newToken := readResumeToken(t, resumed)
+	if newToken.ResumeToken == token.ResumeToken || newToken.OutputOffset != int64(len("one\r")) {
+		t.Errorf("unexpected token after resuming: %+v", newToken)
+	}
+	if err := resumed.WriteMessage(websocket.BinaryMessage, []byte("\x00two\r")); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, resumed, "two\r")
+
+	// Tokens can only be used once
+	reused, _, err := websocket.DefaultDialer.Dial(resumeURL(token.ResumeToken, ""), nil)
+	if err != nil {
+		t.Fatalf("expected the connection to be upgraded before being closed: %v", err)
+	}
+	_, _, err = reused.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != closeResumeFailed {
+		t.Errorf("expected close code %d for a reused token, got %v", closeResumeFailed, err)
+	}
+	reused.Close()
+
+	// Both ends are closed when the session is not resumed within the grace period
+	resumed.NetConn().Close()
+	select {
+	case code := <-backendClosed:
+		if code != websocket.CloseNormalClosure {
+			t.Errorf("expected a normal closure on the device end, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the device console to be closed after the grace period")
+	}
+	if terminalSessions.get(strings.Split(token.ResumeToken, ".")[0]) != nil {
+		time.Sleep(100 * time.Millisecond)
+		if terminalSessions.get(strings.Split(token.ResumeToken, ".")[0]) != nil {
+			t.Error("expected the session to be unregistered")
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/audit"
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// closeTerminatedByAdmin is sent to the browser when an administrator ends the session
+const closeTerminatedByAdmin = 4006
+
+// TerminalSessionInfo describes an open terminal session
+type TerminalSessionInfo struct {
+	ID           string    `json:"id"`
+	Username     string    `json:"username,omitempty"`
+	Provider     string    `json:"provider,omitempty"`
+	Instance     string    `json:"instance,omitempty"`
+	Organization string    `json:"organization,omitempty"`
+	Device       string    `json:"device"`
+	ClientIP     string    `json:"clientIp,omitempty"`
+	StartedAt    time.Time `json:"startedAt"`
+	// BytesIn are received from the browser, and BytesOut sent to it
+	BytesIn      int64     `json:"bytesIn"`
+	BytesOut     int64     `json:"bytesOut"`
+	LastActivity time.Time `json:"lastActivity"`
+	// Observers are the usernames of the users following the session
+	Observers []string `json:"observers"`
+}
+
+// terminalSession tracks the activity of an open session, and lets administrators terminate it
+type terminalSession struct {
+	info         TerminalSessionInfo
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	lastActivity atomic.Int64
+	// terminate receives the username of the administrator ending the session
+	terminate chan string
+	// attach receives the browser connections resuming the session
+	attach chan *terminalAttachment
+	done   chan struct{}
+
+	mu        sync.Mutex
+	output    *outputRing
+	observers map[*terminalObserver]struct{}
+	ended     bool
+	// frontend is the browser connection, nil while the browser is disconnected
+	frontend *websocket.Conn
+	// detachedAt is the output offset at which the browser disconnected
+	detachedAt  int64
+	resumeToken string
+	// resumeGracePeriod is how long the session waits for the browser to resume it, zero when it cannot be resumed
+	resumeGracePeriod time.Duration
+}
+
+func newTerminalSession(info TerminalSessionInfo, frontend *websocket.Conn) *terminalSession {
+	s := &terminalSession{
+		info:      info,
+		terminate: make(chan string, 1),
+		attach:    make(chan *terminalAttachment),
+		done:      make(chan struct{}),
+		output:    newOutputRing(max(observerCatchUpSize, config.TerminalResumeBufferKB*1024)),
+		observers: map[*terminalObserver]struct{}{},
+		frontend:  frontend,
+	}
+	s.lastActivity.Store(info.StartedAt.UnixNano())
+	return s
+}
+
+func (s *terminalSession) received(n int) {
+	s.bytesIn.Add(int64(n))
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (s *terminalSession) sent(n int) {
+	s.bytesOut.Add(int64(n))
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (s *terminalSession) snapshot() TerminalSessionInfo {
+	info := s.info
+	info.BytesIn = s.bytesIn.Load()
+	info.BytesOut = s.bytesOut.Load()
+	info.LastActivity = time.Unix(0, s.lastActivity.Load())
+	s.mu.Lock()
+	info.Observers = make([]string, 0, len(s.observers))
+	for o := range s.observers {
+		info.Observers = append(info.Observers, o.username)
+	}
+	s.mu.Unlock()
+	sort.Strings(info.Observers)
+	return info
+}
+
+// WriteMessage forwards a message of the device console to the browser and the observers. Failing
+// to write to the browser disconnects it, without ending the session.
+func (s *terminalSession) WriteMessage(messageType int, msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.broadcastLocked(msg)
+	if s.frontend != nil {
+		if err := s.writeFrontendLocked(messageType, msg); err != nil {
+			s.frontend.Close()
+		}
+	}
+	return nil
+}
+
+// writeFrontend writes a message to the browser, if it is connected
+func (s *terminalSession) writeFrontend(messageType int, msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.frontend == nil {
+		return nil
+	}
+	return s.writeFrontendLocked(messageType, msg)
+}
+
+func (s *terminalSession) writeFrontendLocked(messageType int, msg []byte) error {
+	_ = s.frontend.SetWriteDeadline(time.Now().Add(websocketTimeout))
+	return s.frontend.WriteMessage(messageType, msg)
+}
+
+// pingFrontend keeps the browser connection open through load balancers and other middlemen
+func (s *terminalSession) pingFrontend() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.frontend != nil {
+		_ = s.frontend.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(websocketTimeout))
+	}
+}
+
+// isFrontend reports whether conn is the current browser connection
+func (s *terminalSession) isFrontend(conn *websocket.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.frontend == conn
+}
+
+// closeFrontend closes the browser connection, first sending a close frame when closeCode is set
+func (s *terminalSession) closeFrontend(closeCode int, closeReason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.frontend == nil {
+		return
+	}
+	if closeCode != 0 {
+		_ = s.frontend.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, closeReason), time.Now().Add(websocketTimeout))
+	}
+	s.frontend.Close()
+	s.frontend = nil
+}
+
+// terminalSessionRegistry holds the sessions open through the proxy, for all instances
+type terminalSessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*terminalSession
+}
+
+var terminalSessions = &terminalSessionRegistry{sessions: map[string]*terminalSession{}}
+
+func (r *terminalSessionRegistry) add(s *terminalSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.info.ID] = s
+}
+
+// remove unregisters the session once it has ended, and disconnects its observers
+func (r *terminalSessionRegistry) remove(s *terminalSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, s.info.ID)
+	s.endObservers()
+	close(s.done)
+}
+
+func (r *terminalSessionRegistry) get(id string) *terminalSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+// list returns the open sessions, oldest first
+func (r *terminalSessionRegistry) list() []TerminalSessionInfo {
+	r.mu.Lock()
+	infos := make([]TerminalSessionInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		infos = append(infos, s.snapshot())
+	}
+	r.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].StartedAt.Before(infos[j].StartedAt) })
+	return infos
+}
+
+func writeTerminalSessionError(w http.ResponseWriter, status int, message, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message, "code": code})
+}
+
+// sessionInScope tells whether the administrator of the request may manage the session. Only the
+// global administrators reach the sessions of the other instances.
+func sessionInScope(r *http.Request, info TerminalSessionInfo) bool {
+	identity, _ := common.UserIdentityFromContext(r.Context())
+	return info.Instance == common.InstanceFromContext(r.Context()).Name ||
+		config.IsGlobalAdminUser(identity.Provider, identity.Username)
+}
+
+// ListTerminalSessions returns the open terminal sessions of the instance, or of all the instances for
+// the global administrators. They can be filtered with the device, user, org and instance query
+// parameters.
+func ListTerminalSessions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	matches := func(filter, value string) bool {
+		return query.Get(filter) == "" || query.Get(filter) == value
+	}
+	filtered := []TerminalSessionInfo{}
+	for _, info := range terminalSessions.list() {
+		if sessionInScope(r, info) && matches("device", info.Device) && matches("user", info.Username) &&
+			matches("org", info.Organization) && matches("instance", info.Instance) {
+			filtered = append(filtered, info)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(filtered)
+}
+
+// TerminateTerminalSession closes a terminal session on both the browser and the device ends,
+// and waits for it to end
+func TerminateTerminalSession(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	session := terminalSessions.get(id)
+	if session == nil || !sessionInScope(r, session.snapshot()) {
+		writeTerminalSessionError(w, http.StatusNotFound, "Terminal session not found", "TERMINAL_SESSION_NOT_FOUND")
+		return
+	}
+
+	identity, _ := common.UserIdentityFromContext(r.Context())
+	info := session.snapshot()
+	entry := audit.Entry{
+		Event:        audit.EventTerminalTerminate,
+		RequestID:    r.Header.Get(common.RequestIDHeader),
+		Username:     identity.Username,
+		Provider:     identity.Provider,
+		Instance:     info.Instance,
+		Organization: info.Organization,
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		Device:       info.Device,
+		Detail:       "session " + info.ID + " of user " + info.Username,
+	}
+	if ip := config.ClientIP(r); ip != nil {
+		entry.ClientIP = ip.String()
+	}
+
+	select {
+	case session.terminate <- identity.Username:
+	default:
+		// The session is already being terminated
+	}
+	select {
+	case <-session.done:
+		entry.Status = http.StatusNoContent
+		audit.Record(entry)
+		w.WriteHeader(http.StatusNoContent)
+	case <-time.After(websocketTimeout):
+		entry.Status = http.StatusAccepted
+		audit.Record(entry)
+		w.WriteHeader(http.StatusAccepted)
+	case <-r.Context().Done():
+		entry.Status = http.StatusAccepted
+		audit.Record(entry)
+	}
+}
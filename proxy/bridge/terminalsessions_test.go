@@ -0,0 +1,134 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// newTestConsole starts a device console that echoes stdin on stdout, and a proxy in front of it
+// keeping its sessions resumable for resumeGracePeriod
+func newTestConsole(t *testing.T, backendClosed chan<- int, resumeGracePeriod time.Duration) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{Subprotocols: []string{"v5.channel.k8s.io"}}
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) && backendClosed != nil {
+					backendClosed <- closeErr.Code
+				}
+				return
+			}
+			if len(msg) > 0 && msg[0] == terminalStdin {
+				msg[0] = terminalStdout
+				if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+					return
+				}
+			}
+		}
+	}))
+	t.Cleanup(backend.Close)
+
+	instance := config.Instance{Name: "default", ApiUrl: backend.URL}
+	bridge := TerminalBridge{TlsConfig: &tls.Config{InsecureSkipVerify: true}, ResumeGracePeriod: resumeGracePeriod} //nolint:gosec // test server certificate
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := common.WithInstance(r.Context(), instance)
+		ctx = common.WithUserIdentity(ctx, common.UserIdentity{Username: "alice"})
+		bridge.HandleTerminal(w, r.WithContext(ctx))
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestTerminateTerminalSession(t *testing.T) { //nolint:paralleltest // uses the package-level session registry
+	backendClosed := make(chan int, 1)
+	proxy := newTestConsole(t, backendClosed, 0)
+
+	wsURL := "ws" + strings.TrimPrefix(proxy.URL, "http") + "/api/terminal/dev1?org_id=org1"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("failed to open the terminal: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("\x00ls\r")); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "ls\r")
+
+	rec := httptest.NewRecorder()
+	ListTerminalSessions(rec, httptest.NewRequest(http.MethodGet, "/api/admin/terminal-sessions?device=dev1", nil))
+	var sessions []TerminalSessionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil {
+		t.Fatalf("invalid list response: %v", err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("expected one open session, got %+v", sessions)
+	}
+	session := sessions[0]
+	if session.Username != "alice" || session.Organization != "org1" || session.BytesIn != 4 || session.BytesOut != 4 {
+		t.Errorf("unexpected session: %+v", session)
+	}
+
+	// The administrators of another instance neither see nor terminate the session
+	otherInstance := func(req *http.Request) *http.Request {
+		return req.WithContext(common.WithInstance(req.Context(), config.Instance{Name: "eu"}))
+	}
+	rec = httptest.NewRecorder()
+	ListTerminalSessions(rec, otherInstance(httptest.NewRequest(http.MethodGet, "/api/admin/terminal-sessions", nil)))
+	if strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("expected no session for another instance, got %s", rec.Body.String())
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/admin/terminal-sessions/{id}", TerminateTerminalSession)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, otherInstance(httptest.NewRequest(http.MethodDelete, "/api/admin/terminal-sessions/"+session.ID, nil)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for the session of another instance, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/admin/terminal-sessions/"+session.ID, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != closeTerminatedByAdmin {
+		t.Errorf("expected the browser to receive close code %d, got %v", closeTerminatedByAdmin, err)
+	}
+	select {
+	case code := <-backendClosed:
+		if code != websocket.CloseNormalClosure {
+			t.Errorf("expected a normal closure on the device end, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the device end to receive a close frame")
+	}
+	if len(terminalSessions.list()) != 0 {
+		t.Error("expected the session to be unregistered")
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/admin/terminal-sessions/"+session.ID, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an ended session, got %d", rec.Code)
+	}
+}
@@ -1,6 +1,7 @@
 package bridge
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -9,8 +10,9 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"time"
 
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
 	"github.com/flightctl/flightctl-ui/log"
 )
 
@@ -48,12 +50,14 @@ type oidcDiscoveryDocument struct {
 }
 
 type TestAuthHandler struct {
-	tlsConfig *tls.Config
+	tlsConfig  *tls.Config
+	httpClient *http.Client
 }
 
 func NewTestAuthHandler(tlsConfig *tls.Config) *TestAuthHandler {
 	return &TestAuthHandler{
-		tlsConfig: tlsConfig,
+		tlsConfig:  tlsConfig,
+		httpClient: NewOutboundClient(tlsConfig),
 	}
 }
 
@@ -73,17 +77,13 @@ func (h *TestAuthHandler) TestConnection(w http.ResponseWriter, r *http.Request)
 		Results: make([]FieldValidationResult, 0),
 	}
 
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: h.tlsConfig,
-		},
-		Timeout: 10 * time.Second,
-	}
+	identity, _ := common.UserIdentityFromContext(r.Context())
+	ctx := WithOutboundSession(r.Context(), identity.Username)
 
 	if req.ProviderType == "oidc" {
-		h.validateOIDCProvider(&req, &response, httpClient)
+		h.validateOIDCProvider(ctx, &req, &response, h.httpClient)
 	} else if req.ProviderType == "oauth2" {
-		h.validateOAuth2Provider(&req, &response, httpClient)
+		h.validateOAuth2Provider(ctx, &req, &response, h.httpClient)
 	} else {
 		http.Error(w, "Invalid provider type", http.StatusBadRequest)
 		return
@@ -93,7 +93,7 @@ func (h *TestAuthHandler) TestConnection(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(response)
 }
 
-func (h *TestAuthHandler) validateOIDCProvider(req *TestConnectionRequest, response *TestConnectionResponse, httpClient *http.Client) {
+func (h *TestAuthHandler) validateOIDCProvider(ctx context.Context, req *TestConnectionRequest, response *TestConnectionResponse, httpClient *http.Client) {
 	if req.Issuer == "" {
 		response.Results = append(response.Results, FieldValidationResult{
 			Field: "issuer",
@@ -105,7 +105,7 @@ func (h *TestAuthHandler) validateOIDCProvider(req *TestConnectionRequest, respo
 	}
 
 	// Minimal SSRF protection for issuer URL
-	if err := validateURLForSSRF(req.Issuer); err != nil {
+	if err := validateOutboundURL(ctx, req.Issuer); err != nil {
 		response.Results = append(response.Results, FieldValidationResult{
 			Field: "issuer",
 			Valid: false,
@@ -128,7 +128,7 @@ func (h *TestAuthHandler) validateOIDCProvider(req *TestConnectionRequest, respo
 
 	// Fetch OIDC discovery document
 	discoveryURL := issuerURL.JoinPath(".well-known", "openid-configuration").String()
-	httpReq, err := makeSafeHTTPRequest(http.MethodGet, discoveryURL)
+	httpReq, err := makeSafeHTTPRequest(ctx, http.MethodGet, discoveryURL)
 	if err != nil {
 		response.Results = append(response.Results, FieldValidationResult{
 			Field: "issuer",
@@ -141,11 +141,15 @@ func (h *TestAuthHandler) validateOIDCProvider(req *TestConnectionRequest, respo
 
 	resp, err := httpClient.Do(httpReq)
 	if err != nil {
+		note := fmt.Sprintf("Failed to fetch OIDC discovery document: %v", err)
+		if isBlockedDestination(err) {
+			note = fmt.Sprintf("Issuer URL cannot be validated with this utility: %v", err)
+		}
 		response.Results = append(response.Results, FieldValidationResult{
 			Field: "issuer",
 			Valid: false,
 			Value: req.Issuer,
-			Notes: []string{fmt.Sprintf("Failed to fetch OIDC discovery document: %v", err)},
+			Notes: appendAllowlistNote(ctx, "Issuer URL", []string{note}),
 		})
 		return
 	}
@@ -156,7 +160,7 @@ func (h *TestAuthHandler) validateOIDCProvider(req *TestConnectionRequest, respo
 			Field: "issuer",
 			Valid: false,
 			Value: req.Issuer,
-			Notes: []string{fmt.Sprintf("OIDC discovery endpoint returned status %d", resp.StatusCode)},
+			Notes: appendAllowlistNote(ctx, "Issuer URL", []string{fmt.Sprintf("OIDC discovery endpoint returned status %d", resp.StatusCode)}),
 		})
 		return
 	}
@@ -209,6 +213,7 @@ func (h *TestAuthHandler) validateOIDCProvider(req *TestConnectionRequest, respo
 	if !hasErrors && len(issuerNotes) == 0 {
 		issuerNotes = append(issuerNotes, "Successfully discovered OIDC configuration from .well-known/openid_configuration")
 	}
+	issuerNotes = appendAllowlistNote(ctx, "Issuer URL", issuerNotes)
 
 	// For OIDC: issuer first, then the rest
 	response.Results = append(response.Results, FieldValidationResult{
@@ -218,10 +223,10 @@ func (h *TestAuthHandler) validateOIDCProvider(req *TestConnectionRequest, respo
 		Notes: issuerNotes,
 	})
 
-	// Verify the discovered endpoints are reachable
-	// Skip SSRF validation since these come from the validated issuer
+	// Verify the discovered endpoints are reachable.
+	// The discovery document is user-controlled too, so these go through the same SSRF checks.
 	if discovery.AuthorizationEndpoint != "" {
-		validation := h.checkEndpointReachability(discovery.AuthorizationEndpoint, "Authorization endpoint", httpClient, false)
+		validation := h.checkEndpointReachability(ctx, discovery.AuthorizationEndpoint, "Authorization endpoint", httpClient, false)
 		response.Results = append(response.Results, FieldValidationResult{
 			Field: "authorizationUrl",
 			Valid: validation.Valid,
@@ -231,7 +236,7 @@ func (h *TestAuthHandler) validateOIDCProvider(req *TestConnectionRequest, respo
 	}
 
 	if discovery.TokenEndpoint != "" {
-		validation := h.checkEndpointReachability(discovery.TokenEndpoint, "Token endpoint", httpClient, true)
+		validation := h.checkEndpointReachability(ctx, discovery.TokenEndpoint, "Token endpoint", httpClient, true)
 		response.Results = append(response.Results, FieldValidationResult{
 			Field: "tokenUrl",
 			Valid: validation.Valid,
@@ -241,7 +246,7 @@ func (h *TestAuthHandler) validateOIDCProvider(req *TestConnectionRequest, respo
 	}
 
 	if discovery.UserinfoEndpoint != "" {
-		validation := h.checkEndpointReachability(discovery.UserinfoEndpoint, "Userinfo endpoint", httpClient, false)
+		validation := h.checkEndpointReachability(ctx, discovery.UserinfoEndpoint, "Userinfo endpoint", httpClient, false)
 		response.Results = append(response.Results, FieldValidationResult{
 			Field: "userinfoUrl",
 			Valid: validation.Valid,
@@ -251,10 +256,10 @@ func (h *TestAuthHandler) validateOIDCProvider(req *TestConnectionRequest, respo
 	}
 }
 
-func (h *TestAuthHandler) validateOAuth2Provider(req *TestConnectionRequest, response *TestConnectionResponse, httpClient *http.Client) {
+func (h *TestAuthHandler) validateOAuth2Provider(ctx context.Context, req *TestConnectionRequest, response *TestConnectionResponse, httpClient *http.Client) {
 	// For OAuth2: other fields first, then issuer last
 	if req.AuthorizationUrl != "" {
-		validation := h.checkEndpointReachability(req.AuthorizationUrl, "Authorization URL", httpClient, false)
+		validation := h.checkEndpointReachability(ctx, req.AuthorizationUrl, "Authorization URL", httpClient, false)
 		response.Results = append(response.Results, FieldValidationResult{
 			Field: "authorizationUrl",
 			Valid: validation.Valid,
@@ -271,7 +276,7 @@ func (h *TestAuthHandler) validateOAuth2Provider(req *TestConnectionRequest, res
 	}
 
 	if req.TokenUrl != "" {
-		validation := h.checkEndpointReachability(req.TokenUrl, "Token URL", httpClient, true)
+		validation := h.checkEndpointReachability(ctx, req.TokenUrl, "Token URL", httpClient, true)
 		response.Results = append(response.Results, FieldValidationResult{
 			Field: "tokenUrl",
 			Valid: validation.Valid,
@@ -288,7 +293,7 @@ func (h *TestAuthHandler) validateOAuth2Provider(req *TestConnectionRequest, res
 	}
 
 	if req.UserinfoUrl != "" {
-		validation := h.checkEndpointReachability(req.UserinfoUrl, "Userinfo URL", httpClient, false)
+		validation := h.checkEndpointReachability(ctx, req.UserinfoUrl, "Userinfo URL", httpClient, false)
 		response.Results = append(response.Results, FieldValidationResult{
 			Field: "userinfoUrl",
 			Valid: validation.Valid,
@@ -306,7 +311,7 @@ func (h *TestAuthHandler) validateOAuth2Provider(req *TestConnectionRequest, res
 
 	// Validate issuer if provided (optional for OAuth2) - add last
 	if req.Issuer != "" {
-		validation := h.checkEndpointReachability(req.Issuer, "Issuer URL", httpClient, false)
+		validation := h.checkEndpointReachability(ctx, req.Issuer, "Issuer URL", httpClient, false)
 		response.Results = append(response.Results, FieldValidationResult{
 			Field: "issuer",
 			Valid: validation.Valid,
@@ -316,18 +321,8 @@ func (h *TestAuthHandler) validateOAuth2Provider(req *TestConnectionRequest, res
 	}
 }
 
-// isPrivateIP checks if an IP address is in a private/local range
-func isPrivateIP(ip net.IP) bool {
-	if ip == nil {
-		return false
-	}
-	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
-		return true
-	}
-	return ip.IsPrivate()
-}
-
-// validateURLForSSRF performs minimal SSRF protection by blocking localhost and private IPs
+// validateURLForSSRF performs a static check of the URL, blocking localhost and private IP literals.
+// Hostnames are checked again against their resolved addresses when the connection is made (see outboundDialer).
 func validateURLForSSRF(rawURL string) error {
 	parsed, err := url.Parse(rawURL)
 	if err != nil {
@@ -346,14 +341,14 @@ func validateURLForSSRF(rawURL string) error {
 
 	// Check for localhost hostnames
 	hostLower := strings.ToLower(host)
-	if hostLower == "localhost" || strings.HasSuffix(hostLower, ".localhost") {
-		return fmt.Errorf("localhost URLs are not allowed")
+	if (hostLower == "localhost" || strings.HasSuffix(hostLower, ".localhost")) && !config.IsOutboundPrivateHostAllowed(hostLower) {
+		return &blockedDestinationError{host: host}
 	}
 
 	// Parse IP address if host is an IP
 	if ip := net.ParseIP(host); ip != nil {
-		if isPrivateIP(ip) {
-			return fmt.Errorf("private IP addresses are not allowed")
+		if isBlockedIP(ip) && !isAllowlistedPrivateDestination(host, ip) {
+			return &blockedDestinationError{host: host, ip: ip}
 		}
 	}
 
@@ -362,9 +357,9 @@ func validateURLForSSRF(rawURL string) error {
 
 // makeSafeHTTPRequest creates an HTTP request with explicit SSRF validation
 // This function validates the URL and reconstructs it from validated components
-func makeSafeHTTPRequest(method, urlStr string) (*http.Request, error) {
+func makeSafeHTTPRequest(ctx context.Context, method, urlStr string) (*http.Request, error) {
 	// Validate URL for SSRF (checks scheme, hostname, localhost, private IPs)
-	if err := validateURLForSSRF(urlStr); err != nil {
+	if err := validateOutboundURL(ctx, urlStr); err != nil {
 		return nil, fmt.Errorf("URL failed SSRF validation: %w", err)
 	}
 
@@ -406,11 +401,20 @@ func makeSafeHTTPRequest(method, urlStr string) (*http.Request, error) {
 		return nil, fmt.Errorf("reconstructed URL failed SSRF validation: %w", err)
 	}
 
-	return http.NewRequest(method, safeURLStr, nil)
+	return http.NewRequestWithContext(ctx, method, safeURLStr, nil)
 }
 
-func (h *TestAuthHandler) checkEndpointReachability(urlStr string, fieldName string, httpClient *http.Client, isTokenEndpoint bool) FieldValidation {
-	req, err := makeSafeHTTPRequest(http.MethodGet, urlStr)
+// appendAllowlistNote adds a note when the check reached a private destination through the allowlist
+func appendAllowlistNote(ctx context.Context, fieldName string, notes []string) []string {
+	destinations := outboundSessionFromContext(ctx).takePrivateDestinations()
+	if len(destinations) == 0 {
+		return notes
+	}
+	return append(notes, fmt.Sprintf("%s was checked under the private destination allowlist: %s", fieldName, strings.Join(destinations, ", ")))
+}
+
+func (h *TestAuthHandler) checkEndpointReachability(ctx context.Context, urlStr string, fieldName string, httpClient *http.Client, isTokenEndpoint bool) FieldValidation {
+	req, err := makeSafeHTTPRequest(ctx, http.MethodGet, urlStr)
 	if err != nil {
 		return FieldValidation{
 			Valid: false,
@@ -422,10 +426,14 @@ func (h *TestAuthHandler) checkEndpointReachability(urlStr string, fieldName str
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		log.GetLogger().Warnf("Endpoint test failed for %s: %v", urlStr, err)
+		note := fmt.Sprintf("%s is not reachable: %v", fieldName, err)
+		if isBlockedDestination(err) {
+			note = fmt.Sprintf("%s cannot be validated with this utility: %v", fieldName, err)
+		}
 		return FieldValidation{
 			Valid: false,
 			Value: urlStr,
-			Notes: []string{fmt.Sprintf("%s is not reachable: %v", fieldName, err)},
+			Notes: appendAllowlistNote(ctx, fieldName, []string{note}),
 		}
 	}
 	defer resp.Body.Close()
@@ -467,6 +475,6 @@ func (h *TestAuthHandler) checkEndpointReachability(urlStr string, fieldName str
 	return FieldValidation{
 		Valid: valid,
 		Value: urlStr,
-		Notes: notes,
+		Notes: appendAllowlistNote(ctx, fieldName, notes),
 	}
 }
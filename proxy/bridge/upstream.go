@@ -0,0 +1,323 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/log"
+	"github.com/flightctl/flightctl-ui/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// Upstreams, named after the variables that configure their URL
+const (
+	upstreamFlightCtl    = "FLIGHTCTL_SERVER"
+	upstreamImageBuilder = "FLIGHTCTL_IMAGEBUILDER_SERVER"
+	upstreamAlertManager = "FLIGHTCTL_ALERTMANAGER_PROXY"
+	upstreamCliArtifacts = "FLIGHTCTL_CLI_ARTIFACTS_SERVER"
+)
+
+const upstreamRetryBaseDelay = 100 * time.Millisecond
+
+// circuitOpenError is returned without contacting the upstream while its circuit breaker is open
+type circuitOpenError struct {
+	upstream   string
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("upstream %s is unavailable", e.upstream)
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker stops sending requests to an upstream after threshold consecutive failures.
+// Once the cooldown has passed, a single probe request is let through: its success closes the
+// circuit again, and its failure re-opens it for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	upstream  string
+	threshold int
+	cooldown  time.Duration
+	state     circuitState
+	failures  int
+	openedAt  time.Time
+	now       func() time.Time
+}
+
+func newCircuitBreaker(upstream string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{upstream: upstream, threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow returns an error when the request must not be sent to the upstream
+func (b *circuitBreaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		elapsed := b.now().Sub(b.openedAt)
+		if elapsed < b.cooldown {
+			return &circuitOpenError{upstream: b.upstream, retryAfter: b.cooldown - elapsed}
+		}
+		b.state = circuitHalfOpen
+		return nil
+	case circuitHalfOpen:
+		// A probe is already in flight
+		return &circuitOpenError{upstream: b.upstream, retryAfter: time.Second}
+	}
+	return nil
+}
+
+func (b *circuitBreaker) recordSuccess() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != circuitClosed {
+		log.GetLogger().Infof("Upstream %s is available again, closing its circuit breaker", b.upstream)
+	}
+	b.state = circuitClosed
+	b.failures = 0
+}
+
+// releaseProbe lets the next request probe the upstream when the probe in flight ended without a verdict
+func (b *circuitBreaker) releaseProbe() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen {
+		b.state = circuitOpen
+		b.openedAt = b.now().Add(-b.cooldown)
+	}
+}
+
+func (b *circuitBreaker) recordFailure() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= b.threshold) {
+		log.GetLogger().Warnf("Upstream %s failed %d times in a row, opening its circuit breaker for %s", b.upstream, b.failures, b.cooldown)
+		b.state = circuitOpen
+		b.openedAt = b.now()
+	}
+}
+
+// upstreamTransport sends requests to an upstream API. Idempotent requests without a body are
+// retried with jittered backoff on connection errors and 502/503 responses, and a circuit breaker
+// fails requests fast while the upstream is down.
+type upstreamTransport struct {
+	name       string
+	base       http.RoundTripper
+	maxRetries int
+	breaker    *circuitBreaker
+	sleep      func(ctx context.Context, d time.Duration) error
+}
+
+func newUpstreamTransport(instance config.Instance, upstream string, tlsConfig *tls.Config) *upstreamTransport {
+	timeouts := config.GetUpstreamTimeouts(upstream)
+	// Every instance has its own breaker, so that one region being down does not affect the others
+	name := upstream
+	if !instance.IsDefault() {
+		name = instance.Name + "/" + upstream
+	}
+	base := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   timeouts.Connect,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &upstreamTransport{
+		name:       name,
+		base:       base,
+		maxRetries: config.UpstreamMaxRetries,
+		breaker:    newCircuitBreaker(name, config.UpstreamCircuitBreakerThreshold, config.UpstreamCircuitBreakerCooldown),
+		sleep:      sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryDelay returns a random delay up to an exponentially growing bound ("full jitter")
+func retryDelay(attempt int) time.Duration {
+	bound := float64(upstreamRetryBaseDelay) * math.Pow(2, float64(attempt))
+	return time.Duration(rand.Int64N(int64(bound)) + 1)
+}
+
+func isRetryableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	// Upgraded connections (e.g. WebSockets) cannot be replayed
+	return req.Header.Get("Upgrade") == ""
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable
+}
+
+// isConnectionError reports whether err happened while establishing or using the connection,
+// before the upstream could have produced a response. Timeouts are not retried, since a slow
+// upstream would only keep the client waiting longer.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	retryable := isRetryableRequest(req)
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if req.Context().Err() != nil {
+			// The client went away, which says nothing about the upstream health
+			t.breaker.releaseProbe()
+			return resp, err
+		}
+
+		failed := err != nil || isRetryableStatus(resp.StatusCode) || resp.StatusCode == http.StatusGatewayTimeout
+		canRetry := retryable && attempt < t.maxRetries &&
+			((err != nil && isConnectionError(err)) || (err == nil && isRetryableStatus(resp.StatusCode)))
+		if !canRetry {
+			if failed {
+				t.breaker.recordFailure()
+			} else {
+				t.breaker.recordSuccess()
+			}
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			_ = resp.Body.Close()
+			log.GetLogger().Debugf("Upstream %s returned %d for %s, retrying", t.name, resp.StatusCode, req.URL.Path)
+		} else {
+			log.GetLogger().Debugf("Request to upstream %s failed for %s, retrying: %v", t.name, req.URL.Path, err)
+		}
+		if sleepErr := t.sleep(req.Context(), retryDelay(attempt)); sleepErr != nil {
+			// The client went away before the retry
+			t.breaker.releaseProbe()
+			return nil, sleepErr
+		}
+	}
+}
+
+// handleUpstreamError replies to requests that could not be completed by the upstream. Requests
+// rejected by an open circuit breaker receive a structured 503 so the UI can tell the API is down.
+func handleUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	var circuitErr *circuitOpenError
+	if errors.As(err, &circuitErr) {
+		retryAfter := int(math.Ceil(circuitErr.retryAfter.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"error":    "The upstream service is temporarily unavailable",
+			"code":     "UPSTREAM_UNAVAILABLE",
+			"upstream": circuitErr.upstream,
+		})
+		return
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"error": fmt.Sprintf("Request body exceeds the limit of %d bytes", maxBytesErr.Limit),
+			"code":  "REQUEST_TOO_LARGE",
+		})
+		return
+	}
+
+	// The route policy cancels requests that run for too long
+	if cause := context.Cause(r.Context()); errors.Is(cause, common.ErrRequestTimeout) || errors.Is(cause, common.ErrStreamIdleTimeout) {
+		upstreamErrorLogger(r).Warnf("Upstream request %s %s cancelled: %v", r.Method, r.URL.Path, cause)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+
+	if errors.Is(err, context.Canceled) {
+		// The client disconnected, nobody is left to read the response
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	status := http.StatusBadGateway
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	}
+	upstreamErrorLogger(r).WithError(err).Warnf("Upstream request %s %s failed", r.Method, r.URL.Path)
+	w.WriteHeader(status)
+}
+
+// upstreamErrorLogger adds the identifiers that correlate a failed request with the upstream logs
+func upstreamErrorLogger(r *http.Request) *logrus.Entry {
+	return log.GetLogger().WithFields(logrus.Fields{
+		"request_id": r.Header.Get(common.RequestIDHeader),
+		"trace_id":   tracing.TraceID(r.Context()),
+	})
+}
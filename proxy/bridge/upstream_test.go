@@ -0,0 +1,137 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestUpstreamTransport(maxRetries, threshold int) *upstreamTransport {
+	return &upstreamTransport{
+		name:       "test",
+		base:       http.DefaultTransport,
+		maxRetries: maxRetries,
+		breaker:    newCircuitBreaker("test", threshold, time.Minute),
+		sleep:      func(context.Context, time.Duration) error { return nil },
+	}
+}
+
+func TestUpstreamTransportRetriesIdempotentRequests(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	transport := newTestUpstreamTransport(2, 0)
+	req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+	req.RequestURI = ""
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls.Load() != 3 {
+		t.Errorf("expected GET to succeed on the third attempt, got status %d after %d calls", resp.StatusCode, calls.Load())
+	}
+
+	calls.Store(0)
+	req = httptest.NewRequest(http.MethodPost, server.URL, strings.NewReader("{}"))
+	req.RequestURI = ""
+	resp, err = transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Errorf("expected POST not to be retried, got status %d after %d calls", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker("test", 2, 30*time.Second)
+	breaker.now = func() time.Time { return now }
+
+	breaker.recordFailure()
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("expected circuit to stay closed below the threshold, got %v", err)
+	}
+	breaker.recordFailure()
+	if err := breaker.allow(); err == nil {
+		t.Fatal("expected circuit to open at the threshold")
+	}
+
+	now = now.Add(31 * time.Second)
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("expected a probe to be allowed after the cooldown, got %v", err)
+	}
+	if err := breaker.allow(); err == nil {
+		t.Fatal("expected only a single probe while half-open")
+	}
+	breaker.recordFailure()
+	if err := breaker.allow(); err == nil {
+		t.Fatal("expected a failed probe to re-open the circuit")
+	}
+
+	now = now.Add(31 * time.Second)
+	_ = breaker.allow()
+	breaker.recordSuccess()
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("expected a successful probe to close the circuit, got %v", err)
+	}
+}
+
+func TestUpstreamTransportReleasesProbeWhenCancelledDuringRetry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	transport := newTestUpstreamTransport(2, 1)
+	transport.breaker.now = func() time.Time { return now }
+	transport.breaker.recordFailure()
+	now = now.Add(2 * time.Minute)
+
+	// The client goes away while waiting to retry the half-open probe
+	ctx, cancel := context.WithCancel(context.Background())
+	transport.sleep = func(ctx context.Context, _ time.Duration) error {
+		cancel()
+		return ctx.Err()
+	}
+	req := httptest.NewRequest(http.MethodGet, server.URL, nil).WithContext(ctx)
+	req.RequestURI = ""
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Fatal("expected the cancelled request to fail")
+	}
+	if err := transport.breaker.allow(); err != nil {
+		t.Errorf("expected the probe to be released for the next request, got %v", err)
+	}
+}
+
+func TestHandleUpstreamErrorCircuitOpen(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/flightctl/api/v1/devices", nil)
+	handleUpstreamError(w, r, &circuitOpenError{upstream: upstreamFlightCtl, retryAfter: 1500 * time.Millisecond})
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "2" {
+		t.Errorf("expected Retry-After 2, got %q", w.Header().Get("Retry-After"))
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["code"] != "UPSTREAM_UNAVAILABLE" {
+		t.Errorf("expected structured error body, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,271 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/metrics"
+	"github.com/flightctl/flightctl-ui/tracing"
+)
+
+var websocketConnectionsGauge = metrics.NewGaugeVec(
+	"flightctl_ui_websocket_connections",
+	"WebSocket connections currently proxied to an upstream API, terminal sessions excluded.",
+	"upstream",
+)
+
+// websocketRouteKeys maps the upstreams to their key in the WebSocket routes file
+var websocketRouteKeys = map[string]string{
+	upstreamFlightCtl:    "flightctl",
+	upstreamImageBuilder: "imagebuilder",
+}
+
+// WebsocketProxy forwards WebSocket connections to the allowlisted paths of an upstream, such as
+// log streams and watch endpoints. Like terminal sessions, connections are checked against the
+// allowed origins, scoped to the organization in the org_id query parameter and kept open with
+// pings.
+//
+// Messages are relayed one at a time in each direction: a message is only read from an end once
+// the previous one was accepted by the other end, so that a slow end slows the other one down
+// through TCP flow control rather than growing buffers in the proxy. An end that does not accept
+// a message within the write timeout of the route closes the connection.
+type WebsocketProxy struct {
+	name      string
+	upstream  string
+	target    *url.URL
+	tlsConfig *tls.Config
+	routes    []config.WebsocketRoute
+	policy    *apiPolicy
+}
+
+func newWebsocketProxy(upstream, apiURL string, tlsConfig *tls.Config) *WebsocketProxy {
+	target, err := url.Parse(apiURL)
+	if err != nil {
+		log.WithError(err).Errorf("Failed to parse URL '%s'", apiURL)
+		os.Exit(1)
+	}
+	name := websocketRouteKeys[upstream]
+	return &WebsocketProxy{
+		name:      name,
+		upstream:  upstream,
+		target:    target,
+		tlsConfig: tlsConfig,
+		routes:    config.WebsocketRoutes[name],
+		policy:    newApiPolicy(upstream),
+	}
+}
+
+func NewFlightCtlWebsocketProxy(instance config.Instance, tlsConfig *tls.Config) *WebsocketProxy {
+	return newWebsocketProxy(upstreamFlightCtl, instance.ApiUrl, tlsConfig)
+}
+
+func NewImageBuilderWebsocketProxy(instance config.Instance, tlsConfig *tls.Config) *WebsocketProxy {
+	return newWebsocketProxy(upstreamImageBuilder, instance.ImageBuilderUrl, tlsConfig)
+}
+
+// route returns the route allowing WebSocket connections to the upstream path
+func (p *WebsocketProxy) route(requestPath string) (config.WebsocketRoute, bool) {
+	for _, route := range p.routes {
+		if matchPolicyPath(route.Path, requestPath) {
+			return route, true
+		}
+	}
+	return config.WebsocketRoute{}, false
+}
+
+// upstreamURL builds the WebSocket URL of the upstream path, keeping the base path of the upstream
+func (p *WebsocketProxy) upstreamURL(requestPath string, query url.Values) (string, error) {
+	scheme, ok := websocketSchemes[p.target.Scheme]
+	if !ok {
+		return "", fmt.Errorf("unsupported upstream URL scheme %q", p.target.Scheme)
+	}
+	upstreamURL := &url.URL{
+		Scheme:   scheme,
+		Host:     p.target.Host,
+		Path:     path.Join("/", p.target.Path, requestPath),
+		RawQuery: query.Encode(),
+	}
+	return upstreamURL.String(), nil
+}
+
+func (p *WebsocketProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Not a WebSocket connection", "code": "WEBSOCKET_REQUIRED"})
+		return
+	}
+
+	requestPath := path.Clean("/" + mux.Vars(r)["forward"])
+	route, ok := p.route(requestPath)
+	if !ok {
+		log.Warnf("Rejected WebSocket connection to upstream %s: path %q is not allowed", p.name, requestPath)
+		rejectWebsocket(w, r, websocket.ClosePolicyViolation, "WebSocket connections are not allowed on this path")
+		return
+	}
+	if !p.policy.enforce(w, r, requestPath) {
+		return
+	}
+
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := validateQueryOrganization(query); err != nil {
+		log.Warnf("Rejected WebSocket connection to upstream %s: %v", p.name, err)
+		rejectOrganizationError(w, r, err)
+		return
+	}
+	upstreamURL, err := p.upstreamURL(requestPath, query)
+	if err != nil {
+		log.Warnf("Failed to build the WebSocket URL of upstream %s: %v", p.name, err)
+		rejectWebsocket(w, r, websocket.CloseInternalServerErr, "Invalid upstream URL")
+		return
+	}
+
+	ctx, span := tracing.Start(r.Context(), "websocket "+p.upstream, trace.SpanKindClient,
+		semconv.ServerAddress(p.target.Hostname()),
+		semconv.URLPath(requestPath),
+	)
+	defer span.End()
+
+	dialer := &websocket.Dialer{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: p.tlsConfig,
+	}
+	backend, resp, err := dialer.DialContext(ctx, upstreamURL, upstreamWebsocketHeaders(ctx, r))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to dial the upstream")
+		statusCode := http.StatusBadGateway
+		if resp != nil && resp.StatusCode != 0 {
+			statusCode = resp.StatusCode
+		}
+		log.Warnf("Failed to dial WebSocket upstream %s for %q: '%v' Status: %d", p.name, requestPath, err, statusCode)
+		rejectWebsocket(w, r, websocket.CloseInternalServerErr, fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)))
+		return
+	}
+	defer backend.Close()
+
+	// The browser gets the subprotocol chosen by the upstream among those it offered
+	upgrader := &websocket.Upgrader{CheckOrigin: checkOrigin}
+	if protocol := backend.Subprotocol(); protocol != "" {
+		upgrader.Subprotocols = []string{protocol}
+	}
+	frontend, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warnf("Failed to upgrade websocket to client: '%v'", err)
+		return
+	}
+	defer frontend.Close()
+
+	websocketConnectionsGauge.Add(1, p.name)
+	defer websocketConnectionsGauge.Add(-1, p.name)
+	log.Debugf("Proxying WebSocket connection to upstream %s for %q", p.name, requestPath)
+
+	frontend.SetReadLimit(route.MaxMessageSize)
+	backend.SetReadLimit(route.MaxMessageSize)
+	writeTimeout := time.Duration(route.WriteTimeoutSeconds) * time.Second
+
+	results := make(chan websocketRelayResult, 2)
+	go relayWebsocket(backend, frontend, writeTimeout, results)
+	go relayWebsocket(frontend, backend, writeTimeout, results)
+
+	ticker := time.NewTicker(websocketPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case result := <-results:
+			// Only wait for the first end to stop and let the defers close both connections
+			closeWebsocketRelay(result)
+			return
+		case <-ticker.C:
+			// Send pings to client to prevent load balancers and other middlemen from closing the connection early
+			_ = frontend.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(websocketTimeout))
+		}
+	}
+}
+
+// deadlineWriter writes messages to a connection, failing when the peer does not accept them in time
+type deadlineWriter struct {
+	conn    *websocket.Conn
+	timeout time.Duration
+}
+
+func (d deadlineWriter) WriteMessage(messageType int, data []byte) error {
+	_ = d.conn.SetWriteDeadline(time.Now().Add(d.timeout))
+	if err := d.conn.WriteMessage(messageType, data); err != nil {
+		return &websocketWriteError{err: err}
+	}
+	return nil
+}
+
+// websocketWriteError is returned by a relay that failed to write to its destination
+type websocketWriteError struct {
+	err error
+}
+
+func (e *websocketWriteError) Error() string {
+	return e.err.Error()
+}
+
+func (e *websocketWriteError) Unwrap() error {
+	return e.err
+}
+
+// websocketRelayResult tells why the relay from src to dest stopped
+type websocketRelayResult struct {
+	dest, src *websocket.Conn
+	err       error
+}
+
+func relayWebsocket(dest, src *websocket.Conn, writeTimeout time.Duration, results chan<- websocketRelayResult) {
+	err := copyMsgs(nil, deadlineWriter{conn: dest, timeout: writeTimeout}, src, nil)
+	results <- websocketRelayResult{dest: dest, src: src, err: err}
+}
+
+// closeWebsocketRelay tells the end still connected why the connection ends: the close code of
+// the other end, or an error of the proxy
+func closeWebsocketRelay(result websocketRelayResult) {
+	peer := result.dest
+	code, reason := websocket.CloseGoingAway, ""
+
+	var writeErr *websocketWriteError
+	var closeErr *websocket.CloseError
+	var netErr net.Error
+	switch {
+	case errors.As(result.err, &writeErr):
+		// The destination failed, tell the source
+		peer = result.src
+		if errors.As(writeErr.err, &netErr) && netErr.Timeout() {
+			code, reason = websocket.CloseTryAgainLater, "The other end is too slow"
+		}
+	case errors.Is(result.err, websocket.ErrReadLimit):
+		code, reason = websocket.CloseMessageTooBig, "Message too big"
+	case errors.As(result.err, &closeErr):
+		// Codes reserved for the local end of a connection cannot be sent
+		switch closeErr.Code {
+		case websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+		default:
+			code, reason = closeErr.Code, closeErr.Text
+		}
+	}
+	_ = peer.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(websocketTimeout))
+}
@@ -0,0 +1,125 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketProxy(t *testing.T) {
+	t.Parallel()
+
+	upgrader := websocket.Upgrader{Subprotocols: []string{"watch.v1"}}
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/base/api/v1/watch/devices" || r.URL.Query().Get("org_id") != "org1" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusNotFound)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(msg) == "bye" {
+				_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "done"), time.Now().Add(time.Second))
+				return
+			}
+			if err := conn.WriteMessage(messageType, msg); err != nil {
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL + "/base")
+	proxy := &WebsocketProxy{
+		name:      "flightctl",
+		upstream:  upstreamFlightCtl,
+		target:    target,
+		tlsConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server certificate
+		routes:    []config.WebsocketRoute{{Path: "/api/v1/watch/**", MaxMessageSize: 16, WriteTimeoutSeconds: 5}},
+		policy:    &apiPolicy{name: "flightctl", defaultAllow: true},
+	}
+	router := mux.NewRouter()
+	router.Handle("/api/ws/flightctl/{forward:.*}", proxy)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	baseURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws/flightctl"
+
+	expectClose := func(conn *websocket.Conn, code int) {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != code {
+			t.Errorf("expected close code %d, got %v", code, err)
+		}
+	}
+	dial := func(path string) *websocket.Conn {
+		t.Helper()
+		dialer := websocket.Dialer{Subprotocols: []string{"watch.v1"}}
+		conn, _, err := dialer.Dial(baseURL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to connect to %s: %v", path, err)
+		}
+		return conn
+	}
+
+	// Messages are relayed both ways, to the path under the base path of the upstream
+	conn := dial("/api/v1/watch/devices?org_id=org1")
+	if conn.Subprotocol() != "watch.v1" {
+		t.Errorf("expected the subprotocol of the upstream, got %q", conn.Subprotocol())
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Fatalf("expected the message to be echoed, got %q, %v", msg, err)
+	}
+	// The close code of the upstream reaches the browser
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	expectClose(conn, 4000)
+	conn.Close()
+
+	// Messages over the size limit of the route close the connection
+	conn = dial("/api/v1/watch/devices?org_id=org1")
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 17))); err != nil {
+		t.Fatal(err)
+	}
+	expectClose(conn, websocket.CloseMessageTooBig)
+	conn.Close()
+
+	// Paths that are not allowlisted and connections without organization are rejected
+	conn = dial("/api/v1/devices?org_id=org1")
+	expectClose(conn, websocket.ClosePolicyViolation)
+	conn.Close()
+	conn = dial("/api/v1/watch/devices")
+	expectClose(conn, websocket.ClosePolicyViolation)
+	conn.Close()
+
+	resp, err := http.Get(server.URL + "/api/ws/flightctl/api/v1/watch/devices?org_id=org1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for a request that is not a WebSocket upgrade, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OrgIDLabel is the alert label holding the organization an alert belongs to
+const OrgIDLabel = "org_id"
+
+// AlertMatcher is a label matcher of the AlertManager v2 API, e.g. severity="critical"
+type AlertMatcher struct {
+	Name     string
+	Operator string
+	Value    string
+}
+
+// alertMatcherOperators are listed so that the two-character operators are tried first
+var alertMatcherOperators = []string{"=~", "!~", "!=", "="}
+
+// ParseAlertMatcher parses a single matcher as sent in the filter parameter of AlertManager queries.
+// Label names and values may be quoted.
+func ParseAlertMatcher(filter string) (AlertMatcher, error) {
+	s := strings.TrimSpace(filter)
+	s = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}"))
+
+	var matcher AlertMatcher
+	if strings.HasPrefix(s, `"`) {
+		name, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return matcher, fmt.Errorf("invalid label name in matcher %q", filter)
+		}
+		s = s[len(name):]
+		matcher.Name, _ = strconv.Unquote(name)
+	} else {
+		end := strings.IndexAny(s, "=!")
+		if end <= 0 {
+			return matcher, fmt.Errorf("invalid matcher %q", filter)
+		}
+		matcher.Name, s = strings.TrimSpace(s[:end]), s[end:]
+	}
+
+	s = strings.TrimSpace(s)
+	for _, op := range alertMatcherOperators {
+		if strings.HasPrefix(s, op) {
+			matcher.Operator = op
+			s = strings.TrimSpace(s[len(op):])
+			break
+		}
+	}
+	if matcher.Operator == "" {
+		return matcher, fmt.Errorf("invalid operator in matcher %q", filter)
+	}
+
+	matcher.Value = s
+	if strings.HasPrefix(s, `"`) {
+		value, err := strconv.Unquote(s)
+		if err != nil {
+			return matcher, fmt.Errorf("invalid value in matcher %q", filter)
+		}
+		matcher.Value = value
+	}
+	return matcher, nil
+}
+
+// IsOrgMatcher reports whether the matcher selects exactly the alerts of the organization
+func (m AlertMatcher) IsOrgMatcher(orgID string) bool {
+	return m.Name == OrgIDLabel && m.Operator == "=" && m.Value == orgID
+}
+
+// ValidateOrgAlertFilters makes sure that the filters sent by the user cannot widen a query scoped to
+// orgID: every filter mentioning the organization label must match exactly that organization.
+func ValidateOrgAlertFilters(filters []string, orgID string) error {
+	for _, filter := range filters {
+		matcher, err := ParseAlertMatcher(filter)
+		// Filters combining several matchers are not used by the UI and harder to verify, so they
+		// are only forwarded when they cannot refer to the organization label
+		if err != nil || strings.Contains(filter, ",") {
+			if strings.Contains(filter, OrgIDLabel) || strings.Contains(filter, `\`) {
+				return fmt.Errorf("unsupported filter %q", filter)
+			}
+			continue
+		}
+		if matcher.Name == OrgIDLabel && !matcher.IsOrgMatcher(orgID) {
+			return fmt.Errorf("the %s matcher must select the current organization", OrgIDLabel)
+		}
+	}
+	return nil
+}
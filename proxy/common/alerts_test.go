@@ -0,0 +1,46 @@
+package common
+
+import "testing"
+
+func TestParseAlertMatcher(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   AlertMatcher
+	}{
+		{`severity="critical"`, AlertMatcher{Name: "severity", Operator: "=", Value: "critical"}},
+		{`org_id=org1`, AlertMatcher{Name: "org_id", Operator: "=", Value: "org1"}},
+		{`{alertname=~"Device.*"}`, AlertMatcher{Name: "alertname", Operator: "=~", Value: "Device.*"}},
+		{` "org_id" != "org2" `, AlertMatcher{Name: "org_id", Operator: "!=", Value: "org2"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseAlertMatcher(tt.filter)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseAlertMatcher(%q) = %+v, %v, want %+v", tt.filter, got, err, tt.want)
+		}
+	}
+	if _, err := ParseAlertMatcher("severity"); err == nil {
+		t.Error("expected a matcher without operator to be rejected")
+	}
+}
+
+func TestValidateOrgAlertFilters(t *testing.T) {
+	tests := []struct {
+		filters []string
+		valid   bool
+	}{
+		{[]string{`severity="critical"`, `resource="device1"`}, true},
+		{[]string{`org_id="org1"`}, true},
+		{[]string{`org_id=org1`, `severity=warning`}, true},
+		{[]string{`org_id="org2"`}, false},
+		{[]string{`org_id!="org1"`}, false},
+		{[]string{`org_id=~".*"`}, false},
+		{[]string{`"org_id"=~".*"`}, false},
+		{[]string{`{severity="critical",org_id=~".*"}`}, false},
+	}
+	for _, tt := range tests {
+		err := ValidateOrgAlertFilters(tt.filters, "org1")
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidateOrgAlertFilters(%q) = %v, expected valid=%v", tt.filters, err, tt.valid)
+		}
+	}
+}
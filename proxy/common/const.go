@@ -3,4 +3,5 @@ package common
 const (
 	CookieSessionName = "flightctl-session"
 	AuthHeaderKey     = "Authorization"
+	RequestIDHeader   = "X-Request-ID"
 )
@@ -0,0 +1,22 @@
+package common
+
+import "context"
+
+// UserIdentity describes the user behind a proxied request
+type UserIdentity struct {
+	Username string
+	Provider string
+}
+
+type userIdentityKey struct{}
+
+// WithUserIdentity returns a copy of ctx carrying the identity of the user that made the request
+func WithUserIdentity(ctx context.Context, identity UserIdentity) context.Context {
+	return context.WithValue(ctx, userIdentityKey{}, identity)
+}
+
+// UserIdentityFromContext returns the identity stored by WithUserIdentity, if any
+func UserIdentityFromContext(ctx context.Context) (UserIdentity, bool) {
+	identity, ok := ctx.Value(userIdentityKey{}).(UserIdentity)
+	return identity, ok
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"context"
+
+	"github.com/flightctl/flightctl-ui/config"
+)
+
+const (
+	// InstanceHeader selects the Flight Control instance that serves a request
+	InstanceHeader = "X-FlightCtl-Instance"
+	// InstancePathPrefix selects the instance through the path, e.g. /api/instances/<name>/flightctl/...,
+	// for requests that cannot set headers such as WebSockets
+	InstancePathPrefix = "/api/instances/"
+)
+
+type instanceKey struct{}
+
+// WithInstance returns a copy of ctx served by the given Flight Control instance
+func WithInstance(ctx context.Context, instance config.Instance) context.Context {
+	return context.WithValue(ctx, instanceKey{}, instance)
+}
+
+// InstanceFromContext returns the instance selected for the request, or the default instance
+func InstanceFromContext(ctx context.Context) config.Instance {
+	if instance, ok := ctx.Value(instanceKey{}).(config.Instance); ok {
+		return instance
+	}
+	return config.DefaultInstance()
+}
+
+// SessionCookieName returns the name of the cookie holding the session of an instance, so that a
+// user can be logged in to several instances at once
+func SessionCookieName(instance config.Instance) string {
+	if instance.IsDefault() {
+		return CookieSessionName
+	}
+	return CookieSessionName + "-" + instance.Name
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// StatusRecorder captures the status code of a response for logs, traces and audits. Flushes and
+// hijacks are passed to the wrapped writer, which http.ResponseController reaches through Unwrap.
+type StatusRecorder struct {
+	http.ResponseWriter
+	status atomic.Int32
+}
+
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w}
+}
+
+// Status returns the status code written so far, or 0 when the response has not started
+func (s *StatusRecorder) Status() int {
+	return int(s.status.Load())
+}
+
+func (s *StatusRecorder) WriteHeader(status int) {
+	// Only the first status reaches the client
+	s.status.CompareAndSwap(0, int32(status))
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *StatusRecorder) Write(b []byte) (int, error) {
+	s.status.CompareAndSwap(0, http.StatusOK)
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *StatusRecorder) Flush() {
+	_ = http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+func (s *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(s.ResponseWriter).Hijack()
+	if err == nil {
+		s.status.CompareAndSwap(0, http.StatusSwitchingProtocols)
+	}
+	return conn, rw, err
+}
+
+func (s *StatusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
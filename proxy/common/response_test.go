@@ -0,0 +1,25 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusRecorder(t *testing.T) {
+	w := httptest.NewRecorder()
+	recorder := NewStatusRecorder(w)
+	if recorder.Status() != 0 {
+		t.Fatalf("expected no status before the response starts, got %d", recorder.Status())
+	}
+	_, _ = recorder.Write([]byte("ok"))
+	recorder.WriteHeader(http.StatusInternalServerError)
+	if recorder.Status() != http.StatusOK {
+		t.Errorf("expected the implicit status of the first write, got %d", recorder.Status())
+	}
+
+	// The wrapped writer is reached through Unwrap
+	if err := http.NewResponseController(recorder).Flush(); err != nil || !w.Flushed {
+		t.Errorf("expected the flush to reach the wrapped writer, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+package common
+
+import "errors"
+
+// Causes of a request context cancelled by the route policy. Handlers use them to tell a
+// timeout apart from a client that disconnected.
+var (
+	ErrRequestTimeout    = errors.New("request exceeded the route timeout")
+	ErrStreamIdleTimeout = errors.New("streaming response exceeded the route idle timeout")
+)
@@ -27,10 +27,10 @@ func IsSafeResourceName(resourceName string) bool {
 	return true
 }
 
-// BuildFctlApiUrl constructs a URL for the Flight Control API by safely joining path segments.
+// BuildFctlApiUrl constructs a URL for the Flight Control API of an instance by safely joining path segments.
 // This prevents SSRF attacks by using proper URL parsing and path joining instead of string concatenation.
-func BuildFctlApiUrl(pathSegments ...string) (string, error) {
-	baseURL, err := url.Parse(config.FctlApiUrl)
+func BuildFctlApiUrl(instance config.Instance, pathSegments ...string) (string, error) {
+	baseURL, err := url.Parse(instance.ApiUrl)
 	if err != nil {
 		return "", fmt.Errorf("invalid base API URL: %w", err)
 	}
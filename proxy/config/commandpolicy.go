@@ -0,0 +1,65 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+)
+
+const (
+	// AllOrganizations is the key of the command policy applied to every organization
+	AllOrganizations = "*"
+	// PolicyConfirm is the action of the command lines that only run once the user confirms them
+	PolicyConfirm = "confirm"
+)
+
+// TerminalCommandPolicy lists the regular expressions matched against each command line typed in
+// a terminal session. Lines matching a deny pattern are not run, lines matching a confirm pattern
+// are only run once the user confirms them. Deny patterns are checked first.
+type TerminalCommandPolicy struct {
+	Deny    []string `json:"deny,omitempty"`
+	Confirm []string `json:"confirm,omitempty"`
+}
+
+// TerminalCommandPolicies holds the command policy of each organization, loaded from
+// TERMINAL_COMMAND_POLICY_FILE. The policy of AllOrganizations applies in addition to the policy
+// of the organization of the session.
+var TerminalCommandPolicies = map[string]TerminalCommandPolicy{}
+
+func init() {
+	if TerminalCommandPolicyFile == "" {
+		return
+	}
+	policies, err := loadTerminalCommandPolicies(TerminalCommandPolicyFile)
+	if err != nil {
+		log.Fatalf("config: failed to load TERMINAL_COMMAND_POLICY_FILE: %v", err)
+	}
+	TerminalCommandPolicies = policies
+}
+
+func loadTerminalCommandPolicies(path string) (map[string]TerminalCommandPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policies map[string]TerminalCommandPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	for organization, policy := range policies {
+		if organization == "" {
+			return nil, fmt.Errorf("empty organization, use %q for every organization", AllOrganizations)
+		}
+		for _, patterns := range [][]string{policy.Deny, policy.Confirm} {
+			for _, pattern := range patterns {
+				if _, err := regexp.Compile(pattern); err != nil {
+					return nil, fmt.Errorf("organization %q has an invalid pattern %q: %w", organization, pattern, err)
+				}
+			}
+		}
+	}
+	return policies, nil
+}
@@ -5,7 +5,9 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -13,6 +15,7 @@ var (
 	FctlApiUrl             = getEnvUrlVar("FLIGHTCTL_SERVER", "https://localhost:3443")
 	FctlApiExternalUrl     = getEnvUrlVar("FLIGHTCTL_SERVER_EXTERNAL", "https://localhost:3443")
 	FctlImageBuilderApiUrl = getEnvUrlVar("FLIGHTCTL_IMAGEBUILDER_SERVER", "https://localhost:8445")
+	FctlConsoleUrl         = getEnvUrlVar("FLIGHTCTL_CONSOLE_SERVER", "")
 	FctlApiInsecure        = getEnvVar("FLIGHTCTL_SERVER_INSECURE_SKIP_VERIFY", "false")
 	FctlCliArtifactsUrl    = getEnvUrlVar("FLIGHTCTL_CLI_ARTIFACTS_SERVER", "http://localhost:8090")
 	AlertManagerApiUrl     = getEnvUrlVar("FLIGHTCTL_ALERTMANAGER_PROXY", "https://localhost:8443")
@@ -26,8 +29,96 @@ var (
 	// origin (e.g. TLS termination at an ingress). When false, only r.TLS and r.Host are used.
 	// Set to true when a trusted reverse proxy sets these headers; see also TrustedProxyNets.
 	TrustXForwardedHeaders = parseBoolEnv("TRUST_X_FORWARDED_HEADERS", false)
+	// Login throttling: attempts per minute for each client IP and for each auth provider, and the maximum
+	// number of login flows a client IP may have started but not completed. A value of 0 disables the limit.
+	LoginRateLimitPerIP         = parseIntEnv("LOGIN_RATE_LIMIT_PER_IP", 30)
+	LoginRateLimitPerProvider   = parseIntEnv("LOGIN_RATE_LIMIT_PER_PROVIDER", 300)
+	LoginMaxPendingTransactions = parseIntEnv("LOGIN_MAX_PENDING_TRANSACTIONS", 20)
+	// Audit log of mutating API calls and terminal sessions. Auditing is enabled when a file or syslog sink is configured.
+	AuditLogFile          = getEnvVar("AUDIT_LOG_FILE", "")
+	AuditLogMaxSizeMB     = parseIntEnv("AUDIT_LOG_MAX_SIZE_MB", 100)
+	AuditLogMaxBackups    = parseIntEnv("AUDIT_LOG_MAX_BACKUPS", 5)
+	AuditLogSyslog        = getEnvVar("AUDIT_LOG_SYSLOG", "false")
+	AuditLogSyslogAddress = getEnvVar("AUDIT_LOG_SYSLOG_ADDRESS", "")
+	AuditLogBodies        = getEnvVar("AUDIT_LOG_BODIES", "false")
+	// Resilience of the proxied upstream APIs: GET requests are retried up to UpstreamMaxRetries times, and an
+	// upstream is considered down after UpstreamCircuitBreakerThreshold consecutive failures (0 disables the breaker).
+	UpstreamMaxRetries              = parseIntEnv("UPSTREAM_MAX_RETRIES", 2)
+	UpstreamCircuitBreakerThreshold = parseIntEnv("UPSTREAM_CIRCUIT_BREAKER_THRESHOLD", 5)
+	UpstreamCircuitBreakerCooldown  = parseDurationEnv("UPSTREAM_CIRCUIT_BREAKER_COOLDOWN", 30*time.Second)
+	// Route policy timeouts of the proxied APIs: ordinary calls must complete within ApiRequestTimeout, while
+	// streaming responses (server-sent events, followed logs) run until idle for ApiStreamIdleTimeout
+	ApiRequestTimeout    = parseDurationEnv("API_REQUEST_TIMEOUT", 60*time.Second)
+	ApiStreamIdleTimeout = parseDurationEnv("API_STREAM_IDLE_TIMEOUT", 5*time.Minute)
+	// Opt-in cache of GET responses from the Flight Control API, private to each session and organization
+	ApiCacheEnabled    = getEnvVar("API_CACHE_ENABLED", "false")
+	ApiCacheTTL        = parseDurationEnv("API_CACHE_TTL", 5*time.Second)
+	ApiCacheMaxEntries = parseIntEnv("API_CACHE_MAX_ENTRIES", 1000)
+	// MetricsAddress is the address of the listener serving /metrics, kept apart from the UI. Metrics are not served when empty.
+	MetricsAddress = getEnvVar("METRICS_ADDRESS", "")
+	// Method and path rules for the API calls forwarded to each upstream (see ApiPolicies). In read-only mode,
+	// every mutating call is rejected except those to the authentication endpoints.
+	ApiPolicyFile = getEnvVar("API_POLICY_FILE", "")
+	ApiReadOnly   = parseBoolEnv("API_READ_ONLY", false)
+	// Upstream paths that can be reached with WebSockets under /api/ws/ (see WebsocketRoutes)
+	WebsocketRoutesFile = getEnvVar("WEBSOCKET_ROUTES_FILE", "")
+	// Limits of the /api/batch endpoint, which runs several API calls in a single round trip
+	BatchMaxItems       = parseIntEnv("BATCH_MAX_ITEMS", 50)
+	BatchMaxConcurrency = parseIntEnv("BATCH_MAX_CONCURRENCY", 8)
+	BatchItemTimeout    = parseDurationEnv("BATCH_ITEM_TIMEOUT", 30*time.Second)
+	// Interval at which the alerts of each organization with browsers subscribed to /api/alerts-stream are polled
+	AlertsStreamPollInterval = parseDurationEnv("ALERTS_STREAM_POLL_INTERVAL", 15*time.Second)
+	// Recording of terminal sessions in asciicast v2 files, enabled when a directory is set. Recordings are
+	// deleted after TerminalRecordingRetention, or oldest first when the directory exceeds its total size.
+	TerminalRecordingDir            = getEnvVar("TERMINAL_RECORDING_DIR", "")
+	TerminalRecordingMaxSizeMB      = parseIntEnv("TERMINAL_RECORDING_MAX_SIZE_MB", 10)
+	TerminalRecordingMaxTotalSizeMB = parseIntEnv("TERMINAL_RECORDING_MAX_TOTAL_SIZE_MB", 1024)
+	TerminalRecordingRetention      = parseDurationEnv("TERMINAL_RECORDING_RETENTION", 30*24*time.Hour)
+	// Limits of terminal sessions. A zero value, the default, disables the limit.
+	TerminalMaxSessions          = parseIntEnv("TERMINAL_MAX_SESSIONS", 0)
+	TerminalMaxSessionsPerUser   = parseIntEnv("TERMINAL_MAX_SESSIONS_PER_USER", 0)
+	TerminalMaxSessionsPerDevice = parseIntEnv("TERMINAL_MAX_SESSIONS_PER_DEVICE", 0)
+	// Terminal sessions without input for TerminalIdleTimeout are closed, after a warning sent
+	// TerminalIdleWarning before. Output from the device does not count as activity.
+	TerminalIdleTimeout = parseDurationEnv("TERMINAL_IDLE_TIMEOUT", 0)
+	TerminalIdleWarning = parseDurationEnv("TERMINAL_IDLE_WARNING", time.Minute)
+	TerminalMaxDuration = parseDurationEnv("TERMINAL_MAX_DURATION", 0)
+	// The device console stays open for TerminalResumeGracePeriod after the browser disconnects
+	// unexpectedly, keeping the last TerminalResumeBufferKB of output to replay when it resumes. Resuming
+	// is disabled by default.
+	TerminalResumeGracePeriod = parseDurationEnv("TERMINAL_RESUME_GRACE_PERIOD", 0)
+	TerminalResumeBufferKB    = parseIntEnv("TERMINAL_RESUME_BUFFER_KB", 256)
+	// Patterns of the commands typed in terminal sessions that are blocked or need a confirmation,
+	// per organization (see TerminalCommandPolicies)
+	TerminalCommandPolicyFile = getEnvVar("TERMINAL_COMMAND_POLICY_FILE", "")
+	// Limits of the /api/console/broadcast endpoint, which runs a command in the console of several
+	// devices. TerminalBroadcastTimeout is the longest a command may run on each device.
+	TerminalBroadcastMaxDevices  = parseIntEnv("TERMINAL_BROADCAST_MAX_DEVICES", 50)
+	TerminalBroadcastConcurrency = parseIntEnv("TERMINAL_BROADCAST_CONCURRENCY", 5)
+	TerminalBroadcastTimeout     = parseDurationEnv("TERMINAL_BROADCAST_TIMEOUT", 30*time.Second)
 )
 
+// UpstreamTimeouts limits how long the proxy waits on each phase of a request to an upstream API
+type UpstreamTimeouts struct {
+	Connect        time.Duration
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration
+}
+
+// GetUpstreamTimeouts returns the timeouts for the upstream whose URL is configured by urlEnvKey
+// (e.g. FLIGHTCTL_SERVER). Each timeout can be set for a single upstream with <urlEnvKey>_<TIMEOUT>,
+// or for all of them with UPSTREAM_<TIMEOUT>.
+func GetUpstreamTimeouts(urlEnvKey string) UpstreamTimeouts {
+	timeout := func(name string, defaultVal time.Duration) time.Duration {
+		return parseDurationEnv(urlEnvKey+"_"+name, parseDurationEnv("UPSTREAM_"+name, defaultVal))
+	}
+	return UpstreamTimeouts{
+		Connect:        timeout("CONNECT_TIMEOUT", 5*time.Second),
+		TLSHandshake:   timeout("TLS_HANDSHAKE_TIMEOUT", 10*time.Second),
+		ResponseHeader: timeout("RESPONSE_HEADER_TIMEOUT", 30*time.Second),
+	}
+}
+
 // trustedProxyNets is parsed from TRUSTED_PROXY_CIDRS (comma-separated). When non-empty and
 // TrustXForwardedHeaders is true, forwarded headers apply only when the immediate client IP
 // (r.RemoteAddr) falls within one of these networks.
@@ -41,7 +132,100 @@ var (
 	trustedProxyCIDRSExplicit bool
 )
 
+// outboundAllowedPrivateNets and outboundAllowedPrivateHosts are parsed from OUTBOUND_ALLOWED_PRIVATE_CIDRS
+// and OUTBOUND_ALLOWED_PRIVATE_HOSTS (comma-separated). They list the private destinations that outbound
+// requests to user-supplied URLs (e.g. testing an auth provider connection) may reach, such as an on-prem
+// identity provider. A host entry matches the host itself and all of its subdomains; an entry with a
+// leading dot matches subdomains only.
+var (
+	outboundAllowedPrivateNets  []*net.IPNet
+	outboundAllowedPrivateHosts []string
+)
+
+// adminUsers is parsed from ADMIN_USERS. These users can access the administration endpoints of the
+// proxy, such as terminal recordings.
+var adminUsers []userEntry
+
+// userEntry identifies a user of an authentication provider, in the users of a single Flight Control
+// instance or of every instance when instance is empty
+type userEntry struct {
+	instance string
+	provider string
+	username string
+}
+
+// parseUserList parses a comma-separated list of provider:username entries, which can be prefixed by
+// an instance name as instance/provider:username. Usernames are only unique within their provider,
+// so entries without one are ignored.
+func parseUserList(envKey, s string) []userEntry {
+	var users []userEntry
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		provider, username, ok := strings.Cut(part, ":")
+		instance, provider, hasInstance := strings.Cut(provider, "/")
+		if !hasInstance {
+			instance, provider = "", instance
+		}
+		if !ok || provider == "" || username == "" || (hasInstance && instance == "") {
+			log.Printf("config: ignoring %s entry %q, expected provider:username or instance/provider:username", envKey, part)
+			continue
+		}
+		users = append(users, userEntry{instance: instance, provider: provider, username: username})
+	}
+	return users
+}
+
+func containsUser(users []userEntry, instance, provider, username string) bool {
+	if provider == "" || username == "" {
+		return false
+	}
+	for _, user := range users {
+		if user.provider == provider && user.username == username && (user.instance == "" || user.instance == instance) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdminUser reports whether the user of the authentication provider, logged in to the Flight Control
+// instance, was granted access to the administration endpoints
+func IsAdminUser(instance, provider, username string) bool {
+	return containsUser(adminUsers, instance, provider, username)
+}
+
+// IsGlobalAdminUser reports whether the user of the authentication provider is an administrator of
+// all the Flight Control instances, through an ADMIN_USERS entry without an instance name
+func IsGlobalAdminUser(provider, username string) bool {
+	if provider == "" || username == "" {
+		return false
+	}
+	for _, user := range adminUsers {
+		if user.instance == "" && user.provider == provider && user.username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// terminalObserverUsers is parsed from TERMINAL_OBSERVER_USERS, in the format of ADMIN_USERS. These
+// users can observe the terminal sessions on the devices they can access.
+var terminalObserverUsers []userEntry
+
+// IsTerminalObserverUser reports whether the user of the authentication provider, logged in to the
+// Flight Control instance, may observe terminal sessions without being an administrator
+func IsTerminalObserverUser(instance, provider, username string) bool {
+	return containsUser(terminalObserverUsers, instance, provider, username)
+}
+
 func init() {
+	adminUsers = parseUserList("ADMIN_USERS", getEnvVar("ADMIN_USERS", ""))
+	terminalObserverUsers = parseUserList("TERMINAL_OBSERVER_USERS", getEnvVar("TERMINAL_OBSERVER_USERS", ""))
+	outboundAllowedPrivateNets = parseTrustedProxyCIDRs(getEnvVar("OUTBOUND_ALLOWED_PRIVATE_CIDRS", ""))
+	outboundAllowedPrivateHosts = parseHostSuffixes(getEnvVar("OUTBOUND_ALLOWED_PRIVATE_HOSTS", ""))
+
 	raw, ok := os.LookupEnv("TRUSTED_PROXY_CIDRS")
 	raw = strings.TrimSpace(raw)
 	trustedProxyCIDRSExplicit = ok && raw != ""
@@ -67,6 +251,38 @@ func parseBoolEnv(key string, defaultVal bool) bool {
 	}
 }
 
+func parseIntEnv(key string, defaultVal int) int {
+	s, ok := os.LookupEnv(key)
+	if !ok || strings.TrimSpace(s) == "" {
+		return defaultVal
+	}
+	val, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || val < 0 {
+		log.Printf("config: invalid value %q for %s, using default %d", s, key, defaultVal)
+		return defaultVal
+	}
+	return val
+}
+
+// TracingEnabled reports whether spans are exported to an OTLP collector, which is configured
+// with the standard OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT variables
+func TracingEnabled() bool {
+	return getEnvVar("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "") != "" || getEnvVar("OTEL_EXPORTER_OTLP_ENDPOINT", "") != ""
+}
+
+func parseDurationEnv(key string, defaultVal time.Duration) time.Duration {
+	s, ok := os.LookupEnv(key)
+	if !ok || strings.TrimSpace(s) == "" {
+		return defaultVal
+	}
+	val, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil || val < 0 {
+		log.Printf("config: invalid duration %q for %s, using default %s", s, key, defaultVal)
+		return defaultVal
+	}
+	return val
+}
+
 func parseTrustedProxyCIDRs(s string) []*net.IPNet {
 	var out []*net.IPNet
 	for _, part := range strings.Split(s, ",") {
@@ -120,6 +336,100 @@ func ShouldTrustForwardedHeaders(r *http.Request) bool {
 	return false
 }
 
+// ClientIP returns the address of the client that made the request. When forwarded headers are trusted
+// for this request (see ShouldTrustForwardedHeaders), X-Forwarded-For is walked from the right and the
+// first address that is not a trusted proxy is used; otherwise the direct connection address is used.
+// Without TRUSTED_PROXY_CIDRS only the right-most entry, the address seen by the nearest proxy, is used
+// since the entries on its left are set by the client.
+func ClientIP(r *http.Request) net.IP {
+	remoteIP := remoteAddrIP(r)
+	if !ShouldTrustForwardedHeaders(r) {
+		return remoteIP
+	}
+
+	var hops []net.IP
+	for _, values := range r.Header.Values("X-Forwarded-For") {
+		for _, part := range strings.Split(values, ",") {
+			if ip := net.ParseIP(strings.TrimSpace(part)); ip != nil {
+				hops = append(hops, ip)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		return remoteIP
+	}
+	if len(trustedProxyNets) == 0 {
+		return hops[len(hops)-1]
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !isTrustedProxyIP(hops[i]) {
+			return hops[i]
+		}
+	}
+	// Every hop is a trusted proxy, so the request came from within the trusted networks
+	return hops[0]
+}
+
+func isTrustedProxyIP(ip net.IP) bool {
+	for _, n := range trustedProxyNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseHostSuffixes(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" || part == "." {
+			continue
+		}
+		out = append(out, part)
+	}
+	return out
+}
+
+// IsOutboundPrivateIPAllowed reports whether the private address ip was allowlisted via OUTBOUND_ALLOWED_PRIVATE_CIDRS
+func IsOutboundPrivateIPAllowed(ip net.IP) bool {
+	for _, n := range outboundAllowedPrivateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOutboundLoopbackIPAllowed reports whether the loopback address ip was allowlisted via
+// OUTBOUND_ALLOWED_PRIVATE_CIDRS by a loopback range, rather than by a broader range that happens to contain it
+func IsOutboundLoopbackIPAllowed(ip net.IP) bool {
+	for _, n := range outboundAllowedPrivateNets {
+		if n.IP.IsLoopback() && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOutboundPrivateHostAllowed reports whether host was allowlisted via OUTBOUND_ALLOWED_PRIVATE_HOSTS
+func IsOutboundPrivateHostAllowed(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return false
+	}
+	for _, suffix := range outboundAllowedPrivateHosts {
+		if strings.HasPrefix(suffix, ".") {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
 func remoteAddrIP(r *http.Request) net.IP {
 	if r == nil {
 		return nil
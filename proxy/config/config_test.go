@@ -3,6 +3,8 @@ package config
 import (
 	"net"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -62,3 +64,214 @@ func TestShouldTrustForwardedHeaders(t *testing.T) { //nolint:paralleltest // mu
 		t.Fatal("expected false when RemoteAddr is outside CIDR")
 	}
 }
+
+func TestOutboundPrivateAllowlist(t *testing.T) { //nolint:paralleltest // mutates package-level config
+	oldNets := outboundAllowedPrivateNets
+	oldHosts := outboundAllowedPrivateHosts
+	defer func() {
+		outboundAllowedPrivateNets = oldNets
+		outboundAllowedPrivateHosts = oldHosts
+	}()
+
+	outboundAllowedPrivateNets = parseTrustedProxyCIDRs("10.20.0.0/24")
+	outboundAllowedPrivateHosts = parseHostSuffixes("corp.example.com, .lab.internal")
+
+	if !IsOutboundPrivateIPAllowed(net.ParseIP("10.20.0.15")) {
+		t.Fatal("expected 10.20.0.15 to be allowed by 10.20.0.0/24")
+	}
+	if IsOutboundPrivateIPAllowed(net.ParseIP("10.30.0.15")) {
+		t.Fatal("expected 10.30.0.15 not to be allowed")
+	}
+
+	outboundAllowedPrivateNets = parseTrustedProxyCIDRs("0.0.0.0/0,::/0")
+	if IsOutboundLoopbackIPAllowed(net.ParseIP("127.0.0.1")) || IsOutboundLoopbackIPAllowed(net.ParseIP("::1")) {
+		t.Fatal("expected loopback addresses not to be allowed by a broader range")
+	}
+	outboundAllowedPrivateNets = parseTrustedProxyCIDRs("127.0.0.1/32,::1/128")
+	if !IsOutboundLoopbackIPAllowed(net.ParseIP("127.0.0.1")) || !IsOutboundLoopbackIPAllowed(net.ParseIP("::1")) {
+		t.Fatal("expected explicitly listed loopback addresses to be allowed")
+	}
+	outboundAllowedPrivateNets = parseTrustedProxyCIDRs("10.20.0.0/24")
+
+	for _, host := range []string{"corp.example.com", "keycloak.corp.example.com", "KEYCLOAK.Corp.Example.com.", "idp.lab.internal"} {
+		if !IsOutboundPrivateHostAllowed(host) {
+			t.Errorf("expected host %q to be allowed", host)
+		}
+	}
+	for _, host := range []string{"evilcorp.example.com", "lab.internal", "example.com", ""} {
+		if IsOutboundPrivateHostAllowed(host) {
+			t.Errorf("expected host %q not to be allowed", host)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) { //nolint:paralleltest // mutates package-level config
+	oldTrust := TrustXForwardedHeaders
+	oldNets := trustedProxyNets
+	oldExplicit := trustedProxyCIDRSExplicit
+	defer func() {
+		TrustXForwardedHeaders = oldTrust
+		trustedProxyNets = oldNets
+		trustedProxyCIDRSExplicit = oldExplicit
+	}()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.5:12345"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 198.51.100.2, 10.0.0.9")
+
+	TrustXForwardedHeaders = false
+	if ip := ClientIP(req); !ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Fatalf("expected the connection address when forwarded headers are not trusted, got %v", ip)
+	}
+
+	TrustXForwardedHeaders = true
+	trustedProxyCIDRSExplicit = true
+	trustedProxyNets = parseTrustedProxyCIDRs("10.0.0.0/8")
+	if ip := ClientIP(req); !ip.Equal(net.ParseIP("198.51.100.2")) {
+		t.Fatalf("expected the right-most untrusted hop, got %v", ip)
+	}
+
+	trustedProxyCIDRSExplicit = false
+	trustedProxyNets = nil
+	if ip := ClientIP(req); !ip.Equal(net.ParseIP("10.0.0.9")) {
+		t.Fatalf("expected the right-most hop without trusted proxy CIDRs, got %v", ip)
+	}
+
+	req.RemoteAddr = "192.0.2.1:1"
+	trustedProxyCIDRSExplicit = true
+	trustedProxyNets = parseTrustedProxyCIDRs("10.0.0.0/8")
+	if ip := ClientIP(req); !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("expected the connection address when it is not a trusted proxy, got %v", ip)
+	}
+}
+
+func TestIsAdminUser(t *testing.T) { //nolint:paralleltest // mutates package-level config
+	oldAdmins := adminUsers
+	defer func() { adminUsers = oldAdmins }()
+
+	adminUsers = parseUserList("ADMIN_USERS", "corp-oidc:alice, eu/k8s:bob, carol, :dave, /k8s:erin")
+	if len(adminUsers) != 2 {
+		t.Fatalf("expected the entries without a provider to be ignored, got %+v", adminUsers)
+	}
+	tests := []struct {
+		instance, provider, username string
+		want                         bool
+	}{
+		{instance: "eu", provider: "corp-oidc", username: "alice", want: true},
+		{instance: "us", provider: "corp-oidc", username: "alice", want: true},
+		{instance: "eu", provider: "github", username: "alice"},
+		{instance: "eu", provider: "", username: "alice"},
+		{instance: "eu", provider: "k8s", username: "bob", want: true},
+		{instance: "us", provider: "k8s", username: "bob"},
+		{instance: "eu", provider: "k8s", username: "carol"},
+	}
+	for _, tt := range tests {
+		if got := IsAdminUser(tt.instance, tt.provider, tt.username); got != tt.want {
+			t.Errorf("IsAdminUser(%q, %q, %q) = %v, want %v", tt.instance, tt.provider, tt.username, got, tt.want)
+		}
+	}
+	if !IsGlobalAdminUser("corp-oidc", "alice") || IsGlobalAdminUser("k8s", "bob") {
+		t.Error("expected only the entries without an instance to be global administrators")
+	}
+}
+
+func TestLoadInstances(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "valid", content: `[{"name":"eu","apiUrl":"https://eu.example.com/"},{"name":"us","apiUrl":"https://us.example.com","displayName":"US"}]`},
+		{name: "empty", content: `[]`, wantErr: true},
+		{name: "invalid name", content: `[{"name":"EU West","apiUrl":"https://eu.example.com"}]`, wantErr: true},
+		{name: "duplicate name", content: `[{"name":"eu","apiUrl":"https://a.example.com"},{"name":"eu","apiUrl":"https://b.example.com"}]`, wantErr: true},
+		{name: "missing api url", content: `[{"name":"eu"}]`, wantErr: true},
+		{name: "invalid url", content: `[{"name":"eu","apiUrl":"ftp://eu.example.com"}]`, wantErr: true},
+		{name: "console url", content: `[{"name":"eu","apiUrl":"https://eu.example.com","consoleUrl":"wss://console.eu.example.com/"},{"name":"us","apiUrl":"https://us.example.com","displayName":"US"}]`},
+		{name: "invalid console url", content: `[{"name":"eu","apiUrl":"https://eu.example.com","consoleUrl":"ftp://console.eu.example.com"}]`, wantErr: true},
+		{name: "missing ca file", content: `[{"name":"eu","apiUrl":"https://eu.example.com","caCertFile":"/nonexistent/ca.crt"}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "instances.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := loadInstances(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", loaded)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if loaded[0].ApiUrl != "https://eu.example.com" || loaded[0].ExternalApiUrl != loaded[0].ApiUrl {
+				t.Errorf("unexpected URLs for %s: %+v", loaded[0].Name, loaded[0])
+			}
+			if loaded[0].DisplayName != "eu" || loaded[1].DisplayName != "US" {
+				t.Errorf("unexpected display names: %q, %q", loaded[0].DisplayName, loaded[1].DisplayName)
+			}
+		})
+	}
+}
+
+func TestLoadTerminalCommandPolicies(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "valid", content: `{"*":{"deny":["^\\s*reboot\\b"]},"org1":{"confirm":["\\brm\\s+-rf\\b"]}}`},
+		{name: "invalid pattern", content: `{"org1":{"deny":["(reboot"]}}`, wantErr: true},
+		{name: "empty organization", content: `{"":{"deny":["reboot"]}}`, wantErr: true},
+		{name: "invalid JSON", content: `{"org1":{"deny":"reboot"}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "command-policy.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			policies, err := loadTerminalCommandPolicies(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %+v, %v", policies, err)
+			}
+		})
+	}
+}
+
+func TestLoadWebsocketRoutes(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "websocket-routes.json")
+	if err := os.WriteFile(path, []byte(`{"imagebuilder":[{"path":"/api/v1/imagebuilds/*/logs","maxMessageSize":4096}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := loadWebsocketRoutes(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	route := routes["imagebuilder"][0]
+	if route.MaxMessageSize != 4096 || route.WriteTimeoutSeconds != DefaultWebsocketWriteTimeout {
+		t.Errorf("unexpected route limits: %+v", route)
+	}
+
+	for _, content := range []string{
+		`{"alerts":[{"path":"/api/v2/alerts"}]}`,
+		`{"flightctl":[{"path":"api/v1/watch"}]}`,
+		`{"flightctl":[{"path":"/api/**/watch"}]}`,
+		`{"flightctl":[{"path":"/api/v1/watch","maxMessageSize":-1}]}`,
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadWebsocketRoutes(path); err == nil {
+			t.Errorf("expected an error for %s", content)
+		}
+	}
+}
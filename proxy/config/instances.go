@@ -0,0 +1,166 @@
+package config
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// DefaultInstanceName names the instance configured by the FLIGHTCTL_* variables when no instances file is used
+const DefaultInstanceName = "default"
+
+// Instance is a Flight Control deployment served by this UI. Each instance has its own upstream
+// APIs, TLS settings and authentication session.
+type Instance struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+	ApiUrl      string `json:"apiUrl"`
+	// ExternalApiUrl is the API URL shown to users in CLI login commands. Defaults to ApiUrl.
+	ExternalApiUrl  string `json:"externalApiUrl,omitempty"`
+	ImageBuilderUrl string `json:"imageBuilderUrl,omitempty"`
+	AlertManagerUrl string `json:"alertManagerUrl,omitempty"`
+	CliArtifactsUrl string `json:"cliArtifactsUrl,omitempty"`
+	// ConsoleUrl is the base URL of the device console websocket service, when it is not exposed
+	// with the API. Defaults to ApiUrl.
+	ConsoleUrl string `json:"consoleUrl,omitempty"`
+	// InsecureSkipVerify disables the TLS verification of all the upstreams of the instance
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// CACertFile is an additional CA bundle trusted for the upstreams of the instance
+	CACertFile string `json:"caCertFile,omitempty"`
+}
+
+// IsDefault reports whether requests that do not select an instance are served by this one
+func (i Instance) IsDefault() bool {
+	return len(instances) > 0 && instances[0].Name == i.Name
+}
+
+var instanceNameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// instances lists the configured Flight Control instances. The first one is the default instance.
+var instances []Instance
+
+func init() {
+	path := getEnvVar("FLIGHTCTL_INSTANCES_FILE", "")
+	if path == "" {
+		instances = []Instance{defaultInstanceFromEnv()}
+		return
+	}
+	loaded, err := loadInstances(path)
+	if err != nil {
+		log.Fatalf("config: failed to load FLIGHTCTL_INSTANCES_FILE: %v", err)
+	}
+	instances = loaded
+}
+
+// defaultInstanceFromEnv describes the single instance configured by the FLIGHTCTL_* variables
+func defaultInstanceFromEnv() Instance {
+	instance := Instance{
+		Name:               DefaultInstanceName,
+		DisplayName:        DefaultInstanceName,
+		ApiUrl:             FctlApiUrl,
+		ExternalApiUrl:     FctlApiExternalUrl,
+		ImageBuilderUrl:    FctlImageBuilderApiUrl,
+		ConsoleUrl:         FctlConsoleUrl,
+		InsecureSkipVerify: FctlApiInsecure == "true",
+		CACertFile:         "../certs/ca.crt",
+	}
+	// The optional upstreams are only enabled when explicitly configured
+	if getEnvVar("FLIGHTCTL_ALERTMANAGER_PROXY", "") != "" {
+		instance.AlertManagerUrl = AlertManagerApiUrl
+	}
+	if getEnvVar("FLIGHTCTL_CLI_ARTIFACTS_SERVER", "") != "" {
+		instance.CliArtifactsUrl = FctlCliArtifactsUrl
+	}
+	return instance
+}
+
+func loadInstances(path string) ([]Instance, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var loaded []Instance
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if len(loaded) == 0 {
+		return nil, errors.New("no instances defined")
+	}
+
+	names := map[string]bool{}
+	for i := range loaded {
+		instance := &loaded[i]
+		if !instanceNameRegex.MatchString(instance.Name) {
+			return nil, fmt.Errorf("invalid instance name %q: must be a lowercase DNS label", instance.Name)
+		}
+		if names[instance.Name] {
+			return nil, fmt.Errorf("duplicate instance name %q", instance.Name)
+		}
+		names[instance.Name] = true
+
+		if instance.ApiUrl == "" {
+			return nil, fmt.Errorf("instance %q has no apiUrl", instance.Name)
+		}
+		for _, u := range []*string{&instance.ApiUrl, &instance.ExternalApiUrl, &instance.ImageBuilderUrl, &instance.AlertManagerUrl, &instance.CliArtifactsUrl} {
+			if *u == "" {
+				continue
+			}
+			*u = strings.TrimSuffix(*u, "/")
+			parsed, err := url.Parse(*u)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("instance %q has an invalid URL %q", instance.Name, *u)
+			}
+		}
+		if instance.ConsoleUrl != "" {
+			instance.ConsoleUrl = strings.TrimSuffix(instance.ConsoleUrl, "/")
+			parsed, err := url.Parse(instance.ConsoleUrl)
+			if err != nil || !slices.Contains([]string{"http", "https", "ws", "wss"}, parsed.Scheme) || parsed.Host == "" {
+				return nil, fmt.Errorf("instance %q has an invalid console URL %q", instance.Name, instance.ConsoleUrl)
+			}
+		}
+		if instance.CACertFile != "" {
+			// Unlike the CA of the FLIGHTCTL_* variables, a CA configured for an instance must exist
+			caCert, err := os.ReadFile(instance.CACertFile)
+			if err != nil {
+				return nil, fmt.Errorf("instance %q has an unreadable caCertFile: %w", instance.Name, err)
+			}
+			if !x509.NewCertPool().AppendCertsFromPEM(caCert) {
+				return nil, fmt.Errorf("instance %q has no PEM certificate in caCertFile %q", instance.Name, instance.CACertFile)
+			}
+		}
+		if instance.ExternalApiUrl == "" {
+			instance.ExternalApiUrl = instance.ApiUrl
+		}
+		if instance.DisplayName == "" {
+			instance.DisplayName = instance.Name
+		}
+	}
+	return loaded, nil
+}
+
+// Instances returns the configured Flight Control instances, the default one first
+func Instances() []Instance {
+	return instances
+}
+
+// DefaultInstance returns the instance serving requests that do not select one
+func DefaultInstance() Instance {
+	return instances[0]
+}
+
+// GetInstance returns the instance with the given name
+func GetInstance(name string) (Instance, bool) {
+	for _, instance := range instances {
+		if instance.Name == name {
+			return instance, true
+		}
+	}
+	return Instance{}, false
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Policy actions
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// ApiPolicyRule matches forwarded calls by method and path. Paths are matched against the path
+// sent to the upstream, e.g. /api/v1/devices/my-device, where "*" matches a single segment and
+// a trailing "/**" matches any number of segments.
+type ApiPolicyRule struct {
+	Action string `json:"action"`
+	// Methods the rule applies to. An empty list matches every method.
+	Methods []string `json:"methods,omitempty"`
+	Path    string   `json:"path"`
+}
+
+// ApiUpstreamPolicy lists the rules of an upstream, evaluated in order. Calls that match no rule
+// get the default action, which is to allow them unless configured otherwise.
+type ApiUpstreamPolicy struct {
+	Default string          `json:"default,omitempty"`
+	Rules   []ApiPolicyRule `json:"rules"`
+}
+
+// ApiPolicyUpstreams are the keys of the policy file, named after the /api/<upstream>/ route prefixes
+var ApiPolicyUpstreams = []string{"flightctl", "imagebuilder", "alerts", "cli-artifacts"}
+
+// ApiPolicies holds the policy of each upstream, loaded from API_POLICY_FILE
+var ApiPolicies = map[string]ApiUpstreamPolicy{}
+
+func init() {
+	if ApiPolicyFile == "" {
+		return
+	}
+	policies, err := loadApiPolicies(ApiPolicyFile)
+	if err != nil {
+		log.Fatalf("config: failed to load API_POLICY_FILE: %v", err)
+	}
+	ApiPolicies = policies
+}
+
+func loadApiPolicies(path string) (map[string]ApiUpstreamPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policies map[string]ApiUpstreamPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	for upstream, policy := range policies {
+		known := false
+		for _, name := range ApiPolicyUpstreams {
+			known = known || name == upstream
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown upstream %q, expected one of %s", upstream, strings.Join(ApiPolicyUpstreams, ", "))
+		}
+		if policy.Default != "" && policy.Default != PolicyAllow && policy.Default != PolicyDeny {
+			return nil, fmt.Errorf("upstream %q has an invalid default action %q", upstream, policy.Default)
+		}
+		for i, rule := range policy.Rules {
+			if rule.Action != PolicyAllow && rule.Action != PolicyDeny {
+				return nil, fmt.Errorf("rule %d of upstream %q has an invalid action %q", i, upstream, rule.Action)
+			}
+			if !strings.HasPrefix(rule.Path, "/") {
+				return nil, fmt.Errorf("rule %d of upstream %q must have a path starting with /", i, upstream)
+			}
+			if strings.Contains(strings.TrimSuffix(rule.Path, "/**"), "**") {
+				return nil, fmt.Errorf("rule %d of upstream %q may only use ** as the last path segment", i, upstream)
+			}
+			for j, method := range rule.Methods {
+				if method == "" {
+					return nil, fmt.Errorf("rule %d of upstream %q has an empty method", i, upstream)
+				}
+				policy.Rules[i].Methods[j] = strings.ToUpper(method)
+			}
+		}
+	}
+	return policies, nil
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Defaults of the WebSocket routes
+const (
+	DefaultWebsocketMaxMessageSize = 1024 * 1024
+	DefaultWebsocketWriteTimeout   = 30
+)
+
+// WebsocketRoute allows WebSocket connections to the upstream paths matching Path, where "*"
+// matches a single segment and a trailing "/**" matches any number of segments.
+type WebsocketRoute struct {
+	Path string `json:"path"`
+	// MaxMessageSize is the largest message accepted from either end, in bytes
+	MaxMessageSize int64 `json:"maxMessageSize,omitempty"`
+	// WriteTimeoutSeconds is how long an end can take to accept a message before the connection is
+	// closed, so that a slow end does not hold up the other one forever
+	WriteTimeoutSeconds int `json:"writeTimeoutSeconds,omitempty"`
+}
+
+// WebsocketRouteUpstreams are the keys of the WebSocket routes file, named after the /api/ws/<upstream>/ route prefixes
+var WebsocketRouteUpstreams = []string{"flightctl", "imagebuilder"}
+
+// WebsocketRoutes holds the allowed routes of each upstream, loaded from WEBSOCKET_ROUTES_FILE.
+// Upstreams without routes accept no WebSocket connection.
+var WebsocketRoutes = map[string][]WebsocketRoute{}
+
+func init() {
+	if WebsocketRoutesFile == "" {
+		return
+	}
+	routes, err := loadWebsocketRoutes(WebsocketRoutesFile)
+	if err != nil {
+		log.Fatalf("config: failed to load WEBSOCKET_ROUTES_FILE: %v", err)
+	}
+	WebsocketRoutes = routes
+}
+
+func loadWebsocketRoutes(path string) (map[string][]WebsocketRoute, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var routes map[string][]WebsocketRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	for upstream, upstreamRoutes := range routes {
+		known := false
+		for _, name := range WebsocketRouteUpstreams {
+			known = known || name == upstream
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown upstream %q, expected one of %s", upstream, strings.Join(WebsocketRouteUpstreams, ", "))
+		}
+		for i, route := range upstreamRoutes {
+			if !strings.HasPrefix(route.Path, "/") {
+				return nil, fmt.Errorf("route %d of upstream %q must have a path starting with /", i, upstream)
+			}
+			if strings.Contains(strings.TrimSuffix(route.Path, "/**"), "**") {
+				return nil, fmt.Errorf("route %d of upstream %q may only use ** as the last path segment", i, upstream)
+			}
+			if route.MaxMessageSize < 0 || route.WriteTimeoutSeconds < 0 {
+				return nil, fmt.Errorf("route %d of upstream %q has a negative limit", i, upstream)
+			}
+			if route.MaxMessageSize == 0 {
+				upstreamRoutes[i].MaxMessageSize = DefaultWebsocketMaxMessageSize
+			}
+			if route.WriteTimeoutSeconds == 0 {
+				upstreamRoutes[i].WriteTimeoutSeconds = DefaultWebsocketWriteTimeout
+			}
+		}
+	}
+	return routes, nil
+}
@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is a family of values sharing a name, identified by their label values
+type metric struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	labels map[string][]string
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*metric
+)
+
+func register(name, help, kind string, labelNames []string) *metric {
+	m := &metric{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		values:     map[string]float64{},
+		labels:     map[string][]string{},
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+	return m
+}
+
+func (m *metric) add(delta float64, labelValues []string) {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.labels[key]; !ok {
+		m.labels[key] = append([]string(nil), labelValues...)
+	}
+	m.values[key] += delta
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	m *metric
+}
+
+// NewCounterVec registers a counter exported under name
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{m: register(name, help, "counter", labelNames)}
+}
+
+// Inc increments the counter for the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.m.add(1, labelValues)
+}
+
+// GaugeVec is a value that can go up and down, partitioned by labels
+type GaugeVec struct {
+	m *metric
+}
+
+// NewGaugeVec registers a gauge exported under name
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{m: register(name, help, "gauge", labelNames)}
+}
+
+// Add changes the gauge for the given label values by delta
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.m.add(delta, labelValues)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+func (m *metric) write(sb *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sb.WriteString(m.name)
+		if len(m.labelNames) > 0 {
+			pairs := make([]string, len(m.labelNames))
+			for i, labelName := range m.labelNames {
+				pairs[i] = fmt.Sprintf(`%s="%s"`, labelName, escapeLabelValue(m.labels[key][i]))
+			}
+			sb.WriteString("{" + strings.Join(pairs, ",") + "}")
+		}
+		sb.WriteString(" " + strconv.FormatFloat(m.values[key], 'f', -1, 64) + "\n")
+	}
+}
+
+// Handler serves all registered metrics in the Prometheus text exposition format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMu.Lock()
+		metrics := append([]*metric(nil), registry...)
+		registryMu.Unlock()
+
+		var sb strings.Builder
+		for _, m := range metrics {
+			m.write(&sb)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write([]byte(sb.String()))
+	})
+}
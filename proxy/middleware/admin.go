@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+)
+
+// RequireAdmin restricts a handler to the users listed in ADMIN_USERS, matched on the provider and
+// instance of their session. It must run after UserIdentityMiddleware, which resolves the username and
+// provider of the session.
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := common.UserIdentityFromContext(r.Context())
+		instance := common.InstanceFromContext(r.Context())
+		if !config.IsAdminUser(instance.Name, identity.Provider, identity.Username) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"error": "This endpoint is restricted to administrators",
+				"code":  "ADMIN_REQUIRED",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
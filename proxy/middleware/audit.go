@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/audit"
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+)
+
+// maxAuditedBodySize limits how much of a request body is kept for the audit log
+const maxAuditedBodySize = 64 * 1024
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func isAuditedAPICall(path string) bool {
+	return isFlightCtlAPICall(path) || isImageBuilderAPICall(path) || isAlertsAPICall(path)
+}
+
+// readAuditedBody reads the beginning of the request body for the audit log, and restores
+// the body so it is still forwarded in full.
+func readAuditedBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAuditedBodySize+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil {
+		return nil, false
+	}
+	if len(body) > maxAuditedBodySize {
+		return nil, true
+	}
+	return body, false
+}
+
+// AuditMiddleware records every mutating call to the Flight Control, ImageBuilder and AlertManager APIs.
+// It must run before OrganizationMiddleware, which removes the organization header.
+func AuditMiddleware(resolveUsername func(ctx context.Context, token string) (string, error)) func(http.Handler) http.Handler {
+	withUserIdentity := UserIdentityMiddleware(resolveUsername)
+	return func(next http.Handler) http.Handler {
+		audited := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entry := audit.Entry{
+				Event:        audit.EventAPICall,
+				RequestID:    r.Header.Get(common.RequestIDHeader),
+				Instance:     common.InstanceFromContext(r.Context()).Name,
+				Organization: r.Header.Get(headerOrganizationID),
+				Method:       r.Method,
+				Path:         r.URL.Path,
+			}
+			if identity, ok := common.UserIdentityFromContext(r.Context()); ok {
+				entry.Username = identity.Username
+				entry.Provider = identity.Provider
+			}
+			if ip := config.ClientIP(r); ip != nil {
+				entry.ClientIP = ip.String()
+			}
+			if config.AuditLogBodies == "true" {
+				body, truncated := readAuditedBody(r)
+				if truncated {
+					entry.Detail = "request body too large to be recorded"
+				} else {
+					entry.Body = audit.RedactBody(body)
+				}
+			}
+
+			recorder := common.NewStatusRecorder(w)
+			start := time.Now()
+			next.ServeHTTP(recorder, r)
+
+			entry.Status = recorder.Status()
+			entry.DurationMs = time.Since(start).Milliseconds()
+			audit.Record(entry)
+		})
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !audit.Enabled() || !isMutatingMethod(r.Method) || !isAuditedAPICall(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			withUserIdentity(audited).ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/flightctl/flightctl-ui/auth"
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/log"
+)
+
+// UserIdentityMiddleware stores the identity of the session user in the request context.
+// It does not enforce authentication: when the username cannot be resolved the request
+// continues without it, and the upstream API remains responsible for rejecting it.
+func UserIdentityMiddleware(resolveUsername func(ctx context.Context, token string) (string, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenData, err := auth.ParseSessionCookie(r)
+			if err != nil || tokenData.Token == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The provider of the cookie is chosen by the client, only the one recorded at login is trusted
+			identity := common.UserIdentity{Provider: auth.SessionProvider(common.InstanceFromContext(r.Context()).Name, tokenData.Token)}
+			username, err := resolveUsername(r.Context(), tokenData.Token)
+			if err != nil {
+				log.GetLogger().WithError(err).Debug("Failed to resolve the username for the session")
+			} else {
+				identity.Username = username
+			}
+			next.ServeHTTP(w, r.WithContext(common.WithUserIdentity(r.Context(), identity)))
+		})
+	}
+}
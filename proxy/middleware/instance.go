@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+)
+
+// InstanceMiddleware selects the Flight Control instance that serves the request, from the
+// /api/instances/<name>/ path prefix or the X-FlightCtl-Instance header, and falls back to the
+// default instance. The path prefix is removed so that the request matches the regular API routes,
+// which is why this middleware must wrap the router instead of being registered on it.
+func InstanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get(common.InstanceHeader)
+		if rest, found := strings.CutPrefix(r.URL.Path, common.InstancePathPrefix); found {
+			var forward string
+			name, forward, _ = strings.Cut(rest, "/")
+			r.URL.Path = "/api/" + forward
+			if rawRest, found := strings.CutPrefix(r.URL.RawPath, common.InstancePathPrefix); found {
+				_, rawForward, _ := strings.Cut(rawRest, "/")
+				r.URL.RawPath = "/api/" + rawForward
+			} else {
+				r.URL.RawPath = ""
+			}
+		}
+
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		instance, ok := config.GetInstance(name)
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"error": fmt.Sprintf("Unknown Flight Control instance %q", name),
+				"code":  "INSTANCE_NOT_FOUND",
+			})
+			return
+		}
+		r.Header.Del(common.InstanceHeader)
+		next.ServeHTTP(w, r.WithContext(common.WithInstance(r.Context(), instance)))
+	})
+}
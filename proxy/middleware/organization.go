@@ -1,19 +1,31 @@
 package middleware
 
 import (
+	"encoding/json"
 	"net/http"
 	"strings"
+
+	"github.com/flightctl/flightctl-ui/common"
 )
 
 const (
 	headerOrganizationID = "X-FlightCtl-Organization-ID"
 	queryOrganizationID  = "org_id"
+	// cookieOrganizationID can carry the selected organization of WebSocket connections, for which
+	// browsers can neither set headers nor, in some embeddings, control the query string
+	cookieOrganizationID = "flightctl-organization-id"
 )
 
 // OrganizationMiddleware adds org_id query parameter to FlightCtl API requests
 // and blocks API calls when no organization is selected
 func OrganizationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTerminalCall(r.URL.Path) || isWebsocketCall(r.URL.Path) {
+			scopeWebsocketRequest(r)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// Don't add org_id to requests that don't need it, and for CORS preflight requests
 		if r.Method == http.MethodOptions || !shouldAddOrgIDFromHeader(r.URL.Path) {
 			next.ServeHTTP(w, r)
@@ -33,8 +45,15 @@ func OrganizationMiddleware(next http.Handler) http.Handler {
 		query := r.URL.Query()
 
 		if isAlertsAPICall(r.URL.Path) {
-			// AlertManager expects org_id as a filter parameter
-			query.Set("filter", "org_id="+orgID)
+			// AlertManager expects org_id as a filter parameter. Its filters are combined, so the
+			// organization matcher is added to the ones sent by the UI.
+			if err := common.ValidateOrgAlertFilters(query["filter"], orgID); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error(), "code": "INVALID_ORGANIZATION_FILTER"})
+				return
+			}
+			query.Add("filter", common.OrgIDLabel+"="+orgID)
 		} else {
 			query.Set(queryOrganizationID, orgID)
 		}
@@ -48,6 +67,42 @@ func OrganizationMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// scopeWebsocketRequest resolves the organization of a terminal session or another WebSocket
+// connection from the header, the org_id query parameter or the organization cookie, in that
+// order, and leaves it in the org_id query parameter. Connections without a valid organization
+// are rejected by their handler, which can report the error with a WebSocket close frame.
+func scopeWebsocketRequest(r *http.Request) {
+	query := r.URL.Query()
+	orgID := r.Header.Get(headerOrganizationID)
+	if orgID == "" {
+		orgID = query.Get(queryOrganizationID)
+	}
+	if orgID == "" {
+		if cookie, err := r.Cookie(cookieOrganizationID); err == nil {
+			orgID = cookie.Value
+		}
+	}
+	if orgID == "" {
+		query.Del(queryOrganizationID)
+	} else {
+		query.Set(queryOrganizationID, orgID)
+	}
+	r.URL.RawQuery = query.Encode()
+	r.Header.Del(headerOrganizationID)
+}
+
+func isTerminalCall(path string) bool {
+	return strings.HasPrefix(path, "/api/terminal/")
+}
+
+func isWebsocketCall(path string) bool {
+	return strings.HasPrefix(path, "/api/ws/")
+}
+
+func isConsoleBroadcastCall(path string) bool {
+	return path == "/api/console/broadcast"
+}
+
 func isFlightCtlAPICall(path string) bool {
 	return strings.HasPrefix(path, "/api/flightctl/")
 }
@@ -72,5 +127,5 @@ func shouldAddOrgIDFromHeader(path string) bool {
 		}
 		return true
 	}
-	return isAlertsAPICall(path) || isImageBuilderAPICall(path)
+	return isAlertsAPICall(path) || isImageBuilderAPICall(path) || isConsoleBroadcastCall(path)
 }
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/flightctl/flightctl-ui/common"
+)
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// RequestIDMiddleware makes sure that every API request carries a request ID, which is forwarded
+// upstream and returned to the client. A well-formed ID sent by the client is kept.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(common.RequestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		r.Header.Set(common.RequestIDHeader, requestID)
+		w.Header().Set(common.RequestIDHeader, requestID)
+		next.ServeHTTP(w, r)
+	})
+}
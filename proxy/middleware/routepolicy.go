@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+)
+
+// RoutePolicy limits the requests served under a path prefix. A zero value disables the limit.
+type RoutePolicy struct {
+	Prefix string
+	// MaxBodySize is the largest request body accepted, in bytes
+	MaxBodySize int64
+	// TotalTimeout caps ordinary requests, from reading the request until the response is written
+	TotalTimeout time.Duration
+	// IdleTimeout replaces TotalTimeout once a streaming response is detected, and closes
+	// the stream when nothing has been written for that long
+	IdleTimeout time.Duration
+}
+
+// timeoutResponseMargin leaves time to write the timeout response itself once the total timeout
+// expires. The connection deadlines must expire after the timer, which cancels the request with
+// common.ErrRequestTimeout as the cause.
+var timeoutResponseMargin = 5 * time.Second
+
+const (
+	kib = 1024
+	mib = 1024 * kib
+)
+
+// routePolicies is matched in order, so longer prefixes must come first
+var routePolicies = []RoutePolicy{
+	// WebSocket connections manage their own keepalive and lifetime once upgraded
+	{Prefix: "/api/terminal/"},
+	{Prefix: "/api/ws/"},
+	{Prefix: "/api/admin/terminal-sessions/"},
+	// Recordings can be large, and are downloaded at the pace of the player
+	{Prefix: "/api/admin/terminal-recordings/", MaxBodySize: 64 * kib, TotalTimeout: 10 * time.Minute},
+	// Console broadcasts stream their results for as long as the commands run, each bounded by its own timeout
+	{Prefix: "/api/console/", MaxBodySize: 64 * kib},
+	{Prefix: "/api/login", MaxBodySize: 64 * kib, TotalTimeout: 30 * time.Second},
+	{Prefix: "/api/logout", MaxBodySize: 64 * kib, TotalTimeout: 30 * time.Second},
+	// Testing a provider makes several outbound requests, each bounded by its own timeout
+	{Prefix: "/api/test-auth-provider-", MaxBodySize: 256 * kib, TotalTimeout: 90 * time.Second},
+	{Prefix: "/api/flightctl/", MaxBodySize: 10 * mib, TotalTimeout: config.ApiRequestTimeout, IdleTimeout: config.ApiStreamIdleTimeout},
+	{Prefix: "/api/imagebuilder/", MaxBodySize: 10 * mib, TotalTimeout: config.ApiRequestTimeout, IdleTimeout: config.ApiStreamIdleTimeout},
+	{Prefix: "/api/alerts/", MaxBodySize: 1 * mib, TotalTimeout: config.ApiRequestTimeout, IdleTimeout: config.ApiStreamIdleTimeout},
+	{Prefix: "/api/", MaxBodySize: 1 * mib, TotalTimeout: config.ApiRequestTimeout, IdleTimeout: config.ApiStreamIdleTimeout},
+	// Static UI assets
+	{Prefix: "/", MaxBodySize: 64 * kib, TotalTimeout: 60 * time.Second},
+}
+
+func routePolicyFor(path string) RoutePolicy {
+	for _, policy := range routePolicies {
+		if strings.HasPrefix(path, policy.Prefix) {
+			return policy
+		}
+	}
+	return RoutePolicy{}
+}
+
+// isStreamingResponse detects responses that are delivered progressively, such as server-sent
+// events and followed logs, and must not be cut off by the total timeout
+func isStreamingResponse(r *http.Request, header http.Header) bool {
+	contentType := header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "text/event-stream") || strings.HasPrefix(contentType, "application/x-ndjson") {
+		return true
+	}
+	return r.URL.Query().Get("follow") == "true"
+}
+
+// policyResponseWriter switches a request from its total timeout to its idle timeout once the
+// response turns out to be a stream, and then extends the deadlines on every write
+type policyResponseWriter struct {
+	*common.StatusRecorder
+	r          *http.Request
+	controller *http.ResponseController
+	policy     RoutePolicy
+	cancel     context.CancelCauseFunc
+
+	// mu guards the fields below, which the timers read
+	mu          sync.Mutex
+	wroteHeader bool
+	streaming   bool
+	totalTimer  *time.Timer
+	idleTimer   *time.Timer
+}
+
+func (p *policyResponseWriter) WriteHeader(status int) {
+	p.mu.Lock()
+	if !p.wroteHeader {
+		p.wroteHeader = true
+		if p.policy.IdleTimeout > 0 && isStreamingResponse(p.r, p.Header()) {
+			p.streaming = true
+			if p.totalTimer != nil {
+				p.totalTimer.Stop()
+			}
+			p.idleTimer = time.AfterFunc(p.policy.IdleTimeout, func() { p.cancel(common.ErrStreamIdleTimeout) })
+			// An expired read deadline would cancel the request in the middle of the stream
+			_ = p.controller.SetReadDeadline(time.Time{})
+			_ = p.controller.SetWriteDeadline(time.Now().Add(p.policy.IdleTimeout))
+		}
+	}
+	p.mu.Unlock()
+	p.StatusRecorder.WriteHeader(status)
+}
+
+func (p *policyResponseWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	wroteHeader := p.wroteHeader
+	p.mu.Unlock()
+	if !wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+
+	p.mu.Lock()
+	if p.streaming {
+		p.idleTimer.Reset(p.policy.IdleTimeout)
+		_ = p.controller.SetWriteDeadline(time.Now().Add(p.policy.IdleTimeout))
+	}
+	p.mu.Unlock()
+	return p.StatusRecorder.Write(b)
+}
+
+func (p *policyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	p.stopTimers()
+	return p.StatusRecorder.Hijack()
+}
+
+func (p *policyResponseWriter) stopTimers() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.totalTimer != nil {
+		p.totalTimer.Stop()
+	}
+	if p.idleTimer != nil {
+		p.idleTimer.Stop()
+	}
+}
+
+func respondRequestTooLarge(w http.ResponseWriter, maxBodySize int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	_, _ = w.Write([]byte(fmt.Sprintf(`{"error": "Request body exceeds the limit of %d bytes", "code": "REQUEST_TOO_LARGE"}`, maxBodySize)))
+}
+
+// RoutePolicyMiddleware applies the body size limit and the timeouts of the route policy matching the request.
+// Timeouts cancel the request context with common.ErrRequestTimeout or common.ErrStreamIdleTimeout as the cause.
+func RoutePolicyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := routePolicyFor(r.URL.Path)
+		controller := http.NewResponseController(w)
+
+		if policy.MaxBodySize > 0 {
+			if r.ContentLength > policy.MaxBodySize {
+				respondRequestTooLarge(w, policy.MaxBodySize)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, policy.MaxBodySize)
+		}
+
+		if policy.TotalTimeout <= 0 && policy.IdleTimeout <= 0 {
+			// The server-wide deadlines do not apply to long-lived routes
+			_ = controller.SetReadDeadline(time.Time{})
+			_ = controller.SetWriteDeadline(time.Time{})
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		pw := &policyResponseWriter{StatusRecorder: common.NewStatusRecorder(w), controller: controller, policy: policy, cancel: cancel}
+		if policy.TotalTimeout > 0 {
+			_ = controller.SetReadDeadline(time.Now().Add(policy.TotalTimeout + timeoutResponseMargin))
+			_ = controller.SetWriteDeadline(time.Now().Add(policy.TotalTimeout + timeoutResponseMargin))
+			pw.totalTimer = time.AfterFunc(policy.TotalTimeout, func() { cancel(common.ErrRequestTimeout) })
+		} else {
+			_ = controller.SetWriteDeadline(time.Time{})
+		}
+		defer pw.stopTimers()
+
+		pw.r = r.WithContext(ctx)
+		next.ServeHTTP(pw, pw.r)
+	})
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/common"
+)
+
+func TestRoutePolicyStreamsOutliveTotalTimeout(t *testing.T) { //nolint:paralleltest // replaces the route policies
+	oldPolicies, oldMargin := routePolicies, timeoutResponseMargin
+	defer func() { routePolicies, timeoutResponseMargin = oldPolicies, oldMargin }()
+	timeoutResponseMargin = 50 * time.Millisecond
+	routePolicies = []RoutePolicy{{Prefix: "/", TotalTimeout: 200 * time.Millisecond, IdleTimeout: time.Second}}
+
+	causes := make(chan error, 2)
+	server := httptest.NewServer(RoutePolicyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+		for i := 0; i < 6; i++ {
+			if _, err := fmt.Fprintf(w, "data: %d\n\n", i); err != nil {
+				break
+			}
+			http.NewResponseController(w).Flush()
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-r.Context().Done():
+			}
+			if r.Context().Err() != nil {
+				break
+			}
+		}
+		causes <- context.Cause(r.Context())
+	})))
+	defer server.Close()
+
+	// A stream keeps going past the total timeout, as long as it writes within the idle timeout
+	resp, err := http.Get(server.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "data:") {
+			events++
+		}
+	}
+	resp.Body.Close()
+	if cause := <-causes; cause != nil || events != 6 {
+		t.Errorf("expected the stream to complete, got %d events and %v", events, cause)
+	}
+
+	// Ordinary responses are cancelled at the total timeout
+	resp, err = http.Get(server.URL + "/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if cause := <-causes; !errors.Is(cause, common.ErrRequestTimeout) {
+		t.Errorf("expected the request to time out, got %v", cause)
+	}
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/tracing"
+	"github.com/gorilla/mux"
+)
+
+// TracingMiddleware continues the trace received in the traceparent/tracestate headers, or starts a new one,
+// and records a server span for the request. It must run after RequestIDMiddleware.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.Extract(r.Context(), r.Header)
+		// Span names must have a low cardinality, the path is only recorded as an attribute
+		name := r.Method
+		var route string
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		if route != "" {
+			name += " " + route
+		}
+		ctx, span := tracing.Start(ctx, name, trace.SpanKindServer,
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+			attribute.String("http.request_id", r.Header.Get(common.RequestIDHeader)),
+			attribute.String("flightctl.instance", common.InstanceFromContext(r.Context()).Name),
+		)
+		if route != "" {
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		if ip := config.ClientIP(r); ip != nil {
+			span.SetAttributes(semconv.ClientAddress(ip.String()))
+		}
+
+		recorder := common.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		tracing.EndWithStatus(span, recorder.Status(), nil)
+	})
+}
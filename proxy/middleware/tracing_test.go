@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+)
+
+func TestTracingMiddlewareNamesSpansAfterTheRoute(t *testing.T) { //nolint:paralleltest // replaces the global tracer provider
+	spans := tracetest.NewSpanRecorder()
+	oldProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	defer otel.SetTracerProvider(oldProvider)
+
+	router := mux.NewRouter()
+	router.Use(TracingMiddleware)
+	// Routes are registered on subrouters, such as the one of /api
+	router.PathPrefix("/api").Subrouter().HandleFunc("/devices/{name}", func(w http.ResponseWriter, r *http.Request) {})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/devices/dev1", nil))
+
+	ended := spans.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("expected one server span, got %d", len(ended))
+	}
+	if ended[0].Name() != "GET /api/devices/{name}" {
+		t.Errorf("expected the span to be named after the route, got %q", ended[0].Name())
+	}
+	attributes := map[string]string{}
+	for _, attr := range ended[0].Attributes() {
+		attributes[string(attr.Key)] = attr.Value.Emit()
+	}
+	if attributes[string(semconv.URLPathKey)] != "/api/devices/dev1" || attributes[string(semconv.HTTPRouteKey)] != "/api/devices/{name}" {
+		t.Errorf("expected the path and route attributes, got %v", attributes)
+	}
+}
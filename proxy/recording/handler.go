@@ -0,0 +1,119 @@
+package recording
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/flightctl/flightctl-ui/audit"
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/log"
+	"github.com/gorilla/mux"
+)
+
+func writeError(w http.ResponseWriter, status int, message, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message, "code": code})
+}
+
+// inScope tells whether the administrator of the request may access the recording. Only the global
+// administrators reach the recordings of the other instances.
+func inScope(r *http.Request, info Info) bool {
+	identity, _ := common.UserIdentityFromContext(r.Context())
+	return info.Instance == common.InstanceFromContext(r.Context()).Name ||
+		config.IsGlobalAdminUser(identity.Provider, identity.Username)
+}
+
+// ListHandler returns the stored recordings of the instance, or of all the instances for the global
+// administrators, most recent first. They can be filtered with the device, user, org and instance
+// query parameters.
+func ListHandler(w http.ResponseWriter, r *http.Request) {
+	s := recordings
+	if s == nil {
+		writeError(w, http.StatusNotImplemented, "Terminal recording is not enabled", "RECORDING_DISABLED")
+		return
+	}
+	infos, err := s.list()
+	if err != nil {
+		log.GetLogger().WithError(err).Error("Failed to list the terminal recordings")
+		writeError(w, http.StatusInternalServerError, "Failed to list the terminal recordings", "RECORDING_ERROR")
+		return
+	}
+	query := r.URL.Query()
+	matches := func(filter, value string) bool {
+		return query.Get(filter) == "" || query.Get(filter) == value
+	}
+	filtered := []Info{}
+	for _, info := range infos {
+		if inScope(r, info) && matches("device", info.Device) && matches("user", info.Username) &&
+			matches("org", info.Organization) && matches("instance", info.Instance) {
+			filtered = append(filtered, info)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(filtered)
+}
+
+// GetHandler streams a recording, to be played back with an asciicast player. Recordings in
+// progress are returned up to their last event.
+func GetHandler(w http.ResponseWriter, r *http.Request) {
+	s := recordings
+	if s == nil {
+		writeError(w, http.StatusNotImplemented, "Terminal recording is not enabled", "RECORDING_DISABLED")
+		return
+	}
+	id := mux.Vars(r)["id"]
+	path, ok := s.path(id)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Invalid recording ID", "INVALID_RECORDING_ID")
+		return
+	}
+	info, err := s.readInfo(id)
+	if err == nil && !inScope(r, info) {
+		err = os.ErrNotExist
+	}
+	var file *os.File
+	if err == nil {
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeError(w, http.StatusNotFound, "Recording not found", "RECORDING_NOT_FOUND")
+			return
+		}
+		log.GetLogger().WithError(err).Errorf("Failed to open terminal recording %s", id)
+		writeError(w, http.StatusInternalServerError, "Failed to open the recording", "RECORDING_ERROR")
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to open the recording", "RECORDING_ERROR")
+		return
+	}
+
+	// Playing back a session reveals everything that was typed and displayed in it
+	entry := audit.Entry{
+		Event:     audit.EventRecordingView,
+		RequestID: r.Header.Get(common.RequestIDHeader),
+		Instance:  info.Instance,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Detail:    id,
+	}
+	if identity, ok := common.UserIdentityFromContext(r.Context()); ok {
+		entry.Username = identity.Username
+		entry.Provider = identity.Provider
+	}
+	if ip := config.ClientIP(r); ip != nil {
+		entry.ClientIP = ip.String()
+	}
+	audit.Record(entry)
+
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, id+fileExtension, stat.ModTime(), file)
+}
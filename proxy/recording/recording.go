@@ -0,0 +1,386 @@
+package recording
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/log"
+)
+
+const (
+	fileExtension = ".cast"
+	// cleanupInterval is how often expired recordings are deleted
+	cleanupInterval = 10 * time.Minute
+	defaultWidth    = 80
+	defaultHeight   = 24
+)
+
+// Asciicast v2 event types
+const (
+	eventOutput = "o"
+	eventInput  = "i"
+	eventResize = "r"
+	eventMarker = "m"
+)
+
+var recordingIDRegex = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}Z-[0-9a-f]{16}$`)
+
+// Metadata identifies the terminal session of a recording. It is stored in the "flightctl" field
+// of the asciicast header, which players ignore.
+type Metadata struct {
+	SessionID    string    `json:"sessionId"`
+	Username     string    `json:"username,omitempty"`
+	Provider     string    `json:"provider,omitempty"`
+	Instance     string    `json:"instance,omitempty"`
+	Organization string    `json:"organization,omitempty"`
+	Device       string    `json:"device"`
+	ClientIP     string    `json:"clientIp,omitempty"`
+	StartedAt    time.Time `json:"startedAt"`
+}
+
+type header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Metadata  Metadata          `json:"flightctl"`
+}
+
+type store struct {
+	dir          string
+	maxSize      int64
+	maxTotalSize int64
+	retention    time.Duration
+
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+var recordings *store
+
+// Init enables the recording of terminal sessions when a recording directory is configured, and
+// starts deleting the recordings that exceed the retention limits
+func Init() error {
+	if config.TerminalRecordingDir == "" {
+		recordings = nil
+		return nil
+	}
+	if err := os.MkdirAll(config.TerminalRecordingDir, 0o750); err != nil {
+		return fmt.Errorf("failed to create the terminal recording directory: %w", err)
+	}
+	recordings = &store{
+		dir:          config.TerminalRecordingDir,
+		maxSize:      int64(config.TerminalRecordingMaxSizeMB) * 1024 * 1024,
+		maxTotalSize: int64(config.TerminalRecordingMaxTotalSizeMB) * 1024 * 1024,
+		retention:    config.TerminalRecordingRetention,
+		active:       map[string]bool{},
+	}
+	go func(s *store) {
+		for {
+			s.cleanup(time.Now())
+			time.Sleep(cleanupInterval)
+		}
+	}(recordings)
+	return nil
+}
+
+// Enabled reports whether terminal sessions are being recorded
+func Enabled() bool {
+	return recordings != nil
+}
+
+// NewSessionID returns a random identifier for a terminal session
+func NewSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Recorder writes the events of a terminal session to an asciicast v2 file. A nil Recorder
+// records nothing, so that callers do not have to check whether recording is enabled.
+type Recorder struct {
+	store *store
+	id    string
+	meta  Metadata
+
+	mu            sync.Mutex
+	file          *os.File
+	size          int64
+	headerWritten bool
+	stopped       bool
+	width, height int
+	// partial holds the bytes of a UTF-8 character split across messages, for each event type
+	partial map[string][]byte
+}
+
+// NewRecorder starts the recording of a terminal session, or returns nil when recording is disabled
+func NewRecorder(meta Metadata) (*Recorder, error) {
+	s := recordings
+	if s == nil {
+		return nil, nil
+	}
+	if meta.StartedAt.IsZero() {
+		meta.StartedAt = time.Now()
+	}
+	if meta.SessionID == "" {
+		meta.SessionID = NewSessionID()
+	}
+	id := meta.StartedAt.UTC().Format("20060102T150405Z") + "-" + meta.SessionID
+	if !recordingIDRegex.MatchString(id) {
+		return nil, fmt.Errorf("invalid session ID %q", meta.SessionID)
+	}
+	file, err := os.OpenFile(filepath.Join(s.dir, id+fileExtension), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the recording: %w", err)
+	}
+	s.mu.Lock()
+	s.active[id] = true
+	s.mu.Unlock()
+	return &Recorder{
+		store:   s,
+		id:      id,
+		meta:    meta,
+		file:    file,
+		width:   defaultWidth,
+		height:  defaultHeight,
+		partial: map[string][]byte{},
+	}, nil
+}
+
+// ID returns the identifier of the recording
+func (r *Recorder) ID() string {
+	if r == nil {
+		return ""
+	}
+	return r.id
+}
+
+// Output records data written by the device to the terminal
+func (r *Recorder) Output(data []byte) {
+	r.record(eventOutput, data)
+}
+
+// Input records data typed by the user
+func (r *Recorder) Input(data []byte) {
+	r.record(eventInput, data)
+}
+
+// Resize records a change of the terminal size
+func (r *Recorder) Resize(width, height int) {
+	if r == nil || width <= 0 || height <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	if !r.headerWritten {
+		// The browser sends its size first, which becomes the initial size of the recording
+		r.width, r.height = width, height
+		r.writeHeaderLocked()
+		return
+	}
+	r.writeEventLocked(eventResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+func (r *Recorder) record(eventType string, data []byte) {
+	if r == nil || len(data) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	data = append(r.partial[eventType], data...)
+	// Keep an incomplete trailing character until the rest of it arrives
+	complete := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				complete = i
+			}
+			break
+		}
+	}
+	r.partial[eventType] = append([]byte(nil), data[complete:]...)
+	if complete > 0 {
+		r.writeEventLocked(eventType, string(data[:complete]))
+	}
+}
+
+func (r *Recorder) writeHeaderLocked() {
+	if r.headerWritten || r.stopped {
+		return
+	}
+	r.headerWritten = true
+	r.writeLineLocked(header{
+		Version:   2,
+		Width:     r.width,
+		Height:    r.height,
+		Timestamp: r.meta.StartedAt.Unix(),
+		Title:     fmt.Sprintf("%s on %s", r.meta.Username, r.meta.Device),
+		Env:       map[string]string{"TERM": "xterm-256color"},
+		Metadata:  r.meta,
+	}, true)
+}
+
+func (r *Recorder) writeEventLocked(eventType, data string) {
+	r.writeHeaderLocked()
+	if r.stopped {
+		return
+	}
+	elapsed := time.Since(r.meta.StartedAt).Seconds()
+	event := []interface{}{json.Number(strconv.FormatFloat(elapsed, 'f', 6, 64)), eventType, data}
+	r.writeLineLocked(event, false)
+}
+
+// writeLineLocked appends a JSON line, and stops the recording once it reaches its size limit
+func (r *Recorder) writeLineLocked(value interface{}, force bool) {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if !force && r.store.maxSize > 0 && r.size+int64(len(line)) > r.store.maxSize {
+		r.stopped = true
+		log.GetLogger().Warnf("Terminal recording %s reached its size limit, the rest of the session is not recorded", r.id)
+		elapsed := time.Since(r.meta.StartedAt).Seconds()
+		line, _ = json.Marshal([]interface{}{json.Number(strconv.FormatFloat(elapsed, 'f', 6, 64)), eventMarker, "recording stopped: size limit reached"})
+		line = append(line, '\n')
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		r.stopped = true
+		log.GetLogger().WithError(err).Errorf("Failed to write terminal recording %s", r.id)
+	}
+}
+
+// Close ends the recording. The output still forwarded by the session afterwards is dropped.
+func (r *Recorder) Close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeHeaderLocked()
+	r.stopped = true
+	if err := r.file.Close(); err != nil {
+		log.GetLogger().WithError(err).Errorf("Failed to close terminal recording %s", r.id)
+	}
+	r.store.mu.Lock()
+	delete(r.store.active, r.id)
+	r.store.mu.Unlock()
+}
+
+// Info describes a stored recording
+type Info struct {
+	ID string `json:"id"`
+	Metadata
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Active    bool      `json:"active"`
+}
+
+func (s *store) path(id string) (string, bool) {
+	if !recordingIDRegex.MatchString(id) {
+		return "", false
+	}
+	return filepath.Join(s.dir, id+fileExtension), true
+}
+
+// readInfo reads the header of a recording
+func (s *store) readInfo(id string) (Info, error) {
+	path, _ := s.path(id)
+	file, err := os.Open(path)
+	if err != nil {
+		return Info{}, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{ID: id, Size: stat.Size(), UpdatedAt: stat.ModTime()}
+	var h header
+	if err := json.NewDecoder(file).Decode(&h); err == nil {
+		info.Metadata, info.Width, info.Height = h.Metadata, h.Width, h.Height
+	}
+	s.mu.Lock()
+	info.Active = s.active[id]
+	s.mu.Unlock()
+	return info, nil
+}
+
+// list returns the recordings, most recent first
+func (s *store) list() ([]Info, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := []Info{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), fileExtension)
+		if !ok || entry.IsDir() || !recordingIDRegex.MatchString(id) {
+			continue
+		}
+		info, err := s.readInfo(id)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	// IDs start with the UTC start time of the session
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID > infos[j].ID })
+	return infos, nil
+}
+
+// cleanup deletes the recordings older than the retention period, then the oldest recordings
+// until the directory fits in its total size. Recordings in progress are never deleted.
+func (s *store) cleanup(now time.Time) {
+	infos, err := s.list()
+	if err != nil {
+		log.GetLogger().WithError(err).Warn("Failed to list the terminal recordings")
+		return
+	}
+	var total int64
+	for _, info := range infos {
+		total += info.Size
+	}
+	// Oldest first
+	for i := len(infos) - 1; i >= 0; i-- {
+		info := infos[i]
+		expired := s.retention > 0 && now.Sub(info.UpdatedAt) > s.retention
+		oversized := s.maxTotalSize > 0 && total > s.maxTotalSize
+		if info.Active || (!expired && !oversized) {
+			continue
+		}
+		path, _ := s.path(info.ID)
+		if err := os.Remove(path); err != nil {
+			log.GetLogger().WithError(err).Warnf("Failed to delete terminal recording %s", info.ID)
+			continue
+		}
+		total -= info.Size
+		log.GetLogger().Infof("Deleted terminal recording %s", info.ID)
+	}
+}
@@ -0,0 +1,221 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flightctl/flightctl-ui/common"
+	"github.com/flightctl/flightctl-ui/config"
+	"github.com/flightctl/flightctl-ui/log"
+	"github.com/gorilla/mux"
+)
+
+func TestMain(m *testing.M) {
+	log.InitLogs()
+	os.Exit(m.Run())
+}
+
+func newTestStore(t *testing.T, maxSize int64) *store {
+	t.Helper()
+	s := &store{dir: t.TempDir(), maxSize: maxSize, active: map[string]bool{}}
+	recordings = s
+	t.Cleanup(func() { recordings = nil })
+	return s
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open the recording: %v", err)
+	}
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestRecorderWritesAsciicast(t *testing.T) { //nolint:paralleltest // uses the package-level store
+	s := newTestStore(t, 0)
+
+	recorder, err := NewRecorder(Metadata{SessionID: "0123456789abcdef", Username: "alice", Device: "dev1"})
+	if err != nil {
+		t.Fatalf("failed to start the recording: %v", err)
+	}
+	recorder.Resize(120, 40)
+	recorder.Input([]byte("ls\r"))
+	// "é" split across two messages must be recorded as a single character
+	recorder.Output([]byte("caf\xc3"))
+	recorder.Output([]byte("\xa9\r\n"))
+	recorder.Resize(100, 30)
+	recorder.Close()
+	// The session can still forward output while it shuts down
+	recorder.Output([]byte("late"))
+	recorder.Resize(80, 24)
+
+	lines := readLines(t, filepath.Join(s.dir, recorder.ID()+fileExtension))
+	if len(lines) != 5 {
+		t.Fatalf("expected a header and 4 events, got %d lines: %v", len(lines), lines)
+	}
+	var h header
+	if err := json.Unmarshal([]byte(lines[0]), &h); err != nil {
+		t.Fatalf("invalid header: %v", err)
+	}
+	if h.Version != 2 || h.Width != 120 || h.Height != 40 || h.Metadata.Username != "alice" || h.Metadata.Device != "dev1" {
+		t.Errorf("unexpected header: %+v", h)
+	}
+
+	expected := [][2]string{{"i", "ls\r"}, {"o", "caf"}, {"o", "é\r\n"}, {"r", "100x30"}}
+	for i, want := range expected {
+		var event []interface{}
+		if err := json.Unmarshal([]byte(lines[i+1]), &event); err != nil || len(event) != 3 {
+			t.Fatalf("invalid event %q: %v", lines[i+1], err)
+		}
+		if _, ok := event[0].(float64); !ok || event[1] != want[0] || event[2] != want[1] {
+			t.Errorf("event %d = %v, want %v", i, event, want)
+		}
+	}
+}
+
+func TestRecorderStopsAtSizeLimit(t *testing.T) { //nolint:paralleltest // uses the package-level store
+	s := newTestStore(t, 600)
+
+	recorder, err := NewRecorder(Metadata{SessionID: "0123456789abcdef", Device: "dev1"})
+	if err != nil {
+		t.Fatalf("failed to start the recording: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		recorder.Output([]byte(strings.Repeat("x", 50)))
+	}
+	recorder.Close()
+
+	lines := readLines(t, filepath.Join(s.dir, recorder.ID()+fileExtension))
+	if !strings.Contains(lines[len(lines)-1], `"m"`) {
+		t.Errorf("expected the recording to end with a marker, got %q", lines[len(lines)-1])
+	}
+	if len(lines) > 10 {
+		t.Errorf("expected the recording to stop at the size limit, got %d lines", len(lines))
+	}
+}
+
+func TestNilRecorder(t *testing.T) { //nolint:paralleltest // uses the package-level store
+	recordings = nil
+	recorder, err := NewRecorder(Metadata{Device: "dev1"})
+	if recorder != nil || err != nil {
+		t.Fatalf("expected no recorder when recording is disabled, got %v, %v", recorder, err)
+	}
+	recorder.Output([]byte("ignored"))
+	recorder.Resize(80, 24)
+	recorder.Close()
+}
+
+func TestCleanup(t *testing.T) { //nolint:paralleltest // uses the package-level store
+	s := newTestStore(t, 0)
+	s.retention = 24 * time.Hour
+	now := time.Now()
+
+	write := func(id string, age time.Duration, size int) {
+		path := filepath.Join(s.dir, id+fileExtension)
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", size)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("20260101T000000Z-0000000000000001", 48*time.Hour, 10)
+	write("20260102T000000Z-0000000000000002", time.Hour, 100)
+	write("20260103T000000Z-0000000000000003", time.Hour, 100)
+	write("20260104T000000Z-0000000000000004", 48*time.Hour, 10)
+	s.active["20260104T000000Z-0000000000000004"] = true
+
+	s.maxTotalSize = 150
+	s.cleanup(now)
+
+	infos, err := s.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, info := range infos {
+		ids = append(ids, info.ID)
+	}
+	// The expired recording and the oldest recording over the total size are deleted, the active one is kept
+	want := []string{"20260104T000000Z-0000000000000004", "20260103T000000Z-0000000000000003"}
+	if strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Errorf("remaining recordings = %v, want %v", ids, want)
+	}
+}
+
+func TestHandlers(t *testing.T) { //nolint:paralleltest // uses the package-level store
+	newTestStore(t, 0)
+	for _, meta := range []Metadata{
+		{SessionID: "0000000000000001", Username: "alice", Instance: "default", Device: "dev1"},
+		{SessionID: "0000000000000002", Username: "bob", Instance: "default", Device: "dev2"},
+		{SessionID: "0000000000000003", Username: "bob", Instance: "eu", Device: "dev3"},
+	} {
+		recorder, err := NewRecorder(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder.Output([]byte("hello"))
+		recorder.Close()
+	}
+
+	rec := httptest.NewRecorder()
+	ListHandler(rec, httptest.NewRequest(http.MethodGet, "/api/admin/terminal-recordings?user=bob", nil))
+	var infos []Info
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatalf("invalid list response: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Device != "dev2" {
+		t.Fatalf("expected only the recording of bob, got %+v", infos)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/admin/terminal-recordings/{id}", GetHandler)
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/admin/terminal-recordings/"+infos[0].ID, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-asciicast" {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), `"o","hello"`) {
+		t.Errorf("expected the recording to be returned, got %s", rec.Body.String())
+	}
+
+	// The recordings of another instance are hidden from its administrators
+	rec = httptest.NewRecorder()
+	ListHandler(rec, httptest.NewRequest(http.MethodGet, "/api/admin/terminal-recordings?user=bob&instance=eu", nil))
+	if strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Fatalf("expected no recording of another instance, got %s", rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	ListHandler(rec, httptest.NewRequest(http.MethodGet, "/api/admin/terminal-recordings", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil || len(infos) != 2 || infos[0].Instance != "default" {
+		t.Fatalf("expected the recordings of the default instance, got %s", rec.Body.String())
+	}
+	eu := httptest.NewRequest(http.MethodGet, "/api/admin/terminal-recordings/"+infos[0].ID, nil)
+	eu = eu.WithContext(common.WithInstance(eu.Context(), config.Instance{Name: "eu"}))
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, eu)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for the recording of another instance, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/admin/terminal-recordings/not-a-recording", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid ID to be rejected, got %d", rec.Code)
+	}
+}
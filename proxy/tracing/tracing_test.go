@@ -0,0 +1,47 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSpansAreExportedToCollector(t *testing.T) {
+	var exported atomic.Int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/v1/traces" {
+			exported.Add(1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+
+	shutdown, err := Init(context.Background())
+	if err != nil {
+		t.Fatalf("failed to initialize tracing: %v", err)
+	}
+
+	ctx, span := Start(context.Background(), "test", trace.SpanKindInternal)
+	header := http.Header{}
+	Inject(ctx, header)
+	span.End()
+
+	if header.Get("traceparent") == "" {
+		t.Error("expected the trace context to be injected in the headers")
+	}
+	if TraceID(Extract(context.Background(), header)) != TraceID(ctx) {
+		t.Error("expected the extracted trace to match the injected one")
+	}
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to flush spans: %v", err)
+	}
+	if exported.Load() == 0 {
+		t.Error("expected spans to be exported to the collector")
+	}
+}